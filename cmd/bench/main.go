@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const usage = `usage: bench [flags]
+  sends receipts to a running app from many clients at once and reports the throughput and latencies,
+  e.g. run it against the app with and without the tx batch window (-c) to compare`
+
+func main() {
+
+	addr := flag.String("a", "http://localhost:5555", "app address")
+	users := flag.Int("u", 1, "number of users to send receipts to, users 1..u")
+	clients := flag.Int("n", 50, "number of concurrent clients")
+	duration := flag.Duration("d", time.Second*10, "benchmark duration")
+	sum := flag.String("s", "0.01", "sum of every receipt")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *users < 1 || *clients < 1 || *duration <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	httpClient := &http.Client{Timeout: time.Minute}
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	statuses := map[int]int{}
+	errs := 0
+
+	wg := sync.WaitGroup{}
+	started := time.Now()
+
+	for client := 0; client < *clients; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+
+			for req := 0; ctx.Err() == nil; req++ {
+				userID := (client+req)%*users + 1
+				reqStarted := time.Now()
+
+				resp, err := httpClient.Post(fmt.Sprintf("%s/%d/receipt/%s", *addr, userID, *sum), "", nil)
+				latency := time.Since(reqStarted)
+
+				mu.Lock()
+				if err != nil {
+					errs++
+				} else {
+					resp.Body.Close()
+					statuses[resp.StatusCode]++
+					latencies = append(latencies, latency)
+				}
+				mu.Unlock()
+			}
+		}(client)
+	}
+
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return latencies[int(float64(len(latencies)-1)*p)]
+	}
+
+	fmt.Printf("requests:   %d in %s, %d failed to send\n", len(latencies), elapsed.Round(time.Millisecond), errs)
+	fmt.Printf("throughput: %.1f req/s\n", float64(len(latencies))/elapsed.Seconds())
+	fmt.Printf("latency:    p50 %s, p90 %s, p99 %s\n", percentile(0.5), percentile(0.9), percentile(0.99))
+	for status, count := range statuses {
+		fmt.Printf("status %d: %d\n", status, count)
+	}
+
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
@@ -9,9 +13,16 @@ import (
 
 	"transactions/internal/api"
 	"transactions/internal/config"
+	"transactions/internal/memstore"
 	"transactions/internal/pg"
+	"transactions/internal/sqlite"
 )
 
+type storage interface {
+	api.Storage
+	InitFirstFiveUsersIfNotExistsForTestingApp() (err error)
+}
+
 func main() {
 
 	gin.SetMode(gin.ReleaseMode)
@@ -33,7 +44,15 @@ func main() {
 	}
 	zerolog.SetGlobalLevel(logLevel)
 
-	newStorage, err := pg.New(newCfg.PgConnString())
+	var newStorage storage
+	switch {
+	case newCfg.InMemoryStorage():
+		newStorage = memstore.New()
+	case strings.HasPrefix(newCfg.PgConnString(), sqlite.DSNScheme):
+		newStorage, err = sqlite.New(newCfg.PgConnString())
+	default:
+		newStorage, err = pg.New(newCfg.PgConnString())
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("creating storage")
 		os.Exit(1)
@@ -53,6 +72,12 @@ func main() {
 	}
 	log.Info().Msg("api created")
 
-	newAPI.Run()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	if err = newAPI.Run(ctx); err != nil {
+		log.Error().Err(err).Msg("running API")
+		os.Exit(1)
+	}
 
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"transactions/internal/config"
+	"transactions/internal/pg"
+)
+
+const usage = `usage: migrate [flags] up | down [steps] | status
+  up             apply all pending migrations
+  down [steps]   revert the last steps applied migrations, 1 by default
+  status         list migrations and when they were applied`
+
+func main() {
+
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	newCfg, err := config.New(config.WithFlag, config.WithEnv)
+	if err != nil {
+		log.Error().Err(err).Msg("creating config")
+		os.Exit(1)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	migrator, err := pg.NewMigrator(newCfg.PgConnString())
+	if err != nil {
+		log.Error().Err(err).Msg("creating migrator")
+		os.Exit(1)
+	}
+	defer migrator.Close()
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("applying migrations")
+			os.Exit(1)
+		}
+		log.Info().Int("applied", applied).Msg("migrations applied")
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				fmt.Fprintln(os.Stderr, usage)
+				os.Exit(2)
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		if err != nil {
+			log.Error().Err(err).Msg("reverting migrations")
+			os.Exit(1)
+		}
+		log.Info().Int("reverted", reverted).Msg("migrations reverted")
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("getting migrations status")
+			os.Exit(1)
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = "applied at " + status.AppliedAt.Format(time.RFC3339)
+			}
+			if status.IsUnknown {
+				appliedAt += " (unknown to this build)"
+			}
+			fmt.Printf("%04d %-30s %s\n", status.Version, status.Name, appliedAt)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+}
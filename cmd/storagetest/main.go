@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"transactions/internal/config"
+	"transactions/internal/memstore"
+	"transactions/internal/pg"
+	"transactions/internal/sqlite"
+	"transactions/internal/storagetest"
+)
+
+// caseT reports the failures of a case. Fatalf ends the goroutine of the case like testing.T.Fatalf does.
+type caseT struct {
+	name   string
+	mu     sync.Mutex
+	failed bool
+}
+
+func (t *caseT) Helper() {}
+
+func (t *caseT) Errorf(format string, args ...any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.failed = true
+	fmt.Printf("    %s: %s\n", t.name, fmt.Sprintf(format, args...))
+}
+
+func (t *caseT) Fatalf(format string, args ...any) {
+	t.Errorf(format, args...)
+	runtime.Goexit()
+}
+
+func main() {
+
+	// The cases provoke errors on purpose, and the storages log every error.
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+
+	newCfg, err := config.New(config.WithFlag, config.WithEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "creating config:", err)
+		os.Exit(1)
+	}
+
+	newStorage := func() (storagetest.Storage, error) {
+		switch {
+		case newCfg.InMemoryStorage():
+			return memstore.New(), nil
+		case strings.HasPrefix(newCfg.PgConnString(), sqlite.DSNScheme):
+			return sqlite.New(newCfg.PgConnString())
+		default:
+			return pg.New(newCfg.PgConnString())
+		}
+	}
+
+	var failed int
+	for _, c := range storagetest.Cases {
+		t := &caseT{name: c.Name}
+		start := time.Now()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			storagetest.RunCase(t, c, newStorage)
+		}()
+		<-done
+
+		if t.failed {
+			failed++
+			fmt.Printf("--- FAIL: %s (%s)\n", c.Name, time.Since(start).Round(time.Millisecond))
+		} else {
+			fmt.Printf("--- ok: %s (%s)\n", c.Name, time.Since(start).Round(time.Millisecond))
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("FAIL: %d of %d cases\n", failed, len(storagetest.Cases))
+		os.Exit(1)
+	}
+	fmt.Printf("ok: %d cases\n", len(storagetest.Cases))
+
+}
@@ -1,22 +1,36 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/net/context"
 	"golang.org/x/sync/errgroup"
+
+	"transactions/internal/model"
+	"transactions/internal/validation"
 )
 
 type API struct {
-	server            *http.Server
-	storage           Storage
-	txQueuesProcesses *txQueuesProcesses
+	server                  *http.Server
+	storage                 Storage
+	amountValidator         *validation.AmountValidator
+	currency                string
+	txQueueActors           *txQueueActors
+	txQueuesProcessor       *txQueuesProcessor
+	idempotencyKeyRetention time.Duration
+	txRetryPolicy           model.RetryPolicy
+	shutdownGracePeriod     time.Duration
+	txBatchWindow           time.Duration
+	txBatchSize             int
+	// workCtx is the parent context of the tx queues processing runs. It is canceled by cancelWork
+	// once the shutdown grace period is over.
+	workCtx    context.Context
+	cancelWork context.CancelFunc
 }
 
 func New(storage Storage, config Config) (newAPI *API, err error) {
@@ -33,10 +47,39 @@ func New(storage Storage, config Config) (newAPI *API, err error) {
 
 	newAPI.storage = storage
 
+	newAPI.amountValidator, err = validation.NewAmountValidator(config.AmountMaxPrecision(), map[validation.Operation]validation.Limits{
+		validation.OperationReceipt:  config.ReceiptAmountLimits(),
+		validation.OperationWithdraw: config.WithdrawAmountLimits(),
+		validation.OperationTransfer: config.TransferAmountLimits(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating amount validator: %w", err)
+	}
+
+	newAPI.currency = config.Currency()
+
 	server := newAPI.newServer(config.RunAPIAddress())
 	newAPI.server = server
 
-	newAPI.txQueuesProcesses = newTxQueuesProcesses()
+	newAPI.txQueueActors = newTxQueueActors()
+
+	newAPI.txQueuesProcessor = newTxQueuesProcessor(config.TxQueuesPollInterval(), config.TxQueuesWorkers())
+
+	newAPI.idempotencyKeyRetention = config.IdempotencyKeyRetention()
+
+	newAPI.shutdownGracePeriod = config.ShutdownGracePeriod()
+
+	newAPI.txBatchWindow = config.TxBatchWindow()
+
+	newAPI.txBatchSize = config.TxBatchSize()
+
+	newAPI.workCtx, newAPI.cancelWork = context.WithCancel(context.Background())
+
+	newAPI.txRetryPolicy = model.RetryPolicy{
+		MaxAttempts: config.TxMaxAttempts(),
+		BaseDelay:   config.TxRetryBaseDelay(),
+		MaxDelay:    config.TxRetryMaxDelay(),
+	}
 
 	return newAPI, nil
 }
@@ -60,127 +103,122 @@ func (a *API) newRouter() *gin.Engine {
 	log.Debug().Msg("api.newRouter START")
 	defer log.Debug().Msg("api.newRouter END")
 
-	newRouter := gin.Default()
+	newRouter := gin.New()
+	newRouter.HandleMethodNotAllowed = true
+
+	newRouter.Use(setRequestID, gin.Logger(), gin.CustomRecovery(func(c *gin.Context, recovered any) {
+		respondError(c, fmt.Errorf("panic: %v", recovered))
+		c.Abort()
+	}))
+
+	newRouter.NoRoute(func(c *gin.Context) {
+		respondError(c, fmt.Errorf("%w: %s %s", errRouteNotFound, c.Request.Method, c.Request.URL.Path))
+	})
+	newRouter.NoMethod(func(c *gin.Context) {
+		respondError(c, fmt.Errorf("%w: %s %s", errMethodNotAllowed, c.Request.Method, c.Request.URL.Path))
+	})
+
+	// The legacy routes put the amount into the URL, so it ends up in the access logs. Use the /v1 ones.
+	newRouter.POST("/:id/receipt/:sum", deprecated("/v1/users/:id/receipts"), a.checkValid(validation.OperationReceipt), a.receiptHandler)
+	newRouter.POST("/:id/withdraw/:sum", deprecated("/v1/users/:id/withdrawals"), a.checkValid(validation.OperationWithdraw), a.withdrawHandler)
 
-	newRouter.Use(a.checkValid)
+	newRouter.GET("/transactions/:id", a.checkValidID, a.getTxHandler)
+	newRouter.GET("/users/:id/balance", a.checkValidID, a.getBalanceHandler)
+	newRouter.GET("/users/:id/transactions", a.checkValidID, a.getTxsHandler)
 
-	newRouter.POST("/:id/receipt/:sum", a.receiptHandler)
-	newRouter.POST("/:id/withdraw/:sum", a.withdrawHandler)
+	newRouter.POST("/transfers", a.transferHandler)
+
+	v1 := newRouter.Group("/v1")
+	v1.POST("/users/:id/receipts", a.checkValidID, a.v1ReceiptHandler)
+	v1.POST("/users/:id/withdrawals", a.checkValidID, a.v1WithdrawalHandler)
+
+	admin := newRouter.Group("/admin")
+	admin.GET("/dead-letters", a.getDeadLettersHandler)
+	admin.POST("/dead-letters/:id/requeue", a.checkValidID, a.requeueDeadLetterHandler)
+	admin.POST("/dead-letters/:id/discard", a.checkValidID, a.discardDeadLetterHandler)
 
 	return newRouter
 }
 
-func (a *API) Run() {
+// Run serves the API and runs the background work until ctx is done or any of them fails.
+// Then it shuts down in order: it stops accepting requests and lets the handlers in flight finish,
+// stops the background work and lets the tx queues processing in progress finish, and closes the storage.
+// The handlers and the processing get the shutdown grace period in total; whatever is still running after it is canceled.
+func (a *API) Run(ctx context.Context) (err error) {
 	log.Debug().Msg("api.Run START")
 	defer log.Debug().Msg("api.Run END")
 
-	shutdown := make(chan os.Signal, 1)
-	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
-
-	errG, ctx := errgroup.WithContext(context.Background())
+	errG, stopCtx := errgroup.WithContext(ctx)
 
 	errG.Go(func() error {
-		return a.startProcessingTxQueues(ctx, shutdown)
+		return a.startProcessingTxQueues(stopCtx)
 	})
 
 	errG.Go(func() error {
-		return a.startListener(ctx, shutdown)
+		return a.startPurgingIdempotencyKeys(stopCtx)
 	})
 
-	if err := errG.Wait(); err != nil {
-		log.Error().Err(err).Msg(err.Error())
-		close(shutdown)
+	if auditor, ok := a.storage.(LedgerAuditor); ok {
+		errG.Go(func() error {
+			return a.startAuditingLedger(stopCtx, auditor)
+		})
 	}
 
-	<-shutdown
-	if err := a.storage.Close(); err != nil {
-		log.Printf("storage closing: %v", err)
-	} else {
-		log.Info().Msg("storage closed")
-	}
-	if err := a.server.Shutdown(context.Background()); err != nil {
-		log.Printf("HTTP server Shutdown: %v", err)
-	} else {
-		log.Info().Msg("HTTP server gracefully shutdown")
+	if listener, ok := a.storage.(TxQueuesListener); ok {
+		errG.Go(func() error {
+			return a.startListeningTxQueues(stopCtx, listener)
+		})
 	}
-}
 
-func (a *API) startProcessingTxQueues(ctx context.Context, shutdown chan os.Signal) (err error) {
+	errG.Go(func() error {
+		return a.startListener(stopCtx)
+	})
+
+	<-stopCtx.Done()
+	log.Info().Dur("gracePeriod", a.shutdownGracePeriod).Msg("shutting down")
 
-	ended := make(chan struct{})
+	graceCtx, cancelGrace := context.WithTimeout(context.Background(), a.shutdownGracePeriod)
+	defer cancelGrace()
 
 	go func() {
-		select {
-		case <-ctx.Done():
-			return
-		case _, ok := <-shutdown:
-			if ok {
-				close(shutdown)
-			}
-			return
-		default:
-			users, errGetting := a.storage.GetUsersWithNonEmptyTxQueues(ctx)
-			if errGetting != nil {
-				errGetting = fmt.Errorf("getting users with non empty tx queues: %w", err)
-				err = errGetting
-				ended <- struct{}{}
-			}
-			if len(users) > 0 {
-				log.Info().Msg("start processing tx queues")
-			}
-			for _, userID := range users {
-				txQueueProcess := a.txQueueProcess(userID)
-				a.tryToProcessTxQueue(ctx, userID, txQueueProcess)
-				log.Info().Str("userID", fmt.Sprint(userID)).Msg("queue txs processed")
-			}
-			ended <- struct{}{}
-		}
+		<-graceCtx.Done()
+		a.cancelWork()
 	}()
 
-	select {
-	case <-ctx.Done():
-		return err
-	case _, ok := <-shutdown:
-		if ok {
-			close(shutdown)
-		}
-		return err
-	case <-ended:
-		return err
+	if errShutdown := a.server.Shutdown(graceCtx); errShutdown != nil {
+		log.Warn().Err(errShutdown).Msg("HTTP server shutdown")
+	} else {
+		log.Info().Msg("HTTP server gracefully shutdown")
 	}
 
-}
+	err = errG.Wait()
+	if err != nil {
+		log.Error().Err(err).Msg("running API")
+	}
 
-func (a *API) startListener(ctx context.Context, shutdown chan os.Signal) (err error) {
+	a.stopTxQueueActors()
+	if errWaiting := a.waitForTxQueueActors(graceCtx); errWaiting != nil {
+		log.Warn().Err(errWaiting).Msg("waiting for tx queues processing")
+	} else {
+		log.Info().Msg("tx queues processing finished")
+	}
 
-	ended := make(chan struct{})
+	if errClosing := a.storage.Close(); errClosing != nil {
+		log.Warn().Err(errClosing).Msg("storage closing")
+	} else {
+		log.Info().Msg("storage closed")
+	}
 
-	go func() {
-		select {
-		case <-ctx.Done():
-			return
-		case _, ok := <-shutdown:
-			if ok {
-				close(shutdown)
-			}
-			return
-		default:
-			log.Info().Str("addr", a.server.Addr).Msg("starting http server")
-			err = a.server.ListenAndServe()
-			ended <- struct{}{}
-		}
-	}()
+	return err
+}
 
-	select {
-	case <-ctx.Done():
-		return err
-	case _, ok := <-shutdown:
-		if ok {
-			close(shutdown)
-		}
-		return err
-	case <-ended:
-		return err
+func (a *API) startListener(ctx context.Context) (err error) {
+
+	log.Info().Str("addr", a.server.Addr).Msg("starting http server")
+
+	if err = a.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serving http: %w", err)
 	}
 
+	return nil
 }
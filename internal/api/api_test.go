@@ -0,0 +1,320 @@
+package api
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+
+	"transactions/internal/memstore"
+	"transactions/internal/model"
+	"transactions/internal/money"
+	"transactions/internal/validation"
+)
+
+func TestMain(m *testing.M) {
+
+	// The tests provoke errors on purpose, and the API logs every error and every request.
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+
+	os.Exit(m.Run())
+}
+
+// testConfig is the config of the API under test: the defaults of the app, but for the fields set by the test.
+type testConfig struct {
+	runAPIAddress       string
+	txBatchWindow       time.Duration
+	shutdownGracePeriod time.Duration
+}
+
+func (c testConfig) RunAPIAddress() string                   { return c.runAPIAddress }
+func (c testConfig) IdempotencyKeyRetention() time.Duration  { return time.Hour * 24 }
+func (c testConfig) TxQueuesPollInterval() time.Duration     { return time.Second * 5 }
+func (c testConfig) TxQueuesWorkers() int                    { return 4 }
+func (c testConfig) TxMaxAttempts() int                      { return 5 }
+func (c testConfig) TxRetryBaseDelay() time.Duration         { return time.Second }
+func (c testConfig) TxRetryMaxDelay() time.Duration          { return time.Minute * 5 }
+func (c testConfig) TxBatchWindow() time.Duration            { return c.txBatchWindow }
+func (c testConfig) TxBatchSize() int                        { return 100 }
+func (c testConfig) AmountMaxPrecision() int                 { return money.Scale }
+func (c testConfig) ReceiptAmountLimits() validation.Limits  { return validation.Limits{} }
+func (c testConfig) WithdrawAmountLimits() validation.Limits { return validation.Limits{} }
+func (c testConfig) TransferAmountLimits() validation.Limits { return validation.Limits{} }
+func (c testConfig) Currency() string                        { return "USD" }
+
+func (c testConfig) ShutdownGracePeriod() time.Duration {
+	if c.shutdownGracePeriod == 0 {
+		return time.Second * 30
+	}
+	return c.shutdownGracePeriod
+}
+
+func newTestAPI(t testing.TB, storage Storage, config testConfig) *API {
+	t.Helper()
+
+	a, err := New(storage, config)
+	if err != nil {
+		t.Fatalf("creating API: %v", err)
+	}
+
+	return a
+}
+
+// freeAddress returns a local address nobody listens on.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+// shutdownCheckingStorage is the memstore that records how the API used it around Close:
+// the calls running when it was closed, the calls made after it, and the actors that had not exited yet.
+type shutdownCheckingStorage struct {
+	*memstore.MemStore
+	a *API
+
+	addedTxs        atomic.Int64
+	activeCalls     atomic.Int64
+	isClosed        atomic.Bool
+	callsAfterClose atomic.Int64
+
+	activeCallsAtClose int64
+	actorsAtClose      int
+}
+
+func (s *shutdownCheckingStorage) call() (done func()) {
+	if s.isClosed.Load() {
+		s.callsAfterClose.Add(1)
+	}
+	s.activeCalls.Add(1)
+	return func() { s.activeCalls.Add(-1) }
+}
+
+func (s *shutdownCheckingStorage) AddTx(ctx context.Context, userID int64, sum money.Amount, details model.TxDetails,
+	idempotencyKey string) (txID int64, isReplay bool, err error) {
+	defer s.call()()
+	defer s.addedTxs.Add(1)
+	return s.MemStore.AddTx(ctx, userID, sum, details, idempotencyKey)
+}
+
+func (s *shutdownCheckingStorage) GetTx(ctx context.Context, txID int64) (tx model.Tx, err error) {
+	defer s.call()()
+	return s.MemStore.GetTx(ctx, txID)
+}
+
+func (s *shutdownCheckingStorage) ProcessTxQueue(ctx context.Context, userID int64) (processed []model.Tx, err error) {
+	defer s.call()()
+	return s.MemStore.ProcessTxQueue(ctx, userID)
+}
+
+func (s *shutdownCheckingStorage) GetUsersWithNonEmptyTxQueues(ctx context.Context) (users []int64, err error) {
+	defer s.call()()
+	return s.MemStore.GetUsersWithNonEmptyTxQueues(ctx)
+}
+
+func (s *shutdownCheckingStorage) Close() (err error) {
+
+	s.activeCallsAtClose = s.activeCalls.Load()
+
+	s.a.txQueueActors.mu.Lock()
+	s.actorsAtClose = len(s.a.txQueueActors.userActors)
+	s.a.txQueueActors.mu.Unlock()
+
+	s.isClosed.Store(true)
+
+	return s.MemStore.Close()
+}
+
+// TestRunShutdownDrainsInFlightRequests cancels Run while receipts wait in the batch window of the user's actor:
+// every request in flight must be answered with its result, and the storage closed only after the handlers and the actors.
+func TestRunShutdownDrainsInFlightRequests(t *testing.T) {
+
+	const requests = 20
+
+	storage := &shutdownCheckingStorage{MemStore: memstore.New()}
+	userID, err := storage.AddUser()
+	if err != nil {
+		t.Fatalf("adding user: %v", err)
+	}
+
+	address := freeAddress(t)
+	a := newTestAPI(t, storage, testConfig{runAPIAddress: address, txBatchWindow: time.Millisecond * 200})
+	storage.a = a
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- a.Run(ctx)
+	}()
+
+	client := &http.Client{Timeout: time.Second * 10, Transport: &http.Transport{DisableKeepAlives: true}}
+	url := fmt.Sprintf("http://%s/v1/users/%d/receipts", address, userID)
+
+	waitForServer(t, client, fmt.Sprintf("http://%s/users/%d/balance", address, userID))
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Post(url, "application/json", strings.NewReader(`{"amount":"1.00"}`))
+			if err != nil {
+				t.Errorf("posting receipt: %v", err)
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+
+	// The shutdown starts once all the requests are queued, while their run waits for the batch window.
+	for storage.addedTxs.Load() < requests {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	wg.Wait()
+	close(statuses)
+
+	for status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("receipt in flight: got status %d, want %d", status, http.StatusOK)
+		}
+	}
+
+	select {
+	case err = <-runErr:
+		if err != nil {
+			t.Errorf("running API: %v", err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("Run didn't return after the shutdown")
+	}
+
+	if !storage.isClosed.Load() {
+		t.Error("storage is not closed")
+	}
+	if storage.activeCallsAtClose != 0 {
+		t.Errorf("storage closed with %d calls running", storage.activeCallsAtClose)
+	}
+	if storage.actorsAtClose != 0 {
+		t.Errorf("storage closed with %d tx queue actors running", storage.actorsAtClose)
+	}
+	if calls := storage.callsAfterClose.Load(); calls != 0 {
+		t.Errorf("storage called %d times after Close", calls)
+	}
+}
+
+func waitForServer(t *testing.T, client *http.Client, url string) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			return
+		}
+	}
+
+	t.Fatalf("server at %s didn't start", url)
+}
+
+func TestRequestTxQueueRunAfterStop(t *testing.T) {
+
+	a := newTestAPI(t, memstore.New(), testConfig{})
+
+	a.stopTxQueueActors()
+
+	if err := <-a.requestTxQueueRun(1); !errors.Is(err, errTxIsStillPending) {
+		t.Errorf("got %v, want %v", err, errTxIsStillPending)
+	}
+
+	if len(a.txQueueActors.userActors) != 0 {
+		t.Errorf("got %d actors started after the stop, want none", len(a.txQueueActors.userActors))
+	}
+
+	if err := a.waitForTxQueueActors(context.Background()); err != nil {
+		t.Errorf("waiting for tx queue actors: %v", err)
+	}
+}
+
+// failingTxQueueStorage is the memstore whose tx queue processing fails with err.
+type failingTxQueueStorage struct {
+	*memstore.MemStore
+	err error
+}
+
+func (s failingTxQueueStorage) ProcessTxQueue(ctx context.Context, userID int64) (processed []model.Tx, err error) {
+	return nil, s.err
+}
+
+// TestProcessTxQueueFailures checks that only the failures caused by the transaction are counted against it.
+func TestProcessTxQueueFailures(t *testing.T) {
+
+	for _, tc := range []struct {
+		name         string
+		err          error
+		wantAttempts int
+	}{
+		{name: "lost connection", err: fmt.Errorf("processing tx queue: %w", driver.ErrBadConn), wantAttempts: 0},
+		{name: "timeout", err: fmt.Errorf("processing tx queue: %w", context.DeadlineExceeded), wantAttempts: 0},
+		{name: "network", err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, wantAttempts: 0},
+		{name: "failure of the transaction", err: errors.New("processing tx queue: value out of range"), wantAttempts: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+
+			storage := failingTxQueueStorage{MemStore: memstore.New(), err: tc.err}
+			userID, err := storage.AddUser()
+			if err != nil {
+				t.Fatalf("adding user: %v", err)
+			}
+			txID, _, err := storage.AddTx(context.Background(), userID, 100, model.TxDetails{}, "")
+			if err != nil {
+				t.Fatalf("adding tx: %v", err)
+			}
+
+			a := newTestAPI(t, storage, testConfig{})
+			defer func() {
+				a.stopTxQueueActors()
+				if err := a.waitForTxQueueActors(context.Background()); err != nil {
+					t.Errorf("waiting for tx queue actors: %v", err)
+				}
+			}()
+
+			if err = <-a.requestTxQueueRun(userID); !errors.Is(err, tc.err) {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+
+			tx, err := storage.GetTx(context.Background(), txID)
+			if err != nil {
+				t.Fatalf("getting tx: %v", err)
+			}
+			if tx.Status != model.TxStatusPending || tx.Attempts != tc.wantAttempts {
+				t.Errorf("got %s tx with %d attempts, want pending with %d", tx.Status, tx.Attempts, tc.wantAttempts)
+			}
+		})
+	}
+}
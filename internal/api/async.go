@@ -0,0 +1,64 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	asyncQueryParam         = "async"
+	preferHeader            = "Prefer"
+	preferenceAppliedHeader = "Preference-Applied"
+	respondAsyncPreference  = "respond-async"
+)
+
+type txAcceptedView struct {
+	ID        int64  `json:"id"`
+	StatusURL string `json:"status_url"`
+}
+
+// isAsync tells that the client doesn't want to wait for the processing of the transaction:
+// the request has async=true in the query or the Prefer: respond-async header. The query param wins over the header.
+func isAsync(c *gin.Context) (async bool, err error) {
+
+	if reqAsync, ok := c.GetQuery(asyncQueryParam); ok {
+		if async, err = strconv.ParseBool(reqAsync); err != nil {
+			return false, fmt.Errorf("%w: %q", errInvalidAsync, reqAsync)
+		}
+		return async, nil
+	}
+
+	return prefersRespondAsync(c.Request.Header.Values(preferHeader)), nil
+}
+
+// prefersRespondAsync tells that one of the Prefer headers has the respond-async preference, e.g. Prefer: respond-async, wait=10.
+func prefersRespondAsync(prefer []string) bool {
+	for _, header := range prefer {
+		for _, preference := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(preference, ";")
+			name, _, _ = strings.Cut(name, "=")
+			if strings.EqualFold(strings.TrimSpace(name), respondAsyncPreference) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// respondAccepted responds to an async submission with 202, the ID of the transaction and the URL to look it up at.
+// The transaction is processed by the background work, see submitTx.
+func respondAccepted(c *gin.Context, txID int64) {
+
+	statusURL := fmt.Sprintf("/transactions/%d", txID)
+
+	c.Header("Location", statusURL)
+	if prefersRespondAsync(c.Request.Header.Values(preferHeader)) {
+		c.Header(preferenceAppliedHeader, respondAsyncPreference)
+	}
+
+	c.JSON(http.StatusAccepted, txAcceptedView{ID: txID, StatusURL: statusURL})
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"transactions/internal/model"
+	"transactions/internal/money"
+)
+
+const (
+	defaultDeadLettersPageLimit = 50
+	maxDeadLettersPageLimit     = 100
+)
+
+type deadLetterView struct {
+	ID         int64                      `json:"id"`
+	TxID       int64                      `json:"transaction_id"`
+	UserID     int64                      `json:"user_id"`
+	Type       model.TxType               `json:"type"`
+	Amount     money.Amount               `json:"amount"`
+	Attempts   int                        `json:"attempts"`
+	LastError  string                     `json:"last_error"`
+	CreatedAt  time.Time                  `json:"created_at"`
+	ResolvedAt *time.Time                 `json:"resolved_at,omitempty"`
+	Resolution model.DeadLetterResolution `json:"resolution,omitempty"`
+}
+
+func newDeadLetterView(deadLetter model.DeadLetter) deadLetterView {
+	tx := model.Tx{Sum: deadLetter.Sum}
+	return deadLetterView{
+		ID:         deadLetter.ID,
+		TxID:       deadLetter.TxID,
+		UserID:     deadLetter.UserID,
+		Type:       tx.Type(),
+		Amount:     tx.Amount(),
+		Attempts:   deadLetter.Attempts,
+		LastError:  deadLetter.LastError,
+		CreatedAt:  deadLetter.CreatedAt,
+		ResolvedAt: deadLetter.ResolvedAt,
+		Resolution: deadLetter.Resolution,
+	}
+}
+
+type deadLettersPageView struct {
+	DeadLetters []deadLetterView `json:"dead_letters"`
+	NextCursor  int64            `json:"next_cursor,omitempty"`
+}
+
+// getDeadLettersHandler responds with a page of the unresolved dead letters, oldest first.
+// Query params: cursor (next_cursor of the previous page) and limit.
+func (a *API) getDeadLettersHandler(c *gin.Context) {
+	log.Debug().Msg("api.getDeadLettersHandler START")
+	defer log.Debug().Msg("api.getDeadLettersHandler END")
+
+	var cursor int64
+	if reqCursor := c.Query("cursor"); reqCursor != "" {
+		var err error
+		cursor, err = strconv.ParseInt(reqCursor, 10, 64)
+		if err != nil || cursor <= 0 {
+			respondError(c, fmt.Errorf("%w: cursor: %q", errInvalidFilter, reqCursor))
+			return
+		}
+	}
+
+	limit := defaultDeadLettersPageLimit
+	if reqLimit := c.Query("limit"); reqLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(reqLimit)
+		if err != nil || limit <= 0 || limit > maxDeadLettersPageLimit {
+			respondError(c, fmt.Errorf("%w: limit: %q, must be from 1 to %d", errInvalidFilter, reqLimit, maxDeadLettersPageLimit))
+			return
+		}
+	}
+
+	// One extra dead letter tells whether there is a next page.
+	deadLetters, err := a.storage.GetDeadLetters(c, cursor, limit+1)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	page := deadLettersPageView{DeadLetters: []deadLetterView{}}
+	if len(deadLetters) > limit {
+		deadLetters = deadLetters[:limit]
+		page.NextCursor = deadLetters[limit-1].ID
+	}
+	for _, deadLetter := range deadLetters {
+		page.DeadLetters = append(page.DeadLetters, newDeadLetterView(deadLetter))
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// requeueDeadLetterHandler puts the transaction of the dead letter back to its user's queue and has the queue processed.
+func (a *API) requeueDeadLetterHandler(c *gin.Context) {
+	log.Debug().Msg("api.requeueDeadLetterHandler START")
+	defer log.Debug().Msg("api.requeueDeadLetterHandler END")
+
+	deadLetter, ok := a.resolveDeadLetter(c, a.storage.RequeueDeadLetter)
+	if !ok {
+		return
+	}
+
+	a.processTxQueueOnNotification(deadLetter.UserID)
+
+	c.JSON(http.StatusOK, newDeadLetterView(deadLetter))
+}
+
+// discardDeadLetterHandler rejects the transaction of the dead letter.
+func (a *API) discardDeadLetterHandler(c *gin.Context) {
+	log.Debug().Msg("api.discardDeadLetterHandler START")
+	defer log.Debug().Msg("api.discardDeadLetterHandler END")
+
+	deadLetter, ok := a.resolveDeadLetter(c, a.storage.DiscardDeadLetter)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, newDeadLetterView(deadLetter))
+}
+
+// resolveDeadLetter resolves the dead letter of the id param with resolve. If it fails, it responds with the error and returns ok = false.
+func (a *API) resolveDeadLetter(c *gin.Context,
+	resolve func(ctx context.Context, deadLetterID int64) (model.DeadLetter, error)) (deadLetter model.DeadLetter, ok bool) {
+
+	idParam, ok := c.Get("id")
+	if !ok {
+		respondError(c, errIDIsEmpty)
+		return model.DeadLetter{}, false
+	}
+	id, ok := idParam.(int64)
+	if !ok {
+		respondError(c, errInvalidID)
+		return model.DeadLetter{}, false
+	}
+
+	deadLetter, err := resolve(c, id)
+	if err != nil {
+		respondError(c, err)
+		return model.DeadLetter{}, false
+	}
+
+	return deadLetter, true
+}
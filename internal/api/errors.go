@@ -0,0 +1,151 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"transactions/internal/pg"
+	"transactions/internal/validation"
+)
+
+var errIDIsEmpty = errors.New("id is empty")
+var errSumIsEmpty = errors.New("sum is empty")
+var errInvalidID = errors.New("invalid id")
+var errInvalidSum = errors.New("invalid sum")
+var errInsufficientFunds = errors.New("not enough funds in the balance")
+var errUserNotFound = errors.New("user not found")
+var errTxNotFound = errors.New("transaction not found")
+var errInvalidFilter = errors.New("invalid filter")
+var errInvalidIdempotencyKey = errors.New("invalid idempotency key")
+var errIdempotencyKeyReused = errors.New("idempotency key is already used for another request")
+var errInvalidTransfer = errors.New("invalid transfer")
+var errInvalidTxRequest = errors.New("invalid transaction request")
+var errCurrencyNotSupported = errors.New("currency is not supported")
+var errInvalidAsync = errors.New("invalid async option, expected true or false")
+var errInvalidWait = errors.New("invalid wait")
+var errTxIsBackingOff = errors.New("transaction processing failed, it will be retried later")
+var errTxIsDeadLettered = errors.New("transaction processing failed too many times, it is dead-lettered")
+var errTxIsRejected = errors.New("transaction is rejected")
+var errDeadLetterNotFound = errors.New("dead letter not found")
+var errDeadLetterIsResolved = errors.New("dead letter is already resolved")
+var errRouteNotFound = errors.New("no such route")
+var errMethodNotAllowed = errors.New("method is not allowed")
+var errInternal = errors.New("internal error")
+
+// errorCode is the machine-readable reason of an error response. The codes are part of the API: never change one.
+type errorCode string
+
+const (
+	codeIDIsEmpty             errorCode = "id_is_empty"
+	codeInvalidID             errorCode = "invalid_id"
+	codeInsufficientFunds     errorCode = "insufficient_funds"
+	codeUserNotFound          errorCode = "user_not_found"
+	codeTxNotFound            errorCode = "transaction_not_found"
+	codeInvalidFilter         errorCode = "invalid_filter"
+	codeInvalidIdempotencyKey errorCode = "invalid_idempotency_key"
+	codeIdempotencyKeyReused  errorCode = "idempotency_key_reused"
+	codeInvalidTransfer       errorCode = "invalid_transfer"
+	codeInvalidTxRequest      errorCode = "invalid_transaction_request"
+	codeCurrencyNotSupported  errorCode = "currency_not_supported"
+	codeInvalidAsync          errorCode = "invalid_async"
+	codeInvalidWait           errorCode = "invalid_wait"
+	codeTxIsStillPending      errorCode = "transaction_still_pending"
+	codeTxIsBackingOff        errorCode = "transaction_backing_off"
+	codeTxIsDeadLettered      errorCode = "transaction_dead_lettered"
+	codeTxIsRejected          errorCode = "transaction_rejected"
+	codeDeadLetterNotFound    errorCode = "dead_letter_not_found"
+	codeDeadLetterIsResolved  errorCode = "dead_letter_resolved"
+	codeRouteNotFound         errorCode = "route_not_found"
+	codeMethodNotAllowed      errorCode = "method_not_allowed"
+	codeInternal              errorCode = "internal_error"
+)
+
+// storageErrors maps the errors of the storages to the errors of the API.
+// It is the only place the handlers learn about the storage errors from, the messages of the storage errors never reach the clients.
+var storageErrors = []struct {
+	storageErr error
+	apiErr     error
+}{
+	{storageErr: pg.ErrInsufficientFunds, apiErr: errInsufficientFunds},
+	{storageErr: pg.ErrUserNotFound, apiErr: errUserNotFound},
+	{storageErr: pg.ErrTxNotFound, apiErr: errTxNotFound},
+	{storageErr: pg.ErrIdempotencyKeyReused, apiErr: errIdempotencyKeyReused},
+	{storageErr: pg.ErrTxQueueIsBackingOff, apiErr: errTxIsBackingOff},
+	{storageErr: pg.ErrDeadLetterNotFound, apiErr: errDeadLetterNotFound},
+	{storageErr: pg.ErrDeadLetterIsResolved, apiErr: errDeadLetterIsResolved},
+}
+
+// errorResponses are the status and the code of every API error. The errors may be wrapped with details for the message.
+var errorResponses = []struct {
+	err    error
+	status int
+	code   errorCode
+}{
+	{err: errIDIsEmpty, status: http.StatusBadRequest, code: codeIDIsEmpty},
+	{err: errInvalidID, status: http.StatusBadRequest, code: codeInvalidID},
+	{err: errSumIsEmpty, status: http.StatusBadRequest, code: errorCode(validation.CodeAmountIsEmpty)},
+	{err: errInvalidSum, status: http.StatusBadRequest, code: errorCode(validation.CodeAmountIsInvalid)},
+	{err: errInvalidFilter, status: http.StatusBadRequest, code: codeInvalidFilter},
+	{err: errInvalidIdempotencyKey, status: http.StatusBadRequest, code: codeInvalidIdempotencyKey},
+	{err: errInvalidTransfer, status: http.StatusBadRequest, code: codeInvalidTransfer},
+	{err: errInvalidTxRequest, status: http.StatusBadRequest, code: codeInvalidTxRequest},
+	{err: errCurrencyNotSupported, status: http.StatusBadRequest, code: codeCurrencyNotSupported},
+	{err: errInvalidAsync, status: http.StatusBadRequest, code: codeInvalidAsync},
+	{err: errInvalidWait, status: http.StatusBadRequest, code: codeInvalidWait},
+	{err: errInsufficientFunds, status: http.StatusPaymentRequired, code: codeInsufficientFunds},
+	{err: errUserNotFound, status: http.StatusNotFound, code: codeUserNotFound},
+	{err: errTxNotFound, status: http.StatusNotFound, code: codeTxNotFound},
+	{err: errDeadLetterNotFound, status: http.StatusNotFound, code: codeDeadLetterNotFound},
+	{err: errRouteNotFound, status: http.StatusNotFound, code: codeRouteNotFound},
+	{err: errMethodNotAllowed, status: http.StatusMethodNotAllowed, code: codeMethodNotAllowed},
+	{err: errTxIsRejected, status: http.StatusConflict, code: codeTxIsRejected},
+	{err: errDeadLetterIsResolved, status: http.StatusConflict, code: codeDeadLetterIsResolved},
+	{err: errIdempotencyKeyReused, status: http.StatusUnprocessableEntity, code: codeIdempotencyKeyReused},
+	{err: errTxIsDeadLettered, status: http.StatusInternalServerError, code: codeTxIsDeadLettered},
+	{err: errTxIsBackingOff, status: http.StatusServiceUnavailable, code: codeTxIsBackingOff},
+	{err: errTxIsStillPending, status: http.StatusGatewayTimeout, code: codeTxIsStillPending},
+}
+
+// errorView is the body of every error response.
+type errorView struct {
+	Code      errorCode `json:"code"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"request_id"`
+}
+
+// respondError responds with the error envelope, e.g. {"code":"insufficient_funds","message":"...","request_id":"..."}.
+// err is an API error, a storage error from storageErrors or a *validation.Error, wrapped or not;
+// anything else is an internal error: it is logged, and the client gets 500 with no details.
+func respondError(c *gin.Context, err error) {
+
+	for _, storageError := range storageErrors {
+		if errors.Is(err, storageError.storageErr) {
+			err = storageError.apiErr
+			break
+		}
+	}
+
+	view := errorView{Code: codeInternal, Message: errInternal.Error(), RequestID: c.GetString(requestIDKey)}
+	status := http.StatusInternalServerError
+
+	var validationErr *validation.Error
+	if errors.As(err, &validationErr) {
+		view.Code, view.Message, status = errorCode(validationErr.Code), validationErr.Message, http.StatusBadRequest
+	} else {
+		for _, errorResponse := range errorResponses {
+			if errors.Is(err, errorResponse.err) {
+				view.Code, view.Message, status = errorResponse.code, err.Error(), errorResponse.status
+				break
+			}
+		}
+	}
+
+	if view.Code == codeInternal {
+		log.Error().Err(err).Str("requestID", view.RequestID).Str("path", c.Request.URL.Path).Msg("internal error")
+	}
+
+	c.JSON(status, view)
+}
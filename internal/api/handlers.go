@@ -1,134 +1,524 @@
 package api
 
 import (
-	"errors"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
+
+	"transactions/internal/model"
+	"transactions/internal/money"
+	"transactions/internal/validation"
 )
 
-var errIDIsEmpty = errors.New("id is empty")
-var errSumIsEmpty = errors.New("sum is empty")
-var errInvalidID = errors.New("invalid id")
-var errInvalidSum = errors.New("invalid sum")
-var errInsufficientFunds = errors.New("not enough funds in the balance")
+// checkValid checks the user ID and the sum of the operation in the path. The sum is a positive amount
+// within the limits of the operation, a rejected one gets 400 with the code of the rejection.
+func (a *API) checkValid(operation validation.Operation) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Debug().Msg("api.checkValid START")
+		defer log.Debug().Msg("api.checkValid END")
+
+		a.checkValidID(c)
+		if c.IsAborted() {
+			return
+		}
+
+		sum, err := a.amountValidator.ParseAmount(operation, c.Param("sum"))
+		if err != nil {
+			respondError(c, err)
+			c.Abort()
+			return
+		}
+
+		c.Set("sum", sum)
+	}
+}
 
-func (a *API) checkValid(c *gin.Context) {
-	log.Debug().Msg("api.checkValid START")
-	defer log.Debug().Msg("api.checkValid END")
+func (a *API) checkValidID(c *gin.Context) {
+	log.Debug().Msg("api.checkValidID START")
+	defer log.Debug().Msg("api.checkValidID END")
 
 	reqID := c.Param("id")
 	if reqID == "" {
-		c.Data(http.StatusBadRequest, "text/plain", []byte(errIDIsEmpty.Error()))
+		respondError(c, errIDIsEmpty)
 		c.Abort()
 		return
 	}
 
 	id, err := strconv.ParseInt(reqID, 10, 64)
 	if err != nil {
-		c.Data(http.StatusBadRequest, "text/plain", []byte(errInvalidID.Error()))
+		respondError(c, errInvalidID)
 		c.Abort()
 		return
 	}
 
 	c.Set("id", id)
 
-	reqSum := c.Param("sum")
-	if reqSum == "" {
-		c.Data(http.StatusBadRequest, "text/plain", []byte(errSumIsEmpty.Error()))
-		c.Abort()
+}
+
+func (a *API) receiptHandler(c *gin.Context) {
+	log.Debug().Msg("api.receiptHandler START")
+	defer log.Debug().Msg("api.receiptHandler END")
+
+	idParam, ok := c.Get("id")
+	if !ok {
+		respondError(c, errIDIsEmpty)
 		return
 	}
-
-	sum, err := strconv.ParseFloat(reqSum, 64)
-	if err != nil {
-		c.Data(http.StatusBadRequest, "text/plain", []byte(errInvalidSum.Error()))
-		c.Abort()
+	id, ok := idParam.(int64)
+	if !ok {
+		respondError(c, errInvalidID)
 		return
 	}
 
-	c.Set("sum", sum)
+	sumParam, ok := c.Get("sum")
+	if !ok {
+		respondError(c, errSumIsEmpty)
+		return
+	}
+	sum, ok := sumParam.(money.Amount)
+	if !ok {
+		respondError(c, errInvalidSum)
+		return
+	}
 
+	a.submitTx(c, id, sum, model.TxDetails{Currency: a.currency}, c.GetHeader(idempotencyKeyHeader))
 }
 
-func (a *API) receiptHandler(c *gin.Context) {
-	log.Debug().Msg("api.receiptHandler START")
-	defer log.Debug().Msg("api.receiptHandler END")
+func (a *API) withdrawHandler(c *gin.Context) {
+	log.Debug().Msg("api.withdrawHandler START")
+	defer log.Debug().Msg("api.withdrawHandler END")
 
 	idParam, ok := c.Get("id")
 	if !ok {
-		c.Data(http.StatusBadRequest, "text/plain", []byte(errIDIsEmpty.Error()))
+		respondError(c, errIDIsEmpty)
 		return
 	}
 	id, ok := idParam.(int64)
 	if !ok {
-		c.Data(http.StatusBadRequest, "text/plain", []byte(errInvalidID.Error()))
+		respondError(c, errInvalidID)
 		return
 	}
 
 	sumParam, ok := c.Get("sum")
 	if !ok {
-		c.Data(http.StatusBadRequest, "text/plain", []byte(errSumIsEmpty.Error()))
+		respondError(c, errSumIsEmpty)
 		return
 	}
-	sum, ok := sumParam.(float64)
+	sum, ok := sumParam.(money.Amount)
 	if !ok {
-		c.Data(http.StatusBadRequest, "text/plain", []byte(errInvalidSum.Error()))
+		respondError(c, errInvalidSum)
+		return
+	}
+
+	a.submitTx(c, id, sum.Neg(), model.TxDetails{Currency: a.currency}, c.GetHeader(idempotencyKeyHeader))
+}
+
+type txResponse struct {
+	ID      int64          `json:"id"`
+	Status  model.TxStatus `json:"status"`
+	Balance money.Amount   `json:"balance"`
+}
+
+// submitTx queues the transaction, waits until it is processed and responds with its result:
+// 200 with the new balance if it is applied, 402 if it is rejected for insufficient funds, 409 for other rejections.
+// An async request (see isAsync) gets 202 with the ID of the transaction at once instead.
+// A retry with the same idempotency key gets the result of the transaction queued by the first request.
+func (a *API) submitTx(c *gin.Context, userID int64, sum money.Amount, details model.TxDetails, idempotencyKey string) {
+	log.Debug().Msg("api.submitTx START")
+	defer log.Debug().Msg("api.submitTx END")
+
+	if len(idempotencyKey) > maxIdempotencyKeyLen {
+		respondError(c, errInvalidIdempotencyKey)
+		return
+	}
+
+	async, err := isAsync(c)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
-	if err := a.storage.AddTx(c, id, sum); err != nil {
-		c.Data(http.StatusInternalServerError, "text/plain", nil)
+	txID, isReplay, err := a.storage.AddTx(c, userID, sum, details, idempotencyKey)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
-	txQueueProcess := a.txQueueProcess(id)
+	if isReplay {
+		c.Header(idempotentReplayedHeader, "true")
+	}
 
-	a.tryToProcessTxQueue(c, id, txQueueProcess)
+	if async {
+		// The reply of the run is not waited for: the run goes on after the response, and it is left
+		// to the background sweep if it fails.
+		a.requestTxQueueRun(userID)
+		respondAccepted(c, txID)
+		return
+	}
 
-	<-txQueueProcess
+	tx, err := a.waitForTx(c.Request.Context(), userID, txID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 
-	c.Data(http.StatusOK, "text/plain", []byte("OK"))
+	switch {
+	case tx.Status == model.TxStatusDeadLettered:
+		respondError(c, errTxIsDeadLettered)
+	case tx.Status == model.TxStatusRejected && tx.RejectCode == model.RejectCodeInsufficientFunds:
+		respondError(c, errInsufficientFunds)
+	case tx.Status == model.TxStatusRejected:
+		respondError(c, fmt.Errorf("%w: %s", errTxIsRejected, tx.RejectReason))
+	default:
+		balance, err := a.balanceAfter(c, tx)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, txResponse{ID: tx.ID, Status: tx.Status, Balance: balance})
+	}
 }
 
-func (a *API) withdrawHandler(c *gin.Context) {
-	log.Debug().Msg("api.withdrawHandler START")
-	defer log.Debug().Msg("api.withdrawHandler END")
+// balanceAfter is the balance of the user right after the applied transaction. The transactions applied
+// before the balances after them were recorded (see the pg migration 0005) have none, e.g. on an idempotent replay:
+// they get the current settled balance of the user instead.
+func (a *API) balanceAfter(c *gin.Context, tx model.Tx) (balance money.Amount, err error) {
+
+	if tx.BalanceAfter != nil {
+		return *tx.BalanceAfter, nil
+	}
+
+	userBalance, err := a.storage.GetBalance(c, tx.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	return userBalance.Settled, nil
+}
+
+type txView struct {
+	ID            int64            `json:"id"`
+	UserID        int64            `json:"user_id"`
+	Type          model.TxType     `json:"type"`
+	Amount        money.Amount     `json:"amount"`
+	Status        model.TxStatus   `json:"status"`
+	RejectCode    model.RejectCode `json:"reject_code,omitempty"`
+	RejectReason  string           `json:"reject_reason,omitempty"`
+	BalanceAfter  *money.Amount    `json:"balance_after,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	ProcessedAt   *time.Time       `json:"processed_at,omitempty"`
+	TransferID    *int64           `json:"transfer_id,omitempty"`
+	Attempts      int              `json:"attempts,omitempty"`
+	LastError     string           `json:"last_error,omitempty"`
+	NextAttemptAt *time.Time       `json:"next_attempt_at,omitempty"`
+	// Currency, Description and ExternalReference are empty for the transactions queued before they were stored.
+	Currency          string `json:"currency,omitempty"`
+	Description       string `json:"description,omitempty"`
+	ExternalReference string `json:"external_reference,omitempty"`
+}
+
+func newTxView(tx model.Tx) txView {
+	return txView{
+		ID:            tx.ID,
+		UserID:        tx.UserID,
+		Type:          tx.Type(),
+		Amount:        tx.Amount(),
+		Status:        tx.Status,
+		RejectCode:    tx.RejectCode,
+		RejectReason:  tx.RejectReason,
+		BalanceAfter:  tx.BalanceAfter,
+		CreatedAt:     tx.CreatedAt,
+		ProcessedAt:   tx.ProcessedAt,
+		TransferID:    tx.TransferID,
+		Attempts:      tx.Attempts,
+		LastError:     tx.LastError,
+		NextAttemptAt: tx.NextAttemptAt,
+
+		Currency:          tx.Currency,
+		Description:       tx.Description,
+		ExternalReference: tx.ExternalReference,
+	}
+}
+
+// maxTxWait bounds the wait param of getTxHandler, so a long poll doesn't outlive the proxies' timeouts.
+const maxTxWait = time.Minute
+
+// getTxHandler responds with the transaction. With the wait param, e.g. ?wait=10s, a pending transaction
+// is responded with once it leaves the pending state or once the wait is over, whichever is first:
+// the client tells by the status, still pending after the wait is not an error.
+func (a *API) getTxHandler(c *gin.Context) {
+	log.Debug().Msg("api.getTxHandler START")
+	defer log.Debug().Msg("api.getTxHandler END")
 
 	idParam, ok := c.Get("id")
 	if !ok {
-		c.Data(http.StatusBadRequest, "text/plain", []byte(errIDIsEmpty.Error()))
+		respondError(c, errIDIsEmpty)
 		return
 	}
 	id, ok := idParam.(int64)
 	if !ok {
-		c.Data(http.StatusBadRequest, "text/plain", []byte(errInvalidID.Error()))
+		respondError(c, errInvalidID)
 		return
 	}
 
-	sumParam, ok := c.Get("sum")
+	var wait time.Duration
+	if reqWait := c.Query("wait"); reqWait != "" {
+		var err error
+		wait, err = time.ParseDuration(reqWait)
+		if err != nil || wait < 0 || wait > maxTxWait {
+			respondError(c, fmt.Errorf("%w: %q, must be a duration like 10s up to %s", errInvalidWait, reqWait, maxTxWait))
+			return
+		}
+	}
+
+	tx, err := a.storage.GetTx(c, id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if tx.Status == model.TxStatusPending && wait > 0 {
+		tx, err = a.pollTx(c.Request.Context(), tx, wait)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, newTxView(tx))
+}
+
+type balanceView struct {
+	UserID             int64        `json:"user_id"`
+	Settled            money.Amount `json:"settled"`
+	PendingReceipts    money.Amount `json:"pending_receipts"`
+	PendingWithdrawals money.Amount `json:"pending_withdrawals"`
+	Available          money.Amount `json:"available"`
+}
+
+func (a *API) getBalanceHandler(c *gin.Context) {
+	log.Debug().Msg("api.getBalanceHandler START")
+	defer log.Debug().Msg("api.getBalanceHandler END")
+
+	idParam, ok := c.Get("id")
+	if !ok {
+		respondError(c, errIDIsEmpty)
+		return
+	}
+	id, ok := idParam.(int64)
+	if !ok {
+		respondError(c, errInvalidID)
+		return
+	}
+
+	balance, err := a.storage.GetBalance(c, id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, balanceView{
+		UserID:             balance.UserID,
+		Settled:            balance.Settled,
+		PendingReceipts:    balance.PendingReceipts,
+		PendingWithdrawals: balance.PendingWithdrawals,
+		Available:          balance.Available(),
+	})
+}
+
+const (
+	defaultTxsPageLimit = 50
+	maxTxsPageLimit     = 100
+)
+
+type txsPageView struct {
+	Transactions []txView `json:"transactions"`
+	NextCursor   int64    `json:"next_cursor,omitempty"`
+}
+
+// getTxsHandler responds with a page of the user's transactions, newest first.
+// Query params: type (receipt, withdraw), status (pending, applied, rejected, dead_lettered), min_amount, max_amount,
+// from, to (RFC 3339, by creation time, `to` is exclusive), cursor (next_cursor of the previous page) and limit.
+func (a *API) getTxsHandler(c *gin.Context) {
+	log.Debug().Msg("api.getTxsHandler START")
+	defer log.Debug().Msg("api.getTxsHandler END")
+
+	idParam, ok := c.Get("id")
 	if !ok {
-		c.Data(http.StatusBadRequest, "text/plain", []byte(errSumIsEmpty.Error()))
+		respondError(c, errIDIsEmpty)
 		return
 	}
-	sum, ok := sumParam.(float64)
+	id, ok := idParam.(int64)
 	if !ok {
-		c.Data(http.StatusBadRequest, "text/plain", []byte(errInvalidSum.Error()))
+		respondError(c, errInvalidID)
+		return
+	}
+
+	filter, err := parseTxFilter(c)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
+	filter.UserID = id
+
+	// One extra transaction tells whether there is a next page.
+	pageLimit := filter.Limit
+	filter.Limit++
 
-	if err := a.storage.AddTx(c, id, -sum); err != nil {
-		c.Data(http.StatusInternalServerError, "text/plain", nil)
+	txs, err := a.storage.GetTxs(c, filter)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
-	txQueueProcess := a.txQueueProcess(id)
+	page := txsPageView{Transactions: []txView{}}
+	if len(txs) > pageLimit {
+		txs = txs[:pageLimit]
+		page.NextCursor = txs[pageLimit-1].ID
+	}
+	for _, tx := range txs {
+		page.Transactions = append(page.Transactions, newTxView(tx))
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+func parseTxFilter(c *gin.Context) (filter model.TxFilter, err error) {
 
-	a.tryToProcessTxQueue(c, id, txQueueProcess)
+	filter.Limit = defaultTxsPageLimit
+
+	if txType := model.TxType(c.Query("type")); txType != "" {
+		if txType != model.TxTypeReceipt && txType != model.TxTypeWithdraw {
+			return filter, fmt.Errorf("%w: type: %q", errInvalidFilter, txType)
+		}
+		filter.Type = txType
+	}
 
-	<-txQueueProcess
+	if status := model.TxStatus(c.Query("status")); status != "" {
+		if status != model.TxStatusPending && status != model.TxStatusApplied && status != model.TxStatusRejected &&
+			status != model.TxStatusDeadLettered {
+			return filter, fmt.Errorf("%w: status: %q", errInvalidFilter, status)
+		}
+		filter.Status = status
+	}
+
+	for param, dest := range map[string]**money.Amount{"min_amount": &filter.MinAmount, "max_amount": &filter.MaxAmount} {
+		if reqAmount := c.Query(param); reqAmount != "" {
+			amount, errParse := money.Parse(reqAmount)
+			if errParse != nil || amount < 0 {
+				return filter, fmt.Errorf("%w: %s: %q", errInvalidFilter, param, reqAmount)
+			}
+			*dest = &amount
+		}
+	}
+
+	for param, dest := range map[string]**time.Time{"from": &filter.CreatedFrom, "to": &filter.CreatedTo} {
+		if reqTime := c.Query(param); reqTime != "" {
+			t, errParse := time.Parse(time.RFC3339, reqTime)
+			if errParse != nil {
+				return filter, fmt.Errorf("%w: %s: %q", errInvalidFilter, param, reqTime)
+			}
+			*dest = &t
+		}
+	}
+
+	if reqCursor := c.Query("cursor"); reqCursor != "" {
+		filter.Cursor, err = strconv.ParseInt(reqCursor, 10, 64)
+		if err != nil || filter.Cursor <= 0 {
+			return filter, fmt.Errorf("%w: cursor: %q", errInvalidFilter, reqCursor)
+		}
+	}
+
+	if reqLimit := c.Query("limit"); reqLimit != "" {
+		filter.Limit, err = strconv.Atoi(reqLimit)
+		if err != nil || filter.Limit <= 0 || filter.Limit > maxTxsPageLimit {
+			return filter, fmt.Errorf("%w: limit: %q, must be from 1 to %d", errInvalidFilter, reqLimit, maxTxsPageLimit)
+		}
+	}
+
+	return filter, nil
+}
+
+type transferRequest struct {
+	From           int64           `json:"from"`
+	To             int64           `json:"to"`
+	Amount         json.RawMessage `json:"amount"`
+	IdempotencyKey string          `json:"idempotency_key"`
+}
+
+// rawAmount is the amount of a JSON body as it was sent, unquoted if it is a JSON string.
+// The bodies keep their amounts in json.RawMessage, so a JSON string and a bare number are both accepted
+// and parsed by the amount validator, not by encoding/json.
+func rawAmount(raw json.RawMessage) string {
+	if unquoted, err := strconv.Unquote(string(raw)); err == nil {
+		return unquoted
+	}
+	return string(raw)
+}
+
+type transferView struct {
+	ID        int64        `json:"id"`
+	From      int64        `json:"from"`
+	To        int64        `json:"to"`
+	Amount    money.Amount `json:"amount"`
+	Balance   money.Amount `json:"balance"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// transferHandler moves money from one user to another at once and responds with the sender's new balance.
+// The idempotency key may be passed in the body or in the Idempotency-Key header.
+func (a *API) transferHandler(c *gin.Context) {
+	log.Debug().Msg("api.transferHandler START")
+	defer log.Debug().Msg("api.transferHandler END")
+
+	var req transferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, fmt.Errorf("%w: %v", errInvalidTransfer, err))
+		return
+	}
+
+	switch {
+	case req.From <= 0 || req.To <= 0:
+		respondError(c, errInvalidID)
+		return
+	case req.From == req.To:
+		respondError(c, fmt.Errorf("%w: from and to are the same user", errInvalidTransfer))
+		return
+	}
+
+	amount, err := a.amountValidator.ParseAmount(validation.OperationTransfer, rawAmount(req.Amount))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	req.IdempotencyKey = idempotencyKey(c, req.IdempotencyKey)
+	if len(req.IdempotencyKey) > maxIdempotencyKeyLen {
+		respondError(c, errInvalidIdempotencyKey)
+		return
+	}
+
+	transfer, isReplay, err := a.storage.Transfer(c, req.From, req.To, amount, req.IdempotencyKey)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if isReplay {
+		c.Header(idempotentReplayedHeader, "true")
+	}
 
-	c.Data(http.StatusOK, "text/plain", []byte("OK"))
+	c.JSON(http.StatusOK, transferView{
+		ID:        transfer.ID,
+		From:      transfer.FromUserID,
+		To:        transfer.ToUserID,
+		Amount:    transfer.Amount,
+		Balance:   transfer.FromBalanceAfter,
+		CreatedAt: transfer.CreatedAt,
+	})
 }
@@ -0,0 +1,300 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"transactions/internal/memstore"
+	"transactions/internal/model"
+)
+
+// newTestRouter returns the router of an API on a new memstore with one user, and the ID of the user.
+func newTestRouter(t *testing.T) (router http.Handler, userID int64) {
+	t.Helper()
+
+	return newTestRouterOn(t, memstore.New())
+}
+
+// newTestRouterOn returns the router of an API on the storage with one new user, and the ID of the user.
+func newTestRouterOn(t *testing.T, storage interface {
+	Storage
+	AddUser() (userID int64, err error)
+}) (router http.Handler, userID int64) {
+	t.Helper()
+
+	userID, err := storage.AddUser()
+	if err != nil {
+		t.Fatalf("adding user: %v", err)
+	}
+
+	a := newTestAPI(t, storage, testConfig{})
+	t.Cleanup(func() {
+		a.stopTxQueueActors()
+		if err := a.waitForTxQueueActors(context.Background()); err != nil {
+			t.Errorf("waiting for tx queue actors: %v", err)
+		}
+	})
+
+	return a.server.Handler, userID
+}
+
+func serve(router http.Handler, method, url, body string, header http.Header) *httptest.ResponseRecorder {
+
+	var reqBody io.Reader
+	if body != "" {
+		reqBody = strings.NewReader(body)
+	}
+
+	req := httptest.NewRequest(method, url, reqBody)
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// decode decodes the body of the response, failing the test on an unexpected status.
+func decode(t *testing.T, rec *httptest.ResponseRecorder, wantStatus int, v any) {
+	t.Helper()
+
+	if rec.Code != wantStatus {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, wantStatus, rec.Body)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %s: %v", rec.Body, err)
+	}
+}
+
+func TestReceipt(t *testing.T) {
+
+	router, userID := newTestRouter(t)
+
+	var resp txResponse
+	decode(t, serve(router, http.MethodPost, fmt.Sprintf("/v1/users/%d/receipts", userID), `{"amount":"10.50"}`, nil),
+		http.StatusOK, &resp)
+	if resp.Status != model.TxStatusApplied || resp.Balance != 1050 {
+		t.Errorf("got %+v, want applied with balance 10.50", resp)
+	}
+
+	rec := serve(router, http.MethodPost, fmt.Sprintf("/%d/receipt/1.25", userID), "", nil)
+	decode(t, rec, http.StatusOK, &resp)
+	if resp.Status != model.TxStatusApplied || resp.Balance != 1175 {
+		t.Errorf("legacy route: got %+v, want applied with balance 11.75", resp)
+	}
+	if rec.Header().Get("Deprecation") != "true" {
+		t.Errorf("legacy route: got Deprecation %q, want true", rec.Header().Get("Deprecation"))
+	}
+}
+
+// legacyTxsStorage is the memstore whose transactions look like the ones applied before
+// the balances after them were recorded.
+type legacyTxsStorage struct {
+	*memstore.MemStore
+}
+
+func (s legacyTxsStorage) GetTx(ctx context.Context, txID int64) (tx model.Tx, err error) {
+	tx, err = s.MemStore.GetTx(ctx, txID)
+	tx.BalanceAfter = nil
+	return tx, err
+}
+
+func TestReceiptWithNoBalanceAfter(t *testing.T) {
+
+	router, userID := newTestRouterOn(t, legacyTxsStorage{MemStore: memstore.New()})
+
+	var resp txResponse
+	decode(t, serve(router, http.MethodPost, fmt.Sprintf("/v1/users/%d/receipts", userID), `{"amount":"2"}`, nil),
+		http.StatusOK, &resp)
+	if resp.Status != model.TxStatusApplied || resp.Balance != 200 {
+		t.Errorf("got %+v, want applied with the settled balance 2.00", resp)
+	}
+}
+
+func TestOverdraftWithdrawal(t *testing.T) {
+
+	router, userID := newTestRouter(t)
+
+	var resp txResponse
+	decode(t, serve(router, http.MethodPost, fmt.Sprintf("/v1/users/%d/receipts", userID), `{"amount":"5"}`, nil),
+		http.StatusOK, &resp)
+
+	var errResp errorView
+	decode(t, serve(router, http.MethodPost, fmt.Sprintf("/v1/users/%d/withdrawals", userID), `{"amount":"5.01"}`, nil),
+		http.StatusPaymentRequired, &errResp)
+	if errResp.Code != codeInsufficientFunds {
+		t.Errorf("got code %q, want %q", errResp.Code, codeInsufficientFunds)
+	}
+
+	var balance balanceView
+	decode(t, serve(router, http.MethodGet, fmt.Sprintf("/users/%d/balance", userID), "", nil), http.StatusOK, &balance)
+	if balance.Settled != 500 {
+		t.Errorf("got settled balance %s, want 5.00 untouched by the rejected withdrawal", balance.Settled)
+	}
+}
+
+func TestIdempotentReplay(t *testing.T) {
+
+	router, userID := newTestRouter(t)
+
+	url := fmt.Sprintf("/v1/users/%d/receipts", userID)
+	header := http.Header{idempotencyKeyHeader: {"receipt-1"}}
+
+	var first, replayed txResponse
+	rec := serve(router, http.MethodPost, url, `{"amount":"3"}`, header)
+	decode(t, rec, http.StatusOK, &first)
+	if rec.Header().Get(idempotentReplayedHeader) != "" {
+		t.Errorf("first request: got %s header", idempotentReplayedHeader)
+	}
+
+	rec = serve(router, http.MethodPost, url, `{"amount":"3"}`, header)
+	decode(t, rec, http.StatusOK, &replayed)
+	if rec.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Errorf("replay: got %s %q, want true", idempotentReplayedHeader, rec.Header().Get(idempotentReplayedHeader))
+	}
+	if replayed != first {
+		t.Errorf("replay: got %+v, want the result of the first request %+v", replayed, first)
+	}
+
+	// The key of the body is the same key as the one of the header.
+	rec = serve(router, http.MethodPost, url, `{"amount":"3","idempotency_key":"receipt-1"}`, nil)
+	decode(t, rec, http.StatusOK, &replayed)
+	if rec.Header().Get(idempotentReplayedHeader) != "true" || replayed != first {
+		t.Errorf("replay with the key in the body: got %+v, want the replayed result %+v", replayed, first)
+	}
+
+	var errResp errorView
+	decode(t, serve(router, http.MethodPost, url, `{"amount":"4"}`, header), http.StatusUnprocessableEntity, &errResp)
+	if errResp.Code != codeIdempotencyKeyReused {
+		t.Errorf("reuse for another amount: got code %q, want %q", errResp.Code, codeIdempotencyKeyReused)
+	}
+
+	var balance balanceView
+	decode(t, serve(router, http.MethodGet, fmt.Sprintf("/users/%d/balance", userID), "", nil), http.StatusOK, &balance)
+	if balance.Settled != 300 {
+		t.Errorf("got settled balance %s, want 3.00 of one receipt", balance.Settled)
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+
+	router, userID := newTestRouter(t)
+
+	for _, tc := range []struct {
+		name       string
+		method     string
+		url        string
+		body       string
+		wantStatus int
+		wantCode   errorCode
+	}{
+		{name: "invalid id", method: http.MethodPost, url: "/v1/users/abc/receipts", body: `{"amount":"1"}`,
+			wantStatus: http.StatusBadRequest, wantCode: codeInvalidID},
+		{name: "amount not positive", method: http.MethodPost, url: fmt.Sprintf("/v1/users/%d/receipts", userID), body: `{"amount":"-1"}`,
+			wantStatus: http.StatusBadRequest, wantCode: "amount_not_positive"},
+		{name: "invalid amount in path", method: http.MethodPost, url: fmt.Sprintf("/%d/withdraw/1,5", userID),
+			wantStatus: http.StatusBadRequest, wantCode: "amount_is_invalid"},
+		{name: "invalid transaction request", method: http.MethodPost, url: fmt.Sprintf("/v1/users/%d/receipts", userID), body: `{`,
+			wantStatus: http.StatusBadRequest, wantCode: codeInvalidTxRequest},
+		{name: "user not found", method: http.MethodPost, url: "/v1/users/999/receipts", body: `{"amount":"1"}`,
+			wantStatus: http.StatusNotFound, wantCode: codeUserNotFound},
+		{name: "transaction not found", method: http.MethodGet, url: "/transactions/999",
+			wantStatus: http.StatusNotFound, wantCode: codeTxNotFound},
+		{name: "route not found", method: http.MethodGet, url: "/no/such/route",
+			wantStatus: http.StatusNotFound, wantCode: codeRouteNotFound},
+		{name: "method not allowed", method: http.MethodGet, url: "/transfers",
+			wantStatus: http.StatusMethodNotAllowed, wantCode: codeMethodNotAllowed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+
+			requestID := "req-" + strings.ReplaceAll(tc.name, " ", "-")
+			rec := serve(router, tc.method, tc.url, tc.body, http.Header{requestIDHeader: {requestID}})
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tc.wantStatus, rec.Body)
+			}
+
+			var fields map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &fields); err != nil {
+				t.Fatalf("decoding %s: %v", rec.Body, err)
+			}
+			if len(fields) != 3 || fields["message"] == "" {
+				t.Errorf("got %s, want code, message and request_id", rec.Body)
+			}
+			if errorCode(fields["code"]) != tc.wantCode {
+				t.Errorf("got code %q, want %q", fields["code"], tc.wantCode)
+			}
+			if fields["request_id"] != requestID || rec.Header().Get(requestIDHeader) != requestID {
+				t.Errorf("got request ID %q and header %q, want %q", fields["request_id"], rec.Header().Get(requestIDHeader), requestID)
+			}
+		})
+	}
+}
+
+// runCountingStorage is the memstore that counts the runs of tx queue processing.
+type runCountingStorage struct {
+	*memstore.MemStore
+	runs atomic.Int64
+}
+
+func (s *runCountingStorage) ProcessTxQueue(ctx context.Context, userID int64) (processed []model.Tx, err error) {
+	s.runs.Add(1)
+	return s.MemStore.ProcessTxQueue(ctx, userID)
+}
+
+// BenchmarkSubmitTx submits receipts of one user from many goroutines at once, with and without the batch window.
+// runs/op is the number of tx queue runs per receipt: the batch window serves many receipts with one run.
+// The memstore looks through all the transactions on every run, so compare the results at the same -benchtime, e.g.:
+//
+//	go test ./internal/api -run=NONE -bench=SubmitTx -benchtime=20000x
+func BenchmarkSubmitTx(b *testing.B) {
+
+	for _, window := range []time.Duration{0, time.Millisecond} {
+		b.Run(fmt.Sprintf("txBatchWindow=%s", window), func(b *testing.B) {
+
+			storage := &runCountingStorage{MemStore: memstore.New()}
+			userID, err := storage.AddUser()
+			if err != nil {
+				b.Fatalf("adding user: %v", err)
+			}
+
+			a := newTestAPI(b, storage, testConfig{txBatchWindow: window})
+			router := a.server.Handler
+			url := fmt.Sprintf("/v1/users/%d/receipts", userID)
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					req := httptest.NewRequest(http.MethodPost, url, strings.NewReader(`{"amount":"1.00"}`))
+					rec := httptest.NewRecorder()
+					router.ServeHTTP(rec, req)
+					if rec.Code != http.StatusOK {
+						b.Errorf("submitting receipt: got status %d: %s", rec.Code, rec.Body)
+						return
+					}
+				}
+			})
+
+			b.StopTimer()
+			b.ReportMetric(float64(storage.runs.Load())/float64(b.N), "runs/op")
+
+			a.stopTxQueueActors()
+			if err := a.waitForTxQueueActors(context.Background()); err != nil {
+				b.Errorf("waiting for tx queue actors: %v", err)
+			}
+		})
+	}
+}
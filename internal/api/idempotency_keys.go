@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLen     = 255
+)
+
+// idempotencyKey is the idempotency key of a request with a JSON body:
+// the one of the body, or the one of the Idempotency-Key header if the body has none.
+func idempotencyKey(c *gin.Context, bodyKey string) string {
+	if bodyKey != "" {
+		return bodyKey
+	}
+	return c.GetHeader(idempotencyKeyHeader)
+}
+
+// purgeIdempotencyKeysInterval is how often expired idempotency keys are deleted,
+// so a key lives at most this long after its retention period.
+const purgeIdempotencyKeysInterval = time.Minute * 10
+
+func (a *API) startPurgingIdempotencyKeys(ctx context.Context) (err error) {
+
+	ticker := time.NewTicker(purgeIdempotencyKeysInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			before := time.Now().Add(-a.idempotencyKeyRetention)
+			deleted, errDeleting := a.storage.DeleteIdempotencyKeysCreatedBefore(ctx, before)
+			if errDeleting != nil {
+				log.Warn().Err(errDeleting).Msg("purging expired idempotency keys")
+				continue
+			}
+			log.Debug().Int64("deleted", deleted).Msg("expired idempotency keys purged")
+		}
+	}
+
+}
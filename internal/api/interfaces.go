@@ -1,14 +1,56 @@
 package api
 
-import "context"
+import (
+	"context"
+	"time"
+
+	"transactions/internal/model"
+	"transactions/internal/money"
+	"transactions/internal/validation"
+)
 
 type Config interface {
 	RunAPIAddress() string
+	IdempotencyKeyRetention() time.Duration
+	TxQueuesPollInterval() time.Duration
+	TxQueuesWorkers() int
+	TxMaxAttempts() int
+	TxRetryBaseDelay() time.Duration
+	TxRetryMaxDelay() time.Duration
+	ShutdownGracePeriod() time.Duration
+	TxBatchWindow() time.Duration
+	TxBatchSize() int
+	AmountMaxPrecision() int
+	ReceiptAmountLimits() validation.Limits
+	WithdrawAmountLimits() validation.Limits
+	TransferAmountLimits() validation.Limits
+	Currency() string
 }
 
 type Storage interface {
-	AddTx(ctx context.Context, userID int64, sum float64) (err error)
-	ProcessTxQueue(ctx context.Context, userID int64) (err error)
+	AddTx(ctx context.Context, userID int64, sum money.Amount, details model.TxDetails, idempotencyKey string) (txID int64, isReplay bool, err error)
+	GetTx(ctx context.Context, txID int64) (tx model.Tx, err error)
+	GetTxs(ctx context.Context, filter model.TxFilter) (txs []model.Tx, err error)
+	GetBalance(ctx context.Context, userID int64) (balance model.Balance, err error)
+	Transfer(ctx context.Context, fromUserID, toUserID int64, amount money.Amount, idempotencyKey string) (transfer model.Transfer, isReplay bool, err error)
+	ProcessTxQueue(ctx context.Context, userID int64) (processed []model.Tx, err error)
 	GetUsersWithNonEmptyTxQueues(ctx context.Context) (users []int64, err error)
+	RecordTxQueueFailure(ctx context.Context, userID int64, reason string, policy model.RetryPolicy) (failed model.Tx, err error)
+	GetDeadLetters(ctx context.Context, cursor int64, limit int) (deadLetters []model.DeadLetter, err error)
+	RequeueDeadLetter(ctx context.Context, deadLetterID int64) (deadLetter model.DeadLetter, err error)
+	DiscardDeadLetter(ctx context.Context, deadLetterID int64) (deadLetter model.DeadLetter, err error)
+	DeleteIdempotencyKeysCreatedBefore(ctx context.Context, before time.Time) (deleted int64, err error)
 	Close() (err error)
 }
+
+// TxQueuesListener is implemented by the storages that can tell when a transaction gets queued,
+// including by another app instance. If the storage implements it, queues are processed right away on the notification.
+type TxQueuesListener interface {
+	ListenTxQueues(ctx context.Context, onQueued func(userID int64)) (err error)
+}
+
+// LedgerAuditor is implemented by the storages with a ledger. If the storage implements it,
+// every balance is periodically reconciled with the full history of its postings.
+type LedgerAuditor interface {
+	AuditLedger(ctx context.Context) (mismatchedUsers []int64, err error)
+}
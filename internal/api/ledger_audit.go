@@ -0,0 +1,37 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// auditLedgerInterval is how often the balances are reconciled with the full ledger.
+// The transactions processing checks only the running ledger balance, the audit is what reads all the postings.
+const auditLedgerInterval = time.Hour
+
+func (a *API) startAuditingLedger(ctx context.Context, auditor LedgerAuditor) (err error) {
+
+	ticker := time.NewTicker(auditLedgerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			mismatchedUsers, errAuditing := auditor.AuditLedger(ctx)
+			if errAuditing != nil {
+				log.Warn().Err(errAuditing).Msg("auditing ledger")
+				continue
+			}
+			if len(mismatchedUsers) > 0 {
+				log.Error().Ints64("userIDs", mismatchedUsers).Msg("balances don't match the ledger")
+				continue
+			}
+			log.Debug().Msg("ledger audited")
+		}
+	}
+
+}
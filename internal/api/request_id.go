@@ -0,0 +1,54 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "request_id"
+	maxRequestIDLen = 128
+)
+
+// setRequestID gives every request an ID: the one of the X-Request-ID header if the client sent a sane one, a new one otherwise.
+// The ID is sent back in the X-Request-ID header and in the error responses, so a client report can be matched with the logs.
+func setRequestID(c *gin.Context) {
+
+	requestID := c.GetHeader(requestIDHeader)
+	if !isSaneRequestID(requestID) {
+		requestID = newRequestID()
+	}
+
+	c.Set(requestIDKey, requestID)
+	c.Header(requestIDHeader, requestID)
+}
+
+// isSaneRequestID tells that the ID is short and made of printable ASCII only, so it is safe to log and to send back.
+func isSaneRequestID(requestID string) bool {
+
+	if requestID == "" || len(requestID) > maxRequestIDLen {
+		return false
+	}
+
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] <= ' ' || requestID[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Warn().Err(err).Msg("generating request ID")
+	}
+
+	return hex.EncodeToString(b)
+}
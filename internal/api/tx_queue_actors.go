@@ -0,0 +1,355 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"transactions/internal/model"
+	"transactions/internal/pg"
+)
+
+// processTxQueueTimeout bounds a single run of the storage queue processing.
+// The run is detached from the requests that asked for it, because other requests may be waiting for it too.
+const processTxQueueTimeout = time.Second * 30
+
+// recordTxQueueFailureTimeout bounds recording of a failed run, with a context of its own, not the one of the run.
+const recordTxQueueFailureTimeout = time.Second * 5
+
+// txQueueActorIdleTimeout is how long an actor with an empty mailbox lives before it exits.
+const txQueueActorIdleTimeout = time.Second * 30
+
+var errTxIsStillPending = errors.New("transaction is still pending")
+
+// errTxQueuesAreStopped is the reply to the requests for a run sent after the shutdown stopped the actors.
+// The queued transactions stay pending until the next start.
+var errTxQueuesAreStopped = fmt.Errorf("%w: tx queues processing is stopped", errTxIsStillPending)
+
+// txQueueActor is the goroutine that owns the processing of a user's tx queue.
+// Every request in its mailbox asks for a run of processing that starts after the request was sent;
+// the actor serves all the requests it has with one run and replies to each of them with the result.
+// It exits after txQueueActorIdleTimeout with an empty mailbox, or once the actors are stopped.
+type txQueueActor struct {
+	userID int64
+	// mailbox and its wake signal are guarded by txQueueActors.mu.
+	mailbox []chan error
+	wake    chan struct{}
+}
+
+type txQueueActors struct {
+	userActors map[int64]*txQueueActor
+	mu         sync.Mutex
+	// running counts the actors that have not exited yet, so the shutdown can wait for them.
+	running sync.WaitGroup
+	// stopping is closed on shutdown, under mu: no actor gets a request after it,
+	// and the actors exit as soon as their mailboxes are empty.
+	stopping chan struct{}
+}
+
+func newTxQueueActors() (newTxQueueActors *txQueueActors) {
+	log.Debug().Msg("api.newTxQueueActors START")
+	defer log.Debug().Msg("api.newTxQueueActors END")
+
+	newTxQueueActors = &txQueueActors{}
+
+	newTxQueueActors.userActors = map[int64]*txQueueActor{}
+
+	newTxQueueActors.mu = sync.Mutex{}
+
+	newTxQueueActors.stopping = make(chan struct{})
+
+	return newTxQueueActors
+
+}
+
+// requestTxQueueRun sends a request for a run of processing of the user's tx queue to the user's actor,
+// starting the actor if there is none. The result of the run is sent to the returned channel, which is never blocked.
+// Once the actors are stopped, the request is refused with errTxQueuesAreStopped: the storage may be closed already.
+func (a *API) requestTxQueueRun(userID int64) (reply <-chan error) {
+	log.Debug().Str("userID", fmt.Sprint(userID)).Msg("api.requestTxQueueRun START")
+	defer log.Debug().Msg("api.requestTxQueueRun END")
+
+	actors := a.txQueueActors
+
+	actors.mu.Lock()
+	defer actors.mu.Unlock()
+
+	request := make(chan error, 1)
+
+	select {
+	case <-actors.stopping:
+		request <- errTxQueuesAreStopped
+		return request
+	default:
+	}
+
+	actor, isExists := actors.userActors[userID]
+	if !isExists {
+		actor = &txQueueActor{userID: userID, wake: make(chan struct{}, 1)}
+		actors.userActors[userID] = actor
+		actors.running.Add(1)
+		go a.runTxQueueActor(actor)
+	}
+
+	actor.mailbox = append(actor.mailbox, request)
+
+	select {
+	case actor.wake <- struct{}{}:
+	default:
+	}
+
+	return request
+}
+
+func (a *API) runTxQueueActor(actor *txQueueActor) {
+	log.Debug().Str("userID", fmt.Sprint(actor.userID)).Msg("api.runTxQueueActor START")
+	defer log.Debug().Str("userID", fmt.Sprint(actor.userID)).Msg("api.runTxQueueActor END")
+
+	actors := a.txQueueActors
+	defer actors.running.Done()
+
+	idle := time.NewTimer(txQueueActorIdleTimeout)
+	defer idle.Stop()
+
+	for {
+
+		select {
+		case <-actor.wake:
+		case <-idle.C:
+		case <-actors.stopping:
+		}
+
+		a.waitForTxBatch(actor)
+
+		actors.mu.Lock()
+		requests := actor.mailbox
+		actor.mailbox = nil
+		if len(requests) == 0 {
+			// Nobody can send to the actor once it is out of the map, so no request is lost.
+			delete(actors.userActors, actor.userID)
+			actors.mu.Unlock()
+			return
+		}
+		actors.mu.Unlock()
+
+		err := a.processTxQueue(actor.userID)
+		for _, request := range requests {
+			request <- err
+		}
+
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(txQueueActorIdleTimeout)
+
+	}
+
+}
+
+// waitForTxBatch holds the run for the batch window, so the requests sent to the actor meanwhile
+// are served by it too. It stops waiting as soon as there are txBatchSize requests.
+// With no window, with an empty mailbox, or once the actors are stopped, it doesn't wait at all:
+// on shutdown the requests in the mailbox are served right away.
+func (a *API) waitForTxBatch(actor *txQueueActor) {
+
+	if a.txBatchWindow <= 0 {
+		return
+	}
+
+	select {
+	case <-a.txQueueActors.stopping:
+		return
+	default:
+	}
+
+	batchIsFull := func() (isFull, isEmpty bool) {
+		a.txQueueActors.mu.Lock()
+		defer a.txQueueActors.mu.Unlock()
+		return len(actor.mailbox) >= a.txBatchSize, len(actor.mailbox) == 0
+	}
+
+	if isFull, isEmpty := batchIsFull(); isFull || isEmpty {
+		return
+	}
+
+	timer := time.NewTimer(a.txBatchWindow)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return
+		case <-a.txQueueActors.stopping:
+			return
+		case <-actor.wake:
+			if isFull, _ := batchIsFull(); isFull {
+				return
+			}
+		}
+	}
+}
+
+// stopTxQueueActors has the actors exit as soon as their mailboxes are empty, and refuses the requests sent after it.
+// No actor is started after it, so waitForTxQueueActors waits for all of them.
+func (a *API) stopTxQueueActors() {
+	a.txQueueActors.mu.Lock()
+	defer a.txQueueActors.mu.Unlock()
+
+	close(a.txQueueActors.stopping)
+}
+
+// waitForTxQueueActors waits until all the actors exit, or until ctx is done.
+func (a *API) waitForTxQueueActors(ctx context.Context) (err error) {
+
+	done := make(chan struct{})
+	go func() {
+		a.txQueueActors.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("tx queues processing is still running: %w", ctx.Err())
+	case <-done:
+		return nil
+	}
+}
+
+// processTxQueue is a single run of processing of the user's tx queue. It is called by the user's actor only.
+func (a *API) processTxQueue(userID int64) (err error) {
+	log.Debug().Str("userID", fmt.Sprint(userID)).Msg("api.processTxQueue START")
+	defer log.Debug().Msg("api.processTxQueue END")
+
+	ctx, cancel := context.WithTimeout(a.workCtx, processTxQueueTimeout)
+	defer cancel()
+
+	processed, err := a.storage.ProcessTxQueue(ctx, userID)
+	if err != nil {
+		if errors.Is(err, pg.ErrTxQueueIsBackingOff) {
+			return err
+		}
+		log.Warn().Err(err).Msg(fmt.Sprintf("processing txs queue: userID: %d", userID))
+		// A run cut off by the shutdown, a timeout or a lost connection is not a failure of the transaction:
+		// it is not counted against the transaction, and the next run retries the queue.
+		if a.workCtx.Err() == nil && !pg.IsTransientError(err) {
+			a.recordTxQueueFailure(userID, err)
+		}
+		return err
+	}
+
+	for _, tx := range processed {
+		if tx.Status == model.TxStatusRejected {
+			log.Info().Str("userID", fmt.Sprint(userID)).Str("txID", fmt.Sprint(tx.ID)).
+				Str("reason", tx.RejectReason).Msg("transaction rejected")
+		}
+	}
+
+	return nil
+}
+
+func (a *API) recordTxQueueFailure(userID int64, processErr error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), recordTxQueueFailureTimeout)
+	defer cancel()
+
+	failed, err := a.storage.RecordTxQueueFailure(ctx, userID, processErr.Error(), a.txRetryPolicy)
+	if err != nil {
+		log.Warn().Err(err).Str("userID", fmt.Sprint(userID)).Msg("recording tx queue failure")
+		return
+	}
+
+	logEvent := log.Info().Str("userID", fmt.Sprint(userID)).Str("txID", fmt.Sprint(failed.ID)).Int("attempts", failed.Attempts)
+	if failed.Status == model.TxStatusDeadLettered {
+		logEvent.Msg("transaction dead-lettered")
+		return
+	}
+	logEvent.Time("nextAttemptAt", *failed.NextAttemptAt).Msg("transaction will be retried")
+
+}
+
+// txPollRecheckInterval is how long pollTx waits before it asks for another run after a run that failed,
+// or that left the transaction pending, e.g. behind a transaction waiting for a retry.
+const txPollRecheckInterval = time.Second
+
+// pollTx has the user's tx queue of the pending transaction processed and waits until the transaction leaves the pending state,
+// for the wait at most. Unlike waitForTx it doesn't fail when the transaction is still pending: it returns the transaction as it is,
+// so a failed run or a queue backing off is only a reason to wait for txPollRecheckInterval and look again.
+// Once the processing is stopped by the shutdown, it returns the transaction as it is right away.
+func (a *API) pollTx(ctx context.Context, tx model.Tx, wait time.Duration) (polled model.Tx, err error) {
+	log.Debug().Str("userID", fmt.Sprint(tx.UserID)).Str("txID", fmt.Sprint(tx.ID)).Msg("api.pollTx START")
+	defer log.Debug().Msg("api.pollTx END")
+
+	waitCtx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	recheck := time.NewTicker(txPollRecheckInterval)
+	defer recheck.Stop()
+
+	for {
+
+		select {
+		case <-waitCtx.Done():
+			return tx, nil
+		case err = <-a.requestTxQueueRun(tx.UserID):
+		}
+
+		if errors.Is(err, errTxQueuesAreStopped) {
+			return tx, nil
+		}
+
+		// The transaction is looked up even if the wait is over meanwhile, the run doesn't depend on it.
+		tx, err = a.storage.GetTx(ctx, tx.ID)
+		if err != nil {
+			return model.Tx{}, err
+		}
+		if tx.Status != model.TxStatusPending {
+			return tx, nil
+		}
+
+		select {
+		case <-waitCtx.Done():
+			return tx, nil
+		case <-recheck.C:
+		}
+
+	}
+
+}
+
+// waitForTx has the user's tx queue processed and waits until the transaction leaves the pending state.
+// The wait is bounded by ctx, the processing itself is not.
+func (a *API) waitForTx(ctx context.Context, userID, txID int64) (tx model.Tx, err error) {
+	log.Debug().Str("userID", fmt.Sprint(userID)).Str("txID", fmt.Sprint(txID)).Msg("api.waitForTx START")
+	defer log.Debug().Msg("api.waitForTx END")
+
+	for {
+
+		select {
+		case <-ctx.Done():
+			return model.Tx{}, fmt.Errorf("txID: %d: %w: %v", txID, errTxIsStillPending, ctx.Err())
+		case err = <-a.requestTxQueueRun(userID):
+		}
+
+		if err != nil {
+			return model.Tx{}, err
+		}
+
+		tx, err = a.storage.GetTx(ctx, txID)
+		if err != nil {
+			return model.Tx{}, err
+		}
+
+		if tx.Status != model.TxStatusPending {
+			return tx, nil
+		}
+
+	}
+
+}
@@ -0,0 +1,23 @@
+package api
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// startListeningTxQueues processes the queues the listener notifies about until ctx is done.
+func (a *API) startListeningTxQueues(ctx context.Context, listener TxQueuesListener) (err error) {
+
+	return listener.ListenTxQueues(ctx, a.processTxQueueOnNotification)
+}
+
+// processTxQueueOnNotification has the user's tx queue processed by a run started after the notification.
+func (a *API) processTxQueueOnNotification(userID int64) {
+	log.Debug().Str("userID", fmt.Sprint(userID)).Msg("api.processTxQueueOnNotification START")
+	defer log.Debug().Msg("api.processTxQueueOnNotification END")
+
+	a.requestTxQueueRun(userID)
+
+}
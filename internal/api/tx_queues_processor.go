@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"transactions/internal/pg"
+)
+
+// txQueuesProcessor periodically sweeps the tx queues: it processes the queues of all the users
+// with pending transactions, so that no queue is left behind by a failed request.
+type txQueuesProcessor struct {
+	pollInterval time.Duration
+	workers      int
+
+	sweeps          atomic.Int64
+	processedQueues atomic.Int64
+	failedQueues    atomic.Int64
+}
+
+func newTxQueuesProcessor(pollInterval time.Duration, workers int) (newProcessor *txQueuesProcessor) {
+	log.Debug().Msg("api.newTxQueuesProcessor START")
+	defer log.Debug().Msg("api.newTxQueuesProcessor END")
+
+	newProcessor = &txQueuesProcessor{}
+
+	newProcessor.pollInterval = pollInterval
+
+	newProcessor.workers = workers
+
+	return newProcessor
+}
+
+// startProcessingTxQueues sweeps the tx queues every poll interval until ctx is done.
+// A sweep in progress then starts no more queues, and the ones started are left to finish.
+func (a *API) startProcessingTxQueues(ctx context.Context) (err error) {
+
+	ticker := time.NewTicker(a.txQueuesProcessor.pollInterval)
+	defer ticker.Stop()
+
+	for {
+
+		a.sweepTxQueues(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+	}
+
+}
+
+// sweepTxQueues processes the queues of all the users with pending transactions,
+// at most txQueuesProcessor.workers queues at once. It starts no more queues once ctx is done,
+// the queues started are processed by the users' actors within a.workCtx.
+func (a *API) sweepTxQueues(ctx context.Context) {
+	log.Debug().Msg("api.sweepTxQueues START")
+	defer log.Debug().Msg("api.sweepTxQueues END")
+
+	processor := a.txQueuesProcessor
+	sweep := processor.sweeps.Add(1)
+	started := time.Now()
+
+	users, err := a.storage.GetUsersWithNonEmptyTxQueues(ctx)
+	if err != nil {
+		log.Warn().Err(err).Int64("sweep", sweep).Msg("getting users with non empty tx queues")
+		return
+	}
+
+	var startedQueues int64
+	var failed atomic.Int64
+	workers := make(chan struct{}, processor.workers)
+	wg := sync.WaitGroup{}
+
+	for _, userID := range users {
+
+		select {
+		case <-ctx.Done():
+		case workers <- struct{}{}:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		startedQueues++
+		wg.Add(1)
+		go func(userID int64) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+
+			err := <-a.requestTxQueueRun(userID)
+			if err != nil && !errors.Is(err, pg.ErrTxQueueIsBackingOff) {
+				failed.Add(1)
+				log.Warn().Err(err).Str("userID", fmt.Sprint(userID)).Msg("tx queue is not processed by the sweep")
+			}
+		}(userID)
+
+	}
+
+	wg.Wait()
+
+	// The queues left once ctx is done are neither processed nor failed: the next sweep gets them.
+	processor.processedQueues.Add(startedQueues - failed.Load())
+	processor.failedQueues.Add(failed.Load())
+
+	logEvent := log.Debug()
+	if len(users) > 0 {
+		logEvent = log.Info()
+	}
+	logEvent.Int64("sweep", sweep).
+		Int("queues", len(users)).
+		Int64("started", startedQueues).
+		Int64("failed", failed.Load()).
+		Dur("duration", time.Since(started)).
+		Int64("totalProcessed", processor.processedQueues.Load()).
+		Int64("totalFailed", processor.failedQueues.Load()).
+		Msg("tx queues swept")
+
+}
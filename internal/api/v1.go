@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"transactions/internal/model"
+	"transactions/internal/validation"
+)
+
+const (
+	maxTxDescriptionLen       = 255
+	maxTxExternalReferenceLen = 255
+)
+
+type txRequest struct {
+	Amount            json.RawMessage `json:"amount"`
+	Currency          string          `json:"currency"`
+	Description       string          `json:"description"`
+	ExternalReference string          `json:"external_reference"`
+	IdempotencyKey    string          `json:"idempotency_key"`
+}
+
+func (a *API) v1ReceiptHandler(c *gin.Context) {
+	log.Debug().Msg("api.v1ReceiptHandler START")
+	defer log.Debug().Msg("api.v1ReceiptHandler END")
+
+	a.submitTxRequest(c, validation.OperationReceipt)
+}
+
+func (a *API) v1WithdrawalHandler(c *gin.Context) {
+	log.Debug().Msg("api.v1WithdrawalHandler START")
+	defer log.Debug().Msg("api.v1WithdrawalHandler END")
+
+	a.submitTxRequest(c, validation.OperationWithdraw)
+}
+
+// submitTxRequest queues the transaction of the JSON body for the user of the id param, see submitTx.
+// The currency may be omitted, otherwise it must be the one of the app. The idempotency key may be passed
+// in the body or in the Idempotency-Key header.
+func (a *API) submitTxRequest(c *gin.Context, operation validation.Operation) {
+
+	idParam, ok := c.Get("id")
+	if !ok {
+		respondError(c, errIDIsEmpty)
+		return
+	}
+	id, ok := idParam.(int64)
+	if !ok {
+		respondError(c, errInvalidID)
+		return
+	}
+
+	var req txRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, fmt.Errorf("%w: %v", errInvalidTxRequest, err))
+		return
+	}
+
+	sum, err := a.amountValidator.ParseAmount(operation, rawAmount(req.Amount))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if operation == validation.OperationWithdraw {
+		sum = sum.Neg()
+	}
+
+	switch {
+	case req.Currency != "" && !strings.EqualFold(req.Currency, a.currency):
+		respondError(c, fmt.Errorf("%w: %q, the only one is %s", errCurrencyNotSupported, req.Currency, a.currency))
+		return
+	case len(req.Description) > maxTxDescriptionLen:
+		respondError(c, fmt.Errorf("%w: description is longer than %d bytes", errInvalidTxRequest, maxTxDescriptionLen))
+		return
+	case len(req.ExternalReference) > maxTxExternalReferenceLen:
+		respondError(c, fmt.Errorf("%w: external_reference is longer than %d bytes", errInvalidTxRequest, maxTxExternalReferenceLen))
+		return
+	}
+
+	a.submitTx(c, id, sum, model.TxDetails{
+		Currency:          a.currency,
+		Description:       req.Description,
+		ExternalReference: req.ExternalReference,
+	}, idempotencyKey(c, req.IdempotencyKey))
+}
+
+// deprecated marks the responses of a legacy route with the Deprecation header
+// and links the route that replaces it, e.g. Link: </v1/users/1/receipts>; rel="successor-version".
+// The :id of the successor route is filled with the id param of the request.
+func deprecated(successorRoute string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Header("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, strings.ReplaceAll(successorRoute, ":id", c.Param("id"))))
+	}
+}
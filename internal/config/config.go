@@ -1,19 +1,46 @@
 package config
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"transactions/internal/money"
+	"transactions/internal/validation"
+)
 
 var errPgConnStringIsEmpty = errors.New("pg conn string is empty")
+var errInvalidCurrency = errors.New("invalid currency")
 
 type Config struct {
-	runAPIAddress string
-	pgConnString  string
-	ginMode       string
-	logLvl        string
+	runAPIAddress           string
+	pgConnString            string
+	inMemoryStorage         bool
+	ginMode                 string
+	logLvl                  string
+	idempotencyKeyRetention time.Duration
+	txQueuesPollInterval    time.Duration
+	txQueuesWorkers         int
+	txMaxAttempts           int
+	txRetryBaseDelay        time.Duration
+	txRetryMaxDelay         time.Duration
+	shutdownGracePeriod     time.Duration
+	txBatchWindow           time.Duration
+	txBatchSize             int
+	// amountMaxPrecision is -1 until it is configured, 0 is a valid precision.
+	amountMaxPrecision   int
+	receiptAmountLimits  string
+	withdrawAmountLimits string
+	transferAmountLimits string
+	amountLimits         map[validation.Operation]validation.Limits
+	currency             string
 }
 
 func New(options ...string) (*Config, error) {
 
-	newConfig := &Config{}
+	newConfig := &Config{amountMaxPrecision: -1}
 
 	for _, opt := range options {
 		switch opt {
@@ -28,10 +55,28 @@ func New(options ...string) (*Config, error) {
 
 	newConfig.setDefaultIfNotConfigured()
 
-	if newConfig.pgConnString == "" {
+	if newConfig.pgConnString == "" && !newConfig.inMemoryStorage {
 		return nil, errPgConnStringIsEmpty
 	}
 
+	newConfig.currency = strings.ToUpper(newConfig.currency)
+	if !isCurrencyCode(newConfig.currency) {
+		return nil, fmt.Errorf("%w: %q, expected a three-letter code like USD", errInvalidCurrency, newConfig.currency)
+	}
+
+	newConfig.amountLimits = map[validation.Operation]validation.Limits{}
+	for operation, reqLimits := range map[validation.Operation]string{
+		validation.OperationReceipt:  newConfig.receiptAmountLimits,
+		validation.OperationWithdraw: newConfig.withdrawAmountLimits,
+		validation.OperationTransfer: newConfig.transferAmountLimits,
+	} {
+		limits, err := validation.ParseLimits(reqLimits)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s amount limits: %w", operation, err)
+		}
+		newConfig.amountLimits[operation] = limits
+	}
+
 	return newConfig, nil
 }
 
@@ -49,6 +94,50 @@ func (c *Config) setDefaultIfNotConfigured() {
 		c.logLvl = "info"
 	}
 
+	if c.idempotencyKeyRetention <= 0 {
+		c.idempotencyKeyRetention = time.Hour * 24
+	}
+
+	if c.txQueuesPollInterval <= 0 {
+		c.txQueuesPollInterval = time.Second * 5
+	}
+
+	if c.txQueuesWorkers <= 0 {
+		c.txQueuesWorkers = 4
+	}
+
+	if c.txMaxAttempts <= 0 {
+		c.txMaxAttempts = 5
+	}
+
+	if c.txRetryBaseDelay <= 0 {
+		c.txRetryBaseDelay = time.Second
+	}
+
+	if c.txRetryMaxDelay <= 0 {
+		c.txRetryMaxDelay = time.Minute * 5
+	}
+
+	if c.shutdownGracePeriod <= 0 {
+		c.shutdownGracePeriod = time.Second * 30
+	}
+
+	if c.txBatchWindow < 0 {
+		c.txBatchWindow = 0
+	}
+
+	if c.txBatchSize <= 0 {
+		c.txBatchSize = 100
+	}
+
+	if c.amountMaxPrecision < 0 {
+		c.amountMaxPrecision = money.Scale
+	}
+
+	if c.currency == "" {
+		c.currency = "USD"
+	}
+
 }
 
 func (c *Config) RunAPIAddress() string {
@@ -59,6 +148,11 @@ func (c *Config) PgConnString() string {
 	return c.pgConnString
 }
 
+// InMemoryStorage tells to keep everything in memory instead of the db, for development and tests.
+func (c *Config) InMemoryStorage() bool {
+	return c.inMemoryStorage
+}
+
 func (c *Config) GinMode() string {
 	return c.ginMode
 }
@@ -67,8 +161,93 @@ func (c *Config) LogLvl() string {
 	return c.logLvl
 }
 
+func (c *Config) IdempotencyKeyRetention() time.Duration {
+	return c.idempotencyKeyRetention
+}
+
+func (c *Config) TxQueuesPollInterval() time.Duration {
+	return c.txQueuesPollInterval
+}
+
+func (c *Config) TxQueuesWorkers() int {
+	return c.txQueuesWorkers
+}
+
+func (c *Config) TxMaxAttempts() int {
+	return c.txMaxAttempts
+}
+
+func (c *Config) TxRetryBaseDelay() time.Duration {
+	return c.txRetryBaseDelay
+}
+
+func (c *Config) TxRetryMaxDelay() time.Duration {
+	return c.txRetryMaxDelay
+}
+
+func (c *Config) ShutdownGracePeriod() time.Duration {
+	return c.shutdownGracePeriod
+}
+
+func (c *Config) TxBatchWindow() time.Duration {
+	return c.txBatchWindow
+}
+
+func (c *Config) TxBatchSize() int {
+	return c.txBatchSize
+}
+
+// AmountMaxPrecision is the max number of significant digits after the point in the amounts of the requests.
+func (c *Config) AmountMaxPrecision() int {
+	return c.amountMaxPrecision
+}
+
+func (c *Config) ReceiptAmountLimits() validation.Limits {
+	return c.amountLimits[validation.OperationReceipt]
+}
+
+func (c *Config) WithdrawAmountLimits() validation.Limits {
+	return c.amountLimits[validation.OperationWithdraw]
+}
+
+func (c *Config) TransferAmountLimits() validation.Limits {
+	return c.amountLimits[validation.OperationTransfer]
+}
+
+// Currency is the three-letter code of the currency of the balances. The requests in another currency are rejected.
+func (c *Config) Currency() string {
+	return c.currency
+}
+
+func isCurrencyCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for _, r := range s {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *Config) String() string {
 	return "run API address :" + c.runAPIAddress +
+		"In memory storage: " + strconv.FormatBool(c.inMemoryStorage) +
 		"Gin mode :" + c.ginMode +
-		"Log lvl: " + c.logLvl
+		"Log lvl: " + c.logLvl +
+		"Idempotency key retention: " + c.idempotencyKeyRetention.String() +
+		"Tx queues poll interval: " + c.txQueuesPollInterval.String() +
+		"Tx queues workers: " + strconv.Itoa(c.txQueuesWorkers) +
+		"Tx max attempts: " + strconv.Itoa(c.txMaxAttempts) +
+		"Tx retry base delay: " + c.txRetryBaseDelay.String() +
+		"Tx retry max delay: " + c.txRetryMaxDelay.String() +
+		"Shutdown grace period: " + c.shutdownGracePeriod.String() +
+		"Tx batch window: " + c.txBatchWindow.String() +
+		"Tx batch size: " + strconv.Itoa(c.txBatchSize) +
+		"Amount max precision: " + strconv.Itoa(c.amountMaxPrecision) +
+		"Receipt amount limits: " + c.receiptAmountLimits +
+		"Withdraw amount limits: " + c.withdrawAmountLimits +
+		"Transfer amount limits: " + c.transferAmountLimits +
+		"Currency: " + c.currency
 }
@@ -3,6 +3,7 @@ package config
 import (
 	"flag"
 	"fmt"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 )
@@ -11,12 +12,42 @@ func (c *Config) parseFromFlag() {
 
 	flag.StringVar(&c.runAPIAddress, "a", "", "api server run address")
 
-	flag.StringVar(&c.pgConnString, "p", "", "connection string to postgres db")
+	flag.StringVar(&c.pgConnString, "p", "", "connection string to the db: postgres, or sqlite:///path/to/file.db for the embedded SQLite storage")
+
+	flag.BoolVar(&c.inMemoryStorage, "m", false, "keep everything in memory instead of the db, for development and tests")
 
 	flag.StringVar(&c.ginMode, "g", "", "gin mode")
 
 	flag.StringVar(&c.logLvl, "l", "", "log lvl")
 
+	flag.DurationVar(&c.idempotencyKeyRetention, "r", 0, "idempotency key retention period")
+
+	flag.DurationVar(&c.txQueuesPollInterval, "i", 0, "tx queues poll interval")
+
+	flag.IntVar(&c.txQueuesWorkers, "w", 0, "number of tx queues processed at once by the background processor")
+
+	flag.IntVar(&c.txMaxAttempts, "n", 0, "number of failed attempts to process a transaction before it is dead-lettered")
+
+	flag.DurationVar(&c.txRetryBaseDelay, "b", 0, "delay before the first retry of a failed transaction, doubled with every attempt")
+
+	flag.DurationVar(&c.txRetryMaxDelay, "x", 0, "max delay between retries of a failed transaction")
+
+	flag.DurationVar(&c.shutdownGracePeriod, "s", 0, "time given to requests and tx queues processing in progress to finish on shutdown")
+
+	flag.DurationVar(&c.txBatchWindow, "c", 0, "window to coalesce the transactions of a user into one tx queue processing, 0 to process at once")
+
+	flag.IntVar(&c.txBatchSize, "z", 0, "max number of transactions coalesced into one tx queue processing")
+
+	flag.IntVar(&c.amountMaxPrecision, "e", -1, "max number of digits after the point in amounts, from 0 to 2")
+
+	flag.StringVar(&c.receiptAmountLimits, "u", "", "min:max amount of a receipt, e.g. 0.10:1000, either side may be empty")
+
+	flag.StringVar(&c.withdrawAmountLimits, "o", "", "min:max amount of a withdrawal, e.g. 0.10:1000, either side may be empty")
+
+	flag.StringVar(&c.transferAmountLimits, "t", "", "min:max amount of a transfer, e.g. 0.10:1000, either side may be empty")
+
+	flag.StringVar(&c.currency, "y", "", "three-letter code of the currency of the balances, e.g. USD")
+
 	flag.Parse()
 
 }
@@ -24,10 +55,25 @@ func (c *Config) parseFromFlag() {
 func (c *Config) parseFromEnv() (err error) {
 
 	envConfig := struct {
-		RunAPIAddress string `env:"RUN_API_ADDRESS"`
-		PgConnString  string `env:"PG_CONN_STRING"`
-		GinMode       string `env:"GIN_MODE"`
-		LogLevel      string `env:"LOG_LEVEL"`
+		RunAPIAddress           string        `env:"RUN_API_ADDRESS"`
+		PgConnString            string        `env:"PG_CONN_STRING"`
+		InMemoryStorage         bool          `env:"IN_MEMORY_STORAGE"`
+		GinMode                 string        `env:"GIN_MODE"`
+		LogLevel                string        `env:"LOG_LEVEL"`
+		IdempotencyKeyRetention time.Duration `env:"IDEMPOTENCY_KEY_RETENTION"`
+		TxQueuesPollInterval    time.Duration `env:"TX_QUEUES_POLL_INTERVAL"`
+		TxQueuesWorkers         int           `env:"TX_QUEUES_WORKERS"`
+		TxMaxAttempts           int           `env:"TX_MAX_ATTEMPTS"`
+		TxRetryBaseDelay        time.Duration `env:"TX_RETRY_BASE_DELAY"`
+		TxRetryMaxDelay         time.Duration `env:"TX_RETRY_MAX_DELAY"`
+		ShutdownGracePeriod     time.Duration `env:"SHUTDOWN_GRACE_PERIOD"`
+		TxBatchWindow           time.Duration `env:"TX_BATCH_WINDOW"`
+		TxBatchSize             int           `env:"TX_BATCH_SIZE"`
+		AmountMaxPrecision      *int          `env:"AMOUNT_MAX_PRECISION"`
+		ReceiptAmountLimits     string        `env:"RECEIPT_AMOUNT_LIMITS"`
+		WithdrawAmountLimits    string        `env:"WITHDRAW_AMOUNT_LIMITS"`
+		TransferAmountLimits    string        `env:"TRANSFER_AMOUNT_LIMITS"`
+		Currency                string        `env:"CURRENCY"`
 	}{}
 
 	if err = env.Parse(&envConfig); err != nil {
@@ -42,6 +88,10 @@ func (c *Config) parseFromEnv() (err error) {
 		c.pgConnString = envConfig.PgConnString
 	}
 
+	if envConfig.InMemoryStorage {
+		c.inMemoryStorage = envConfig.InMemoryStorage
+	}
+
 	if envConfig.GinMode != "" {
 		c.ginMode = envConfig.GinMode
 	}
@@ -50,5 +100,61 @@ func (c *Config) parseFromEnv() (err error) {
 		c.ginMode = envConfig.LogLevel
 	}
 
+	if envConfig.IdempotencyKeyRetention != 0 {
+		c.idempotencyKeyRetention = envConfig.IdempotencyKeyRetention
+	}
+
+	if envConfig.TxQueuesPollInterval != 0 {
+		c.txQueuesPollInterval = envConfig.TxQueuesPollInterval
+	}
+
+	if envConfig.TxQueuesWorkers != 0 {
+		c.txQueuesWorkers = envConfig.TxQueuesWorkers
+	}
+
+	if envConfig.TxMaxAttempts != 0 {
+		c.txMaxAttempts = envConfig.TxMaxAttempts
+	}
+
+	if envConfig.TxRetryBaseDelay != 0 {
+		c.txRetryBaseDelay = envConfig.TxRetryBaseDelay
+	}
+
+	if envConfig.TxRetryMaxDelay != 0 {
+		c.txRetryMaxDelay = envConfig.TxRetryMaxDelay
+	}
+
+	if envConfig.ShutdownGracePeriod != 0 {
+		c.shutdownGracePeriod = envConfig.ShutdownGracePeriod
+	}
+
+	if envConfig.TxBatchWindow != 0 {
+		c.txBatchWindow = envConfig.TxBatchWindow
+	}
+
+	if envConfig.TxBatchSize != 0 {
+		c.txBatchSize = envConfig.TxBatchSize
+	}
+
+	if envConfig.AmountMaxPrecision != nil {
+		c.amountMaxPrecision = *envConfig.AmountMaxPrecision
+	}
+
+	if envConfig.ReceiptAmountLimits != "" {
+		c.receiptAmountLimits = envConfig.ReceiptAmountLimits
+	}
+
+	if envConfig.WithdrawAmountLimits != "" {
+		c.withdrawAmountLimits = envConfig.WithdrawAmountLimits
+	}
+
+	if envConfig.TransferAmountLimits != "" {
+		c.transferAmountLimits = envConfig.TransferAmountLimits
+	}
+
+	if envConfig.Currency != "" {
+		c.currency = envConfig.Currency
+	}
+
 	return nil
 }
@@ -0,0 +1,527 @@
+// Package memstore is an in-memory storage with the same semantics as the pg one, for development and tests.
+// It keeps nothing between restarts.
+package memstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"transactions/internal/model"
+	"transactions/internal/money"
+	"transactions/internal/pg"
+)
+
+var ErrStorageIsClosed = errors.New("storage is closed")
+
+type storedIdempotencyKey struct {
+	userID     int64
+	sum        money.Amount
+	txID       int64
+	transferID int64
+	createdAt  time.Time
+}
+
+// MemStore keeps everything behind one mutex, so every method is atomic and the user's queue
+// is processed by one caller at a time, like the pg storage does with its locks.
+// IDs of the transactions, transfers and dead letters are their indexes in the slices plus one.
+type MemStore struct {
+	mu              sync.Mutex
+	isClosed        bool
+	balances        map[int64]money.Amount
+	lastUserID      int64
+	txs             []model.Tx
+	transfers       []model.Transfer
+	deadLetters     []model.DeadLetter
+	idempotencyKeys map[string]storedIdempotencyKey
+}
+
+func New() (newMemStore *MemStore) {
+	log.Debug().Msg("memstore.New START")
+	defer log.Debug().Msg("memstore.New END")
+
+	newMemStore = &MemStore{}
+
+	newMemStore.balances = map[int64]money.Amount{}
+
+	newMemStore.idempotencyKeys = map[string]storedIdempotencyKey{}
+
+	return newMemStore
+}
+
+// AddUser adds a user with a zero balance and returns the ID of the user.
+func (m *MemStore) AddUser() (userID int64, err error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.isClosed {
+		return 0, ErrStorageIsClosed
+	}
+
+	m.lastUserID++
+	m.balances[m.lastUserID] = 0
+
+	return m.lastUserID, nil
+}
+
+func (m *MemStore) InitFirstFiveUsersIfNotExistsForTestingApp() (err error) {
+	log.Debug().Msg("MemStore.InitFirstFiveUsersIfNotExistsForTestingApp START")
+	defer log.Debug().Msg("MemStore.InitFirstFiveUsersIfNotExistsForTestingApp END")
+
+	for m.lastUserID < 5 {
+		if _, err = m.AddUser(); err != nil {
+			return fmt.Errorf("adding user: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// lock locks the storage. It fails if the storage is closed or ctx is done; the caller must unlock it only if lock succeeds.
+func (m *MemStore) lock(ctx context.Context) (err error) {
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if m.isClosed {
+		m.mu.Unlock()
+		return ErrStorageIsClosed
+	}
+
+	return nil
+}
+
+func (m *MemStore) AddTx(ctx context.Context, userID int64, sum money.Amount, details model.TxDetails, idempotencyKey string) (txID int64, isReplay bool, err error) {
+	log.Debug().Msg("MemStore.AddTx START")
+	defer log.Debug().Msg("MemStore.AddTx END")
+
+	if err = m.lock(ctx); err != nil {
+		return 0, false, err
+	}
+	defer m.mu.Unlock()
+
+	if idempotencyKey != "" {
+		if key, isExists := m.idempotencyKeys[idempotencyKey]; isExists {
+			if key.userID != userID || key.sum != sum || key.transferID != 0 {
+				return 0, false, fmt.Errorf("userID: %d: %w", userID, pg.ErrIdempotencyKeyReused)
+			}
+			return key.txID, true, nil
+		}
+	}
+
+	if _, isExists := m.balances[userID]; !isExists {
+		return 0, false, fmt.Errorf("adding a transaction to the user's queue: userID: %d: %w", userID, pg.ErrUserNotFound)
+	}
+
+	tx := m.addTx(model.Tx{UserID: userID, Sum: sum, Status: model.TxStatusPending, TxDetails: details})
+
+	if idempotencyKey != "" {
+		m.idempotencyKeys[idempotencyKey] = storedIdempotencyKey{userID: userID, sum: sum, txID: tx.ID, createdAt: tx.CreatedAt}
+	}
+
+	return tx.ID, false, nil
+}
+
+func (m *MemStore) addTx(tx model.Tx) model.Tx {
+	tx.ID = int64(len(m.txs)) + 1
+	tx.CreatedAt = time.Now()
+	m.txs = append(m.txs, tx)
+	return tx
+}
+
+func (m *MemStore) GetTx(ctx context.Context, txID int64) (tx model.Tx, err error) {
+	log.Debug().Msg("MemStore.GetTx START")
+	defer log.Debug().Msg("MemStore.GetTx END")
+
+	if err = m.lock(ctx); err != nil {
+		return model.Tx{}, err
+	}
+	defer m.mu.Unlock()
+
+	if txID < 1 || txID > int64(len(m.txs)) {
+		return model.Tx{}, fmt.Errorf("getting transaction: txID: %d: %w", txID, pg.ErrTxNotFound)
+	}
+
+	return m.txs[txID-1], nil
+}
+
+func (m *MemStore) GetTxs(ctx context.Context, filter model.TxFilter) (txs []model.Tx, err error) {
+	log.Debug().Msg("MemStore.GetTxs START")
+	defer log.Debug().Msg("MemStore.GetTxs END")
+
+	if err = m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	for i := len(m.txs) - 1; i >= 0 && len(txs) < filter.Limit; i-- {
+		tx := m.txs[i]
+		amount := tx.Amount()
+		switch {
+		case tx.UserID != filter.UserID,
+			filter.Cursor != 0 && tx.ID >= filter.Cursor,
+			filter.Type != "" && tx.Type() != filter.Type,
+			filter.Status != "" && tx.Status != filter.Status,
+			filter.MinAmount != nil && amount < *filter.MinAmount,
+			filter.MaxAmount != nil && amount > *filter.MaxAmount,
+			filter.CreatedFrom != nil && tx.CreatedAt.Before(*filter.CreatedFrom),
+			filter.CreatedTo != nil && !tx.CreatedAt.Before(*filter.CreatedTo):
+			continue
+		}
+		txs = append(txs, tx)
+	}
+
+	return txs, nil
+}
+
+func (m *MemStore) GetBalance(ctx context.Context, userID int64) (balance model.Balance, err error) {
+	log.Debug().Msg("MemStore.GetBalance START")
+	defer log.Debug().Msg("MemStore.GetBalance END")
+
+	if err = m.lock(ctx); err != nil {
+		return model.Balance{}, err
+	}
+	defer m.mu.Unlock()
+
+	settled, isExists := m.balances[userID]
+	if !isExists {
+		return model.Balance{}, fmt.Errorf("getting user balance: userID: %d: %w", userID, pg.ErrUserNotFound)
+	}
+
+	balance = model.Balance{UserID: userID, Settled: settled}
+	for _, tx := range m.txs {
+		if tx.UserID != userID || tx.Status != model.TxStatusPending {
+			continue
+		}
+		if tx.Sum > 0 {
+			balance.PendingReceipts += tx.Sum
+		} else {
+			balance.PendingWithdrawals += tx.Sum.Neg()
+		}
+	}
+
+	return balance, nil
+}
+
+// Transfer moves the amount from one user to another at once, see pg.Pg.Transfer.
+func (m *MemStore) Transfer(ctx context.Context, fromUserID, toUserID int64, amount money.Amount, idempotencyKey string) (transfer model.Transfer, isReplay bool, err error) {
+	log.Debug().Msg("MemStore.Transfer START")
+	defer log.Debug().Msg("MemStore.Transfer END")
+
+	if err = m.lock(ctx); err != nil {
+		return model.Transfer{}, false, err
+	}
+	defer m.mu.Unlock()
+
+	if idempotencyKey != "" {
+		if key, isExists := m.idempotencyKeys[idempotencyKey]; isExists {
+			if key.transferID == 0 {
+				return model.Transfer{}, false, fmt.Errorf("userID: %d: %w", fromUserID, pg.ErrIdempotencyKeyReused)
+			}
+			transfer = m.transfers[key.transferID-1]
+			if transfer.FromUserID != fromUserID || transfer.ToUserID != toUserID || transfer.Amount != amount {
+				return model.Transfer{}, false, fmt.Errorf("userID: %d: %w", fromUserID, pg.ErrIdempotencyKeyReused)
+			}
+			return transfer, true, nil
+		}
+	}
+
+	for _, userID := range []int64{fromUserID, toUserID} {
+		if _, isExists := m.balances[userID]; !isExists {
+			return model.Transfer{}, false, fmt.Errorf("getting user balance: userID: %d: %w", userID, pg.ErrUserNotFound)
+		}
+	}
+
+	fromBalance, err := m.balances[fromUserID].Add(amount.Neg())
+	if err != nil {
+		return model.Transfer{}, false, fmt.Errorf("debiting user: userID: %d: %w", fromUserID, err)
+	}
+	if fromBalance < 0 {
+		return model.Transfer{}, false, fmt.Errorf("debiting user: userID: %d: %w", fromUserID, pg.ErrInsufficientFunds)
+	}
+	toBalance, err := m.balances[toUserID].Add(amount)
+	if err != nil {
+		return model.Transfer{}, false, fmt.Errorf("crediting user: userID: %d: %w", toUserID, err)
+	}
+
+	transfer = model.Transfer{
+		ID:               int64(len(m.transfers)) + 1,
+		FromUserID:       fromUserID,
+		ToUserID:         toUserID,
+		Amount:           amount,
+		FromBalanceAfter: fromBalance,
+		CreatedAt:        time.Now(),
+	}
+	m.transfers = append(m.transfers, transfer)
+
+	m.balances[fromUserID], m.balances[toUserID] = fromBalance, toBalance
+
+	fromTx := m.addTransferTx(fromUserID, amount.Neg(), fromBalance, transfer.ID)
+	m.addTransferTx(toUserID, amount, toBalance, transfer.ID)
+
+	if idempotencyKey != "" {
+		m.idempotencyKeys[idempotencyKey] = storedIdempotencyKey{
+			userID:     fromUserID,
+			sum:        amount.Neg(),
+			txID:       fromTx.ID,
+			transferID: transfer.ID,
+			createdAt:  transfer.CreatedAt,
+		}
+	}
+
+	return transfer, false, nil
+}
+
+func (m *MemStore) addTransferTx(userID int64, sum, balanceAfter money.Amount, transferID int64) model.Tx {
+	tx := m.addTx(model.Tx{UserID: userID, Sum: sum, Status: model.TxStatusApplied, BalanceAfter: &balanceAfter, TransferID: &transferID})
+	m.txs[tx.ID-1].ProcessedAt = &tx.CreatedAt
+	return m.txs[tx.ID-1]
+}
+
+// ProcessTxQueue processes the pending transactions of the user one by one in FIFO order, see pg.Pg.ProcessTxQueue.
+func (m *MemStore) ProcessTxQueue(ctx context.Context, userID int64) (processed []model.Tx, err error) {
+	log.Debug().Msg("MemStore.ProcessTxQueue START")
+	defer log.Debug().Msg("MemStore.ProcessTxQueue END")
+
+	if err = m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	balance, isExists := m.balances[userID]
+	if !isExists {
+		return nil, fmt.Errorf("getting user balance: userID: %d: %w", userID, pg.ErrUserNotFound)
+	}
+
+	pending := m.pendingTxs(userID)
+	if len(pending) > 0 && pending[0].NextAttemptAt != nil && pending[0].NextAttemptAt.After(time.Now()) {
+		return nil, fmt.Errorf("processing tx queue: userID: %d: txID: %d: %w", userID, pending[0].ID, pg.ErrTxQueueIsBackingOff)
+	}
+
+	now := time.Now()
+	for _, currTx := range pending {
+
+		newBalance, errAdd := balance.Add(currTx.Sum)
+		switch {
+		case errAdd != nil:
+			currTx.Status, currTx.RejectCode, currTx.RejectReason = model.TxStatusRejected, model.RejectCodeBalanceOverflow, errAdd.Error()
+		case newBalance < 0:
+			currTx.Status, currTx.RejectCode, currTx.RejectReason = model.TxStatusRejected, model.RejectCodeInsufficientFunds, pg.ErrInsufficientFunds.Error()
+		default:
+			currTx.Status = model.TxStatusApplied
+			balance = newBalance
+		}
+
+		balanceAfter := balance
+		currTx.BalanceAfter = &balanceAfter
+		processedAt := now
+		currTx.ProcessedAt = &processedAt
+
+		m.txs[currTx.ID-1] = currTx
+		processed = append(processed, currTx)
+	}
+
+	m.balances[userID] = balance
+
+	return processed, nil
+}
+
+// pendingTxs returns the pending transactions of the user in FIFO order.
+func (m *MemStore) pendingTxs(userID int64) (pending []model.Tx) {
+	for _, tx := range m.txs {
+		if tx.UserID == userID && tx.Status == model.TxStatusPending {
+			pending = append(pending, tx)
+		}
+	}
+	return pending
+}
+
+// GetUsersWithNonEmptyTxQueues returns the users with pending transactions,
+// except the ones whose oldest pending transaction waits for its next attempt.
+func (m *MemStore) GetUsersWithNonEmptyTxQueues(ctx context.Context) (users []int64, err error) {
+	log.Debug().Msg("MemStore.GetUsersWithNonEmptyTxQueues START")
+	defer log.Debug().Msg("MemStore.GetUsersWithNonEmptyTxQueues END")
+
+	if err = m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	// The transactions are in FIFO order, so the first pending one of a user is the oldest.
+	isBackingOff := map[int64]bool{}
+	now := time.Now()
+	for _, tx := range m.txs {
+		if tx.Status != model.TxStatusPending {
+			continue
+		}
+		if _, isSeen := isBackingOff[tx.UserID]; !isSeen {
+			isBackingOff[tx.UserID] = tx.NextAttemptAt != nil && tx.NextAttemptAt.After(now)
+		}
+	}
+
+	for userID, currIsBackingOff := range isBackingOff {
+		if !currIsBackingOff {
+			users = append(users, userID)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i] < users[j] })
+
+	return users, nil
+}
+
+// RecordTxQueueFailure counts a failed run against the oldest pending transaction of the user, see pg.Pg.RecordTxQueueFailure.
+func (m *MemStore) RecordTxQueueFailure(ctx context.Context, userID int64, reason string, policy model.RetryPolicy) (failed model.Tx, err error) {
+	log.Debug().Msg("MemStore.RecordTxQueueFailure START")
+	defer log.Debug().Msg("MemStore.RecordTxQueueFailure END")
+
+	if err = m.lock(ctx); err != nil {
+		return model.Tx{}, err
+	}
+	defer m.mu.Unlock()
+
+	pending := m.pendingTxs(userID)
+	if len(pending) == 0 {
+		return model.Tx{}, fmt.Errorf("getting the oldest pending transaction: userID: %d: %w", userID, pg.ErrTxNotFound)
+	}
+
+	failed = pending[0]
+	failed.Attempts++
+	failed.LastError = reason
+
+	now := time.Now()
+	if failed.Attempts >= policy.MaxAttempts {
+		failed.Status = model.TxStatusDeadLettered
+		failed.NextAttemptAt = nil
+		failed.ProcessedAt = &now
+		m.deadLetters = append(m.deadLetters, model.DeadLetter{
+			ID:        int64(len(m.deadLetters)) + 1,
+			TxID:      failed.ID,
+			UserID:    userID,
+			Sum:       failed.Sum,
+			Attempts:  failed.Attempts,
+			LastError: reason,
+			CreatedAt: now,
+		})
+	} else {
+		nextAttemptAt := now.Add(policy.Delay(failed.Attempts))
+		failed.NextAttemptAt = &nextAttemptAt
+	}
+
+	m.txs[failed.ID-1] = failed
+
+	return failed, nil
+}
+
+// GetDeadLetters returns a page of the unresolved dead letters, oldest first.
+func (m *MemStore) GetDeadLetters(ctx context.Context, cursor int64, limit int) (deadLetters []model.DeadLetter, err error) {
+	log.Debug().Msg("MemStore.GetDeadLetters START")
+	defer log.Debug().Msg("MemStore.GetDeadLetters END")
+
+	if err = m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	for _, deadLetter := range m.deadLetters {
+		if len(deadLetters) == limit {
+			break
+		}
+		if deadLetter.ResolvedAt == nil && deadLetter.ID > cursor {
+			deadLetters = append(deadLetters, deadLetter)
+		}
+	}
+
+	return deadLetters, nil
+}
+
+// RequeueDeadLetter puts the transaction of the dead letter back to its user's queue, see pg.Pg.RequeueDeadLetter.
+func (m *MemStore) RequeueDeadLetter(ctx context.Context, deadLetterID int64) (deadLetter model.DeadLetter, err error) {
+	log.Debug().Msg("MemStore.RequeueDeadLetter START")
+	defer log.Debug().Msg("MemStore.RequeueDeadLetter END")
+
+	return m.resolveDeadLetter(ctx, deadLetterID, model.DeadLetterResolutionRequeued, func(tx *model.Tx) {
+		tx.Status = model.TxStatusPending
+		tx.Attempts, tx.LastError, tx.NextAttemptAt, tx.ProcessedAt = 0, "", nil, nil
+	})
+}
+
+// DiscardDeadLetter rejects the transaction of the dead letter.
+func (m *MemStore) DiscardDeadLetter(ctx context.Context, deadLetterID int64) (deadLetter model.DeadLetter, err error) {
+	log.Debug().Msg("MemStore.DiscardDeadLetter START")
+	defer log.Debug().Msg("MemStore.DiscardDeadLetter END")
+
+	return m.resolveDeadLetter(ctx, deadLetterID, model.DeadLetterResolutionDiscarded, func(tx *model.Tx) {
+		now := time.Now()
+		tx.Status, tx.RejectCode, tx.RejectReason, tx.ProcessedAt =
+			model.TxStatusRejected, model.RejectCodeDiscarded, string(model.DeadLetterResolutionDiscarded), &now
+	})
+}
+
+func (m *MemStore) resolveDeadLetter(ctx context.Context, deadLetterID int64, resolution model.DeadLetterResolution,
+	resolveTx func(tx *model.Tx)) (deadLetter model.DeadLetter, err error) {
+
+	if err = m.lock(ctx); err != nil {
+		return model.DeadLetter{}, err
+	}
+	defer m.mu.Unlock()
+
+	if deadLetterID < 1 || deadLetterID > int64(len(m.deadLetters)) {
+		return model.DeadLetter{}, fmt.Errorf("getting dead letter: id: %d: %w", deadLetterID, pg.ErrDeadLetterNotFound)
+	}
+
+	deadLetter = m.deadLetters[deadLetterID-1]
+	if deadLetter.ResolvedAt != nil {
+		return model.DeadLetter{}, fmt.Errorf("resolving dead letter: id: %d: %w: %s", deadLetterID, pg.ErrDeadLetterIsResolved, deadLetter.Resolution)
+	}
+
+	if tx := &m.txs[deadLetter.TxID-1]; tx.Status == model.TxStatusDeadLettered {
+		resolveTx(tx)
+	}
+
+	now := time.Now()
+	deadLetter.ResolvedAt, deadLetter.Resolution = &now, resolution
+	m.deadLetters[deadLetterID-1] = deadLetter
+
+	return deadLetter, nil
+}
+
+// DeleteIdempotencyKeysCreatedBefore deletes the expired idempotency keys.
+func (m *MemStore) DeleteIdempotencyKeysCreatedBefore(ctx context.Context, before time.Time) (deleted int64, err error) {
+	log.Debug().Msg("MemStore.DeleteIdempotencyKeysCreatedBefore START")
+	defer log.Debug().Msg("MemStore.DeleteIdempotencyKeysCreatedBefore END")
+
+	if err = m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.Unlock()
+
+	for keyName, key := range m.idempotencyKeys {
+		if key.createdAt.Before(before) {
+			delete(m.idempotencyKeys, keyName)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// Close makes every further call but Close fail with ErrStorageIsClosed.
+func (m *MemStore) Close() (err error) {
+	log.Debug().Msg("MemStore.Close START")
+	defer log.Debug().Msg("MemStore.Close END")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.isClosed = true
+
+	return nil
+}
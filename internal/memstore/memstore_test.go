@@ -0,0 +1,14 @@
+package memstore_test
+
+import (
+	"testing"
+
+	"transactions/internal/memstore"
+	"transactions/internal/storagetest"
+)
+
+func TestMemStore(t *testing.T) {
+	storagetest.Run(t, func() (storagetest.Storage, error) {
+		return memstore.New(), nil
+	})
+}
@@ -0,0 +1,18 @@
+package model
+
+import "transactions/internal/money"
+
+// Balance is the state of a user's money: Settled is what the applied transactions add up to,
+// PendingReceipts and PendingWithdrawals are totals of the transactions still queued.
+type Balance struct {
+	UserID             int64
+	Settled            money.Amount
+	PendingReceipts    money.Amount
+	PendingWithdrawals money.Amount
+}
+
+// Available is the settled balance minus the queued withdrawals: queued receipts
+// are not available until they are applied, queued withdrawals are already promised.
+func (b Balance) Available() money.Amount {
+	return b.Settled - b.PendingWithdrawals
+}
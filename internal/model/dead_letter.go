@@ -0,0 +1,29 @@
+package model
+
+import (
+	"time"
+
+	"transactions/internal/money"
+)
+
+type DeadLetterResolution string
+
+const (
+	DeadLetterResolutionRequeued  DeadLetterResolution = "requeued"
+	DeadLetterResolutionDiscarded DeadLetterResolution = "discarded"
+)
+
+// DeadLetter is a transaction whose processing failed too many times. It waits for an admin
+// to requeue or discard it; until then its transaction is dead-lettered and the user's queue goes on without it.
+type DeadLetter struct {
+	ID        int64
+	TxID      int64
+	UserID    int64
+	Sum       money.Amount
+	Attempts  int
+	LastError string
+	CreatedAt time.Time
+	// ResolvedAt and Resolution are set once the dead letter is requeued or discarded.
+	ResolvedAt *time.Time
+	Resolution DeadLetterResolution
+}
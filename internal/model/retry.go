@@ -0,0 +1,24 @@
+package model
+
+import "time"
+
+// RetryPolicy tells how a transaction whose processing fails is retried:
+// the delays between attempts grow exponentially from BaseDelay up to MaxDelay,
+// and after MaxAttempts failed attempts the transaction is dead-lettered.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// Delay is how long to wait before the next attempt after the given number of failed attempts.
+func (p RetryPolicy) Delay(attempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
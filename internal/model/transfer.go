@@ -0,0 +1,17 @@
+package model
+
+import (
+	"time"
+
+	"transactions/internal/money"
+)
+
+// Transfer is money moved from one user to another at once.
+type Transfer struct {
+	ID               int64
+	FromUserID       int64
+	ToUserID         int64
+	Amount           money.Amount
+	FromBalanceAfter money.Amount
+	CreatedAt        time.Time
+}
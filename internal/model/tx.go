@@ -0,0 +1,93 @@
+package model
+
+import (
+	"time"
+
+	"transactions/internal/money"
+)
+
+type TxStatus string
+
+const (
+	TxStatusPending  TxStatus = "pending"
+	TxStatusApplied  TxStatus = "applied"
+	TxStatusRejected TxStatus = "rejected"
+	// TxStatusDeadLettered is a transaction whose processing failed too many times, see DeadLetter.
+	TxStatusDeadLettered TxStatus = "dead_lettered"
+)
+
+// RejectCode is the machine-readable reason of a rejected transaction, RejectReason is its text for display.
+type RejectCode string
+
+const (
+	RejectCodeInsufficientFunds RejectCode = "insufficient_funds"
+	RejectCodeBalanceOverflow   RejectCode = "balance_overflow"
+	// RejectCodeDiscarded is a dead-lettered transaction discarded by an admin.
+	RejectCodeDiscarded RejectCode = "discarded"
+)
+
+type TxType string
+
+const (
+	TxTypeReceipt  TxType = "receipt"
+	TxTypeWithdraw TxType = "withdraw"
+)
+
+// Tx is a queued transaction of a user: a receipt if Sum is positive, a withdrawal if it is negative.
+type Tx struct {
+	ID           int64
+	UserID       int64
+	Sum          money.Amount
+	Status       TxStatus
+	RejectCode   RejectCode
+	RejectReason string
+	// BalanceAfter is the balance of the user right after the transaction was processed, nil while it is pending.
+	BalanceAfter *money.Amount
+	CreatedAt    time.Time
+	ProcessedAt  *time.Time
+	// TransferID is set if the transaction is a side of a transfer between users.
+	TransferID *int64
+	// Attempts is the number of failed attempts to process the transaction, LastError is the error of the last one.
+	// The next attempt is not made before NextAttemptAt.
+	Attempts      int
+	LastError     string
+	NextAttemptAt *time.Time
+	TxDetails
+}
+
+// TxDetails is what the client tells about a transaction besides its amount. It is stored as it is
+// and doesn't affect processing. Currency is the one of the app: the balances are kept in one currency.
+type TxDetails struct {
+	Currency          string
+	Description       string
+	ExternalReference string
+}
+
+func (t Tx) Type() TxType {
+	if t.Sum < 0 {
+		return TxTypeWithdraw
+	}
+	return TxTypeReceipt
+}
+
+// Amount is the absolute value of Sum.
+func (t Tx) Amount() money.Amount {
+	if t.Sum < 0 {
+		return t.Sum.Neg()
+	}
+	return t.Sum
+}
+
+// TxFilter selects a page of a user's transactions, newest first. Zero fields don't filter.
+// Cursor is the ID of the last transaction of the previous page.
+type TxFilter struct {
+	UserID      int64
+	Type        TxType
+	Status      TxStatus
+	MinAmount   *money.Amount
+	MaxAmount   *money.Amount
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	Cursor      int64
+	Limit       int
+}
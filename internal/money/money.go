@@ -0,0 +1,165 @@
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Scale is the number of digits after the decimal point an Amount keeps.
+const Scale = 2
+
+// minorUnitsInMajor is 10^Scale: how many minor units make one major unit.
+const minorUnitsInMajor = 100
+
+var (
+	ErrInvalidAmount  = errors.New("invalid amount")
+	ErrAmountOverflow = errors.New("amount overflow")
+	// ErrAmountTooPrecise is an ErrInvalidAmount with more than Scale significant digits after the point.
+	ErrAmountTooPrecise = fmt.Errorf("%w: more than %d digits after the point", ErrInvalidAmount, Scale)
+)
+
+// Amount is a sum of money kept as an exact integer count of minor units
+// (e.g. cents), so that adding amounts never loses precision.
+// Its range is symmetric, from -math.MaxInt64 to math.MaxInt64, so Neg never overflows:
+// Parse and Add never return math.MinInt64.
+type Amount int64
+
+// Parse parses a decimal string like "12", "-12.3" or "12.34" into an Amount.
+// It never goes through floating point: anything that is not a plain decimal
+// with at most Scale significant fractional digits is rejected.
+func Parse(s string) (Amount, error) {
+
+	if s == "" {
+		return 0, ErrInvalidAmount
+	}
+
+	negative := false
+	switch s[0] {
+	case '-':
+		negative = true
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+
+	intPart, fracPart, hasPoint := strings.Cut(s, ".")
+	if intPart == "" || hasPoint && fracPart == "" {
+		return 0, ErrInvalidAmount
+	}
+	if !isDigits(intPart) || !isDigits(fracPart) {
+		return 0, ErrInvalidAmount
+	}
+
+	// Zeros after the last significant digit don't count: "12.300" is "12.30".
+	fracPart = strings.TrimRight(fracPart, "0")
+	if len(fracPart) > Scale {
+		return 0, ErrAmountTooPrecise
+	}
+
+	fracPart += strings.Repeat("0", Scale-len(fracPart))
+
+	major, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil {
+		return 0, ErrAmountOverflow
+	}
+	minor, err := strconv.ParseInt(fracPart, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidAmount
+	}
+
+	if major > (math.MaxInt64-minor)/minorUnitsInMajor {
+		return 0, ErrAmountOverflow
+	}
+
+	amount := Amount(major*minorUnitsInMajor + minor)
+	if negative {
+		amount = -amount
+	}
+
+	return amount, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Add returns a + b, or ErrAmountOverflow if the result does not fit into an Amount.
+func (a Amount) Add(b Amount) (Amount, error) {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) || sum == math.MinInt64 {
+		return 0, ErrAmountOverflow
+	}
+	return sum, nil
+}
+
+// Neg returns -a. The Neg of math.MinInt64, which is out of the range of an Amount, is itself.
+func (a Amount) Neg() Amount {
+	return -a
+}
+
+// String formats the amount as a decimal with exactly Scale fractional digits, e.g. "-12.30".
+func (a Amount) String() string {
+	sign := ""
+	abs := uint64(a)
+	if a < 0 {
+		sign = "-"
+		abs = uint64(-(a + 1)) + 1
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, abs/minorUnitsInMajor, Scale, abs%minorUnitsInMajor)
+}
+
+// MarshalJSON encodes the amount as a JSON string, so clients never see it as a float.
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(a.String())), nil
+}
+
+// UnmarshalJSON accepts both a JSON string ("12.34") and a bare JSON number (12.34).
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// Value implements driver.Valuer: amounts are stored as bigint minor units.
+func (a Amount) Value() (driver.Value, error) {
+	return int64(a), nil
+}
+
+// Scan implements sql.Scanner for bigint minor units.
+func (a *Amount) Scan(src any) error {
+	switch v := src.(type) {
+	case int64:
+		*a = Amount(v)
+	case []byte:
+		parsed, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return fmt.Errorf("scanning amount: %w", err)
+		}
+		*a = Amount(parsed)
+	case string:
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("scanning amount: %w", err)
+		}
+		*a = Amount(parsed)
+	default:
+		return fmt.Errorf("scanning amount: unsupported type %T", src)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+
+	for _, tc := range []struct {
+		s          string
+		wantAmount Amount
+		wantErr    error
+	}{
+		{s: "0", wantAmount: 0},
+		{s: "12", wantAmount: 1200},
+		{s: "12.3", wantAmount: 1230},
+		{s: "12.34", wantAmount: 1234},
+		{s: "0.01", wantAmount: 1},
+		{s: "007.50", wantAmount: 750},
+		{s: "12.300", wantAmount: 1230},
+		{s: "12.000", wantAmount: 1200},
+		{s: "+12.34", wantAmount: 1234},
+		{s: "-12.34", wantAmount: -1234},
+		{s: "-0", wantAmount: 0},
+		{s: "-0.00", wantAmount: 0},
+		{s: "92233720368547758.07", wantAmount: math.MaxInt64},
+		{s: "-92233720368547758.07", wantAmount: -math.MaxInt64},
+
+		{s: "92233720368547758.08", wantErr: ErrAmountOverflow},
+		{s: "-92233720368547758.08", wantErr: ErrAmountOverflow},
+		{s: "92233720368547759", wantErr: ErrAmountOverflow},
+		{s: "9223372036854775808", wantErr: ErrAmountOverflow},
+
+		{s: "", wantErr: ErrInvalidAmount},
+		{s: "-", wantErr: ErrInvalidAmount},
+		{s: "+-5", wantErr: ErrInvalidAmount},
+		{s: "--5", wantErr: ErrInvalidAmount},
+		{s: "12.345", wantErr: ErrAmountTooPrecise},
+		{s: "12.3450", wantErr: ErrAmountTooPrecise},
+		// A too precise amount is an invalid one too.
+		{s: "-0.001", wantErr: ErrInvalidAmount},
+		{s: "12.", wantErr: ErrInvalidAmount},
+		{s: ".5", wantErr: ErrInvalidAmount},
+		{s: "1,5", wantErr: ErrInvalidAmount},
+		{s: "1e3", wantErr: ErrInvalidAmount},
+		{s: "NaN", wantErr: ErrInvalidAmount},
+		{s: "Inf", wantErr: ErrInvalidAmount},
+		{s: " 5", wantErr: ErrInvalidAmount},
+		{s: "0x10", wantErr: ErrInvalidAmount},
+		{s: "1_000", wantErr: ErrInvalidAmount},
+	} {
+		amount, err := Parse(tc.s)
+		switch {
+		case tc.wantErr != nil && !errors.Is(err, tc.wantErr):
+			t.Errorf("%q: got %d, %v, want %v", tc.s, amount, err, tc.wantErr)
+		case tc.wantErr == nil && err != nil:
+			t.Errorf("%q: got error %v, want %d", tc.s, err, tc.wantAmount)
+		case tc.wantErr == nil && amount != tc.wantAmount:
+			t.Errorf("%q: got %d, want %d", tc.s, amount, tc.wantAmount)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+
+	for _, tc := range []struct {
+		amount Amount
+		want   string
+	}{
+		{amount: 0, want: "0.00"},
+		{amount: 1, want: "0.01"},
+		{amount: 10, want: "0.10"},
+		{amount: 1234, want: "12.34"},
+		{amount: -1, want: "-0.01"},
+		{amount: -1230, want: "-12.30"},
+		{amount: math.MaxInt64, want: "92233720368547758.07"},
+		{amount: -math.MaxInt64, want: "-92233720368547758.07"},
+		{amount: math.MinInt64, want: "-92233720368547758.08"},
+	} {
+		if got := tc.amount.String(); got != tc.want {
+			t.Errorf("%d: got %q, want %q", int64(tc.amount), got, tc.want)
+		}
+	}
+}
+
+func TestAddAndNeg(t *testing.T) {
+
+	for _, tc := range []struct {
+		a, b    Amount
+		want    Amount
+		wantErr error
+	}{
+		{a: 100, b: 50, want: 150},
+		{a: 100, b: -150, want: -50},
+		{a: math.MaxInt64, b: -math.MaxInt64, want: 0},
+		{a: math.MaxInt64 - 1, b: 1, want: math.MaxInt64},
+		{a: -math.MaxInt64 + 1, b: -1, want: -math.MaxInt64},
+
+		{a: math.MaxInt64, b: 1, wantErr: ErrAmountOverflow},
+		{a: 1, b: math.MaxInt64, wantErr: ErrAmountOverflow},
+		{a: -math.MaxInt64, b: -2, wantErr: ErrAmountOverflow},
+		// math.MinInt64 fits into an int64 but not into the symmetric range of an Amount.
+		{a: -math.MaxInt64, b: -1, wantErr: ErrAmountOverflow},
+	} {
+		sum, err := tc.a.Add(tc.b)
+		switch {
+		case tc.wantErr != nil && !errors.Is(err, tc.wantErr):
+			t.Errorf("%d + %d: got %d, %v, want %v", int64(tc.a), int64(tc.b), int64(sum), err, tc.wantErr)
+		case tc.wantErr == nil && (err != nil || sum != tc.want):
+			t.Errorf("%d + %d: got %d, %v, want %d", int64(tc.a), int64(tc.b), int64(sum), err, int64(tc.want))
+		}
+	}
+
+	for _, tc := range []struct {
+		amount Amount
+		want   Amount
+	}{
+		{amount: 0, want: 0},
+		{amount: 150, want: -150},
+		{amount: -150, want: 150},
+		{amount: math.MaxInt64, want: -math.MaxInt64},
+		{amount: -math.MaxInt64, want: math.MaxInt64},
+		{amount: math.MinInt64, want: math.MinInt64},
+	} {
+		if got := tc.amount.Neg(); got != tc.want {
+			t.Errorf("-(%d): got %d, want %d", int64(tc.amount), int64(got), int64(tc.want))
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+
+	for _, tc := range []struct {
+		amount Amount
+		want   string
+	}{
+		{amount: 1234, want: `"12.34"`},
+		{amount: -5, want: `"-0.05"`},
+		{amount: 0, want: `"0.00"`},
+	} {
+		got, err := json.Marshal(tc.amount)
+		if err != nil || string(got) != tc.want {
+			t.Errorf("marshalling %d: got %s, %v, want %s", int64(tc.amount), got, err, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		data    string
+		want    Amount
+		wantErr bool
+	}{
+		{data: `"12.34"`, want: 1234},
+		{data: `12.34`, want: 1234},
+		{data: `-7`, want: -700},
+		{data: `"-0.5"`, want: -50},
+
+		{data: `"12.345"`, wantErr: true},
+		{data: `1e3`, wantErr: true},
+		{data: `"abc"`, wantErr: true},
+		{data: `true`, wantErr: true},
+		{data: `"92233720368547758.08"`, wantErr: true},
+	} {
+		var amount Amount
+		err := json.Unmarshal([]byte(tc.data), &amount)
+		switch {
+		case tc.wantErr && err == nil:
+			t.Errorf("unmarshalling %s: got %d, want an error", tc.data, int64(amount))
+		case !tc.wantErr && (err != nil || amount != tc.want):
+			t.Errorf("unmarshalling %s: got %d, %v, want %d", tc.data, int64(amount), err, int64(tc.want))
+		}
+	}
+}
+
+func TestValueAndScan(t *testing.T) {
+
+	value, err := Amount(-1234).Value()
+	if err != nil || value != int64(-1234) {
+		t.Errorf("value: got %#v, %v, want int64(-1234)", value, err)
+	}
+
+	for _, tc := range []struct {
+		src     any
+		want    Amount
+		wantErr bool
+	}{
+		{src: int64(1234), want: 1234},
+		{src: int64(math.MinInt64), want: math.MinInt64},
+		{src: []byte("-1234"), want: -1234},
+		{src: "9223372036854775807", want: math.MaxInt64},
+
+		{src: []byte("12.34"), wantErr: true},
+		{src: "abc", wantErr: true},
+		{src: "9223372036854775808", wantErr: true},
+		{src: 12.34, wantErr: true},
+		{src: nil, wantErr: true},
+	} {
+		var amount Amount
+		err := amount.Scan(tc.src)
+		switch {
+		case tc.wantErr && err == nil:
+			t.Errorf("scanning %#v: got %d, want an error", tc.src, int64(amount))
+		case !tc.wantErr && (err != nil || amount != tc.want):
+			t.Errorf("scanning %#v: got %d, %v, want %d", tc.src, int64(amount), err, int64(tc.want))
+		}
+	}
+}
@@ -8,22 +8,27 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-const queryCreateTableBalance = `
-CREATE TABLE IF NOT EXISTS balance
-(
-	id             bigserial PRIMARY KEY,
-	user_id        bigint REFERENCES users(id) ON DELETE CASCADE,
-	sum            double precision NOT NULL CHECK (NOT(sum < 0))
-);
-`
-
 const queryCreateStartingBalance = `INSERT INTO balance (user_id, sum) VALUES ($1, 0)`
 
 const queryChangeBalance = `UPDATE balance SET sum = sum + $2 WHERE user_id=$1`
 
+const queryGetBalanceForUpdate = `SELECT sum FROM balance WHERE user_id=$1 FOR UPDATE`
+
+const queryGetBalance = `
+SELECT b.sum,
+	COALESCE(sum(q.sum) FILTER (WHERE q.sum > 0), 0)::bigint,
+	COALESCE(-sum(q.sum) FILTER (WHERE q.sum < 0), 0)::bigint
+FROM balance b
+LEFT JOIN tx_queues q ON q.user_id = b.user_id AND q.status = 'pending'
+WHERE b.user_id = $1
+GROUP BY b.sum
+`
+
 type balanceStmts struct {
 	stmtCreateStartingBalance *sql.Stmt
 	stmtChangeBalance         *sql.Stmt
+	stmtGetBalanceForUpdate   *sql.Stmt
+	stmtGetBalance            *sql.Stmt
 }
 
 func prepareBalanceStmts(ctx context.Context, p *Pg) (err error) {
@@ -46,6 +51,14 @@ func prepareBalanceStmts(ctx context.Context, p *Pg) (err error) {
 		return fmt.Errorf("preparing `change balance` stmt: %w", err)
 	}
 
+	if newBalanceStmts.stmtGetBalanceForUpdate, err = p.db.PrepareContext(ctx, queryGetBalanceForUpdate); err != nil {
+		return fmt.Errorf("preparing `get balance for update` stmt: %w", err)
+	}
+
+	if newBalanceStmts.stmtGetBalance, err = p.db.PrepareContext(ctx, queryGetBalance); err != nil {
+		return fmt.Errorf("preparing `get balance` stmt: %w", err)
+	}
+
 	p.balanceStmts = &newBalanceStmts
 
 	return nil
@@ -0,0 +1,58 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	queryAddDeadLetter  = `INSERT INTO tx_dead_letters (tx_id, user_id, sum, attempts, last_error) VALUES ($1, $2, $3, $4, $5)`
+	queryGetDeadLetters = `SELECT id, tx_id, user_id, sum, attempts, last_error, created_at, resolved_at, COALESCE(resolution, '')
+		FROM tx_dead_letters WHERE resolved_at IS NULL AND id > $1 ORDER BY id LIMIT $2`
+	queryGetDeadLetterForUpdate = `SELECT id, tx_id, user_id, sum, attempts, last_error, created_at, resolved_at, COALESCE(resolution, '')
+		FROM tx_dead_letters WHERE id = $1 FOR UPDATE`
+	queryResolveDeadLetter = `UPDATE tx_dead_letters SET resolved_at = now(), resolution = $2 WHERE id = $1 RETURNING resolved_at`
+)
+
+type deadLettersStmts struct {
+	stmtAddDeadLetter          *sql.Stmt
+	stmtGetDeadLetters         *sql.Stmt
+	stmtGetDeadLetterForUpdate *sql.Stmt
+	stmtResolveDeadLetter      *sql.Stmt
+}
+
+func prepareDeadLettersStmts(ctx context.Context, p *Pg) (err error) {
+	log.Debug().Msg("pg.prepareDeadLettersStmts START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("pg.prepareDeadLettersStmts END")
+		} else {
+			log.Debug().Msg("pg.prepareDeadLettersStmts END")
+		}
+	}()
+
+	newDeadLettersStmts := deadLettersStmts{}
+
+	if newDeadLettersStmts.stmtAddDeadLetter, err = p.db.PrepareContext(ctx, queryAddDeadLetter); err != nil {
+		return fmt.Errorf("preparing `add dead letter` stmt: %w", err)
+	}
+
+	if newDeadLettersStmts.stmtGetDeadLetters, err = p.db.PrepareContext(ctx, queryGetDeadLetters); err != nil {
+		return fmt.Errorf("preparing `get dead letters` stmt: %w", err)
+	}
+
+	if newDeadLettersStmts.stmtGetDeadLetterForUpdate, err = p.db.PrepareContext(ctx, queryGetDeadLetterForUpdate); err != nil {
+		return fmt.Errorf("preparing `get dead letter for update` stmt: %w", err)
+	}
+
+	if newDeadLettersStmts.stmtResolveDeadLetter, err = p.db.PrepareContext(ctx, queryResolveDeadLetter); err != nil {
+		return fmt.Errorf("preparing `resolve dead letter` stmt: %w", err)
+	}
+
+	p.deadLettersStmts = &newDeadLettersStmts
+
+	return nil
+}
@@ -1,7 +1,47 @@
 package pg
 
-import "errors"
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
 
 var (
-	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrInsufficientFunds    = errors.New("insufficient funds")
+	ErrLedgerMismatch       = errors.New("balance does not match the ledger")
+	ErrUserNotFound         = errors.New("user not found")
+	ErrTxNotFound           = errors.New("transaction not found")
+	ErrIdempotencyKeyReused = errors.New("idempotency key is already used for another request")
+	ErrTxQueueIsBackingOff  = errors.New("tx queue waits for the next attempt after a failure")
+	ErrDeadLetterNotFound   = errors.New("dead letter not found")
+	ErrDeadLetterIsResolved = errors.New("dead letter is already resolved")
 )
+
+// IsTransientError tells that err is a failure of the call, not of the data it works on: the call is canceled
+// or timed out, the connection to the db is lost, or the db is shutting down. The same call may succeed later.
+func IsTransientError(err error) bool {
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || pgconn.Timeout(err) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var pgError *pgconn.PgError
+	if errors.As(err, &pgError) {
+		return pgerrcode.IsConnectionException(pgError.Code) ||
+			pgError.Code == pgerrcode.AdminShutdown || pgError.Code == pgerrcode.CrashShutdown ||
+			pgError.Code == pgerrcode.CannotConnectNow
+	}
+
+	return false
+}
@@ -0,0 +1,51 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	queryAddIdempotencyKey = `INSERT INTO idempotency_keys (key, user_id, sum, tx_id, transfer_id) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (key) DO NOTHING`
+	queryGetIdempotencyKey                  = `SELECT user_id, sum, tx_id, transfer_id FROM idempotency_keys WHERE key = $1`
+	queryDeleteIdempotencyKeysCreatedBefore = `DELETE FROM idempotency_keys WHERE created_at < $1`
+)
+
+type idempotencyKeysStmts struct {
+	stmtAddIdempotencyKey                  *sql.Stmt
+	stmtGetIdempotencyKey                  *sql.Stmt
+	stmtDeleteIdempotencyKeysCreatedBefore *sql.Stmt
+}
+
+func prepareIdempotencyKeysStmts(ctx context.Context, p *Pg) (err error) {
+	log.Debug().Msg("pg.prepareIdempotencyKeysStmts START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("pg.prepareIdempotencyKeysStmts END")
+		} else {
+			log.Debug().Msg("pg.prepareIdempotencyKeysStmts END")
+		}
+	}()
+
+	newIdempotencyKeysStmts := idempotencyKeysStmts{}
+
+	if newIdempotencyKeysStmts.stmtAddIdempotencyKey, err = p.db.PrepareContext(ctx, queryAddIdempotencyKey); err != nil {
+		return fmt.Errorf("preparing `add idempotency key` stmt: %w", err)
+	}
+
+	if newIdempotencyKeysStmts.stmtGetIdempotencyKey, err = p.db.PrepareContext(ctx, queryGetIdempotencyKey); err != nil {
+		return fmt.Errorf("preparing `get idempotency key` stmt: %w", err)
+	}
+
+	if newIdempotencyKeysStmts.stmtDeleteIdempotencyKeysCreatedBefore, err = p.db.PrepareContext(ctx, queryDeleteIdempotencyKeysCreatedBefore); err != nil {
+		return fmt.Errorf("preparing `delete idempotency keys created before` stmt: %w", err)
+	}
+
+	p.idempotencyKeysStmts = &newIdempotencyKeysStmts
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+
+	"transactions/internal/money"
+)
+
+// The ledger tables are described in migrations/0003_ledger.up.sql, the running balances in migrations/0013_ledger_balances.up.sql.
+const (
+	queryPostJournalEntry = `
+WITH entry AS (
+	INSERT INTO journal_entries (tx_id, transfer_id, description) VALUES ($1, $2, $3) RETURNING id
+)
+INSERT INTO postings (entry_id, user_id, direction, amount)
+	SELECT entry.id, $4::bigint, 'debit', $6 FROM entry
+	UNION ALL
+	SELECT entry.id, $5::bigint, 'credit', $6 FROM entry
+`
+	queryCheckBalanceAgainstLedger = `
+SELECT b.sum = COALESCE(l.sum, 0)
+FROM balance b LEFT JOIN ledger_balances l ON l.user_id = b.user_id
+WHERE b.user_id = $1
+`
+	// queryAuditLedger selects the users whose balance or running ledger balance differs from the sum of their postings.
+	queryAuditLedger = `
+SELECT b.user_id
+FROM balance b
+LEFT JOIN (
+	SELECT user_id, sum(CASE direction WHEN 'credit' THEN amount ELSE -amount END) AS sum
+	FROM postings WHERE user_id IS NOT NULL GROUP BY user_id
+) p ON p.user_id = b.user_id
+LEFT JOIN ledger_balances l ON l.user_id = b.user_id
+WHERE b.sum <> COALESCE(p.sum, 0) OR COALESCE(l.sum, 0) <> COALESCE(p.sum, 0)
+ORDER BY b.user_id
+`
+)
+
+const (
+	entryDescriptionReceipt  = "receipt"
+	entryDescriptionWithdraw = "withdraw"
+	entryDescriptionTransfer = "transfer"
+)
+
+type ledgerStmts struct {
+	stmtPostJournalEntry          *sql.Stmt
+	stmtCheckBalanceAgainstLedger *sql.Stmt
+	stmtAuditLedger               *sql.Stmt
+}
+
+func prepareLedgerStmts(ctx context.Context, p *Pg) (err error) {
+	log.Debug().Msg("pg.prepareLedgerStmts START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("pg.prepareLedgerStmts END")
+		} else {
+			log.Debug().Msg("pg.prepareLedgerStmts END")
+		}
+	}()
+
+	newLedgerStmts := ledgerStmts{}
+
+	if newLedgerStmts.stmtPostJournalEntry, err = p.db.PrepareContext(ctx, queryPostJournalEntry); err != nil {
+		return fmt.Errorf("preparing `post journal entry` stmt: %w", err)
+	}
+
+	if newLedgerStmts.stmtCheckBalanceAgainstLedger, err = p.db.PrepareContext(ctx, queryCheckBalanceAgainstLedger); err != nil {
+		return fmt.Errorf("preparing `check balance against ledger` stmt: %w", err)
+	}
+
+	if newLedgerStmts.stmtAuditLedger, err = p.db.PrepareContext(ctx, queryAuditLedger); err != nil {
+		return fmt.Errorf("preparing `audit ledger` stmt: %w", err)
+	}
+
+	p.ledgerStmts = &newLedgerStmts
+
+	return nil
+}
+
+// postTx writes the journal entry of a queued transaction: a receipt moves money
+// from the external world to the user, a withdrawal moves it back.
+func (p *Pg) postTx(ctx context.Context, tx *sql.Tx, txID, userID int64, sum money.Amount) (err error) {
+
+	user := sql.NullInt64{Int64: userID, Valid: true}
+	world := sql.NullInt64{}
+
+	description, debit, credit, amount := entryDescriptionReceipt, world, user, sum
+	if sum < 0 {
+		description, debit, credit, amount = entryDescriptionWithdraw, user, world, sum.Neg()
+	}
+
+	_, err = tx.StmtContext(ctx, p.ledgerStmts.stmtPostJournalEntry).
+		ExecContext(ctx, txID, nil, description, debit, credit, amount)
+	if err != nil {
+		return fmt.Errorf("posting journal entry: txID: %d: %w", txID, err)
+	}
+
+	return nil
+}
+
+// postTransfer writes the journal entry of a transfer: money moves from one user straight to another.
+func (p *Pg) postTransfer(ctx context.Context, tx *sql.Tx, transferID, fromUserID, toUserID int64, amount money.Amount) (err error) {
+
+	from := sql.NullInt64{Int64: fromUserID, Valid: true}
+	to := sql.NullInt64{Int64: toUserID, Valid: true}
+
+	_, err = tx.StmtContext(ctx, p.ledgerStmts.stmtPostJournalEntry).
+		ExecContext(ctx, nil, transferID, entryDescriptionTransfer, from, to, amount)
+	if err != nil {
+		return fmt.Errorf("posting journal entry: transferID: %d: %w", transferID, err)
+	}
+
+	return nil
+}
+
+// checkBalanceAgainstLedger makes sure the stored balance of the user equals the running balance of the user's postings.
+// It doesn't read the postings themselves, so it costs the same whatever the history of the user, see AuditLedger.
+func (p *Pg) checkBalanceAgainstLedger(ctx context.Context, tx *sql.Tx, userID int64) (err error) {
+
+	var isConsistent bool
+	err = tx.StmtContext(ctx, p.ledgerStmts.stmtCheckBalanceAgainstLedger).QueryRowContext(ctx, userID).Scan(&isConsistent)
+	if err != nil {
+		return fmt.Errorf("checking balance against ledger: userID: %d: %w", userID, err)
+	}
+
+	if !isConsistent {
+		return fmt.Errorf("userID: %d: %w", userID, ErrLedgerMismatch)
+	}
+
+	return nil
+}
+
+// AuditLedger reconciles every balance with the full history of the postings of the user and returns the users
+// whose balance or running ledger balance differs from it. It reads all the postings, so it is meant for a periodic job.
+func (p *Pg) AuditLedger(ctx context.Context) (mismatchedUsers []int64, err error) {
+	log.Debug().Msg("Pg.AuditLedger START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("Pg.AuditLedger END")
+		} else {
+			log.Debug().Msg("Pg.AuditLedger END")
+		}
+	}()
+
+	rows, err := p.ledgerStmts.stmtAuditLedger.QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("auditing ledger: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int64
+		if err = rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("reading ledger audit: %w", err)
+		}
+		mismatchedUsers = append(mismatchedUsers, userID)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading ledger audit: %w", err)
+	}
+
+	return mismatchedUsers, nil
+}
@@ -0,0 +1,414 @@
+package pg
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// migrationsLockID is the key of the advisory lock that keeps several instances from migrating at once.
+const migrationsLockID = 5_315_402_271
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+var (
+	ErrUnknownSchemaVersion      = errors.New("database has migrations this build doesn't know, it is newer")
+	ErrMigrationChecksumMismatch = errors.New("applied migration differs from its file")
+	ErrInvalidMigrations         = errors.New("invalid migration files")
+)
+
+const queryCreateTableSchemaMigrations = `
+CREATE TABLE IF NOT EXISTS schema_migrations
+(
+	version        integer PRIMARY KEY,
+	name           text NOT NULL,
+	checksum       text NOT NULL,
+	applied_at     timestamptz NOT NULL DEFAULT now()
+);
+`
+
+const (
+	queryLockMigrations         = `SELECT pg_advisory_lock($1)`
+	queryUnlockMigrations       = `SELECT pg_advisory_unlock($1)`
+	queryGetAppliedMigrations   = `SELECT version, name, checksum, applied_at FROM schema_migrations ORDER BY version`
+	queryAddAppliedMigration    = `INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`
+	queryDeleteAppliedMigration = `DELETE FROM schema_migrations WHERE version = $1`
+)
+
+// migrationPreconditions are checked before the pending migration of the version, in its transaction,
+// and fail it instead of letting it lose data. They are not part of the migration files, so adding one
+// doesn't change the checksum of a migration applied elsewhere already.
+var migrationPreconditions = map[int]string{
+	// 0002 rounds the double precision sums to minor units. A sum with a fraction of a minor unit, e.g. 0.001,
+	// can't be converted without loss: the migration fails with the ids of such rows (the first 100 of them),
+	// and they must be fixed by hand before it is run again.
+	2: `
+DO $$
+DECLARE
+	lossy_ids text;
+BEGIN
+	IF EXISTS (SELECT 1 FROM information_schema.columns
+		WHERE table_name = 'balance' AND column_name = 'sum' AND data_type = 'double precision') THEN
+		SELECT string_agg(id::text, ', ' ORDER BY id) INTO lossy_ids FROM (
+			SELECT id FROM balance WHERE sum::numeric * 100 <> trunc(sum::numeric * 100) ORDER BY id LIMIT 100
+		) lossy;
+		IF lossy_ids IS NOT NULL THEN
+			RAISE EXCEPTION 'balance sums with fractions of a minor unit, fix them first: ids: %', lossy_ids;
+		END IF;
+	END IF;
+	IF EXISTS (SELECT 1 FROM information_schema.columns
+		WHERE table_name = 'tx_queues' AND column_name = 'sum' AND data_type = 'double precision') THEN
+		SELECT string_agg(id::text, ', ' ORDER BY id) INTO lossy_ids FROM (
+			SELECT id FROM tx_queues WHERE sum::numeric * 100 <> trunc(sum::numeric * 100) ORDER BY id LIMIT 100
+		) lossy;
+		IF lossy_ids IS NOT NULL THEN
+			RAISE EXCEPTION 'tx_queues sums with fractions of a minor unit, fix them first: ids: %', lossy_ids;
+		END IF;
+	END IF;
+END
+$$;
+`,
+}
+
+type migration struct {
+	version  int
+	name     string
+	up       string
+	down     string
+	checksum string
+}
+
+// MigrationStatus is a migration and when it was applied, AppliedAt is nil if it is not applied yet.
+// IsUnknown is true for a migration applied by a newer build: there is no file for it.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+	IsUnknown bool
+}
+
+type appliedMigration struct {
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// Migrator applies and reverts the versioned migrations from the migrations directory.
+// Every migration runs in its own transaction together with its record in schema_migrations.
+type Migrator struct {
+	db         *sql.DB
+	migrations []migration
+}
+
+func NewMigrator(pgConn string) (newMigrator *Migrator, err error) {
+	log.Debug().Msg("pg.NewMigrator START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("pg.NewMigrator END")
+		} else {
+			log.Debug().Msg("pg.NewMigrator END")
+		}
+	}()
+
+	db, err := sql.Open("pgx", pgConn)
+	if err != nil {
+		return nil, fmt.Errorf("opening connection with postgres db: %w", err)
+	}
+
+	return newMigratorWithDB(db)
+}
+
+func newMigratorWithDB(db *sql.DB) (*Migrator, error) {
+
+	migrations, err := readMigrations(migrationsFS)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+func readMigrations(fsys fs.FS) (migrations []migration, err error) {
+
+	files, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("listing migration files: %w", err)
+	}
+
+	byVersion := map[int]*migration{}
+	for _, file := range files {
+
+		match := migrationFileName.FindStringSubmatch(file[len("migrations/"):])
+		if match == nil {
+			return nil, fmt.Errorf("%w: unexpected file name: %s", ErrInvalidMigrations, file)
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		name, direction := match[2], match[3]
+
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("reading migration file %s: %w", file, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if m.name != name {
+			return nil, fmt.Errorf("%w: version %d has two names: %s, %s", ErrInvalidMigrations, version, m.name, name)
+		}
+
+		if direction == "up" {
+			m.up = string(content)
+			checksum := sha256.Sum256(content)
+			m.checksum = hex.EncodeToString(checksum[:])
+		} else {
+			m.down = string(content)
+		}
+	}
+
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("%w: version %d must have both up and down files", ErrInvalidMigrations, m.version)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("%w: versions must go one by one from 1, missing %d", ErrInvalidMigrations, i+1)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Up applies all the migrations that are not applied yet, each one after its precondition if it has one.
+// It fails with ErrUnknownSchemaVersion if the database was migrated by a newer build
+// and with ErrMigrationChecksumMismatch if an applied migration file was changed.
+func (m *Migrator) Up(ctx context.Context) (applied int, err error) {
+	log.Debug().Msg("Migrator.Up START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("Migrator.Up END")
+		} else {
+			log.Debug().Int("applied", applied).Msg("Migrator.Up END")
+		}
+	}()
+
+	err = m.withLock(ctx, func(conn *sql.Conn, alreadyApplied map[int]appliedMigration) error {
+
+		if err := m.checkApplied(alreadyApplied); err != nil {
+			return err
+		}
+
+		for _, migr := range m.migrations {
+			if _, ok := alreadyApplied[migr.version]; ok {
+				continue
+			}
+			script := migr.up
+			if precondition, ok := migrationPreconditions[migr.version]; ok {
+				script = precondition + script
+			}
+			if err := m.run(ctx, conn, migr, script, queryAddAppliedMigration, migr.version, migr.name, migr.checksum); err != nil {
+				return err
+			}
+			log.Info().Int("version", migr.version).Str("name", migr.name).Msg("migration applied")
+			applied++
+		}
+
+		return nil
+	})
+
+	return applied, err
+}
+
+// Down reverts the last steps applied migrations.
+func (m *Migrator) Down(ctx context.Context, steps int) (reverted int, err error) {
+	log.Debug().Msg("Migrator.Down START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("Migrator.Down END")
+		} else {
+			log.Debug().Int("reverted", reverted).Msg("Migrator.Down END")
+		}
+	}()
+
+	err = m.withLock(ctx, func(conn *sql.Conn, alreadyApplied map[int]appliedMigration) error {
+
+		if err := m.checkApplied(alreadyApplied); err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && reverted < steps; i-- {
+			migr := m.migrations[i]
+			if _, ok := alreadyApplied[migr.version]; !ok {
+				continue
+			}
+			if err := m.run(ctx, conn, migr, migr.down, queryDeleteAppliedMigration, migr.version); err != nil {
+				return err
+			}
+			log.Info().Int("version", migr.version).Str("name", migr.name).Msg("migration reverted")
+			reverted++
+		}
+
+		return nil
+	})
+
+	return reverted, err
+}
+
+// Status lists the known migrations and the unknown applied ones, ordered by version.
+func (m *Migrator) Status(ctx context.Context) (statuses []MigrationStatus, err error) {
+	log.Debug().Msg("Migrator.Status START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("Migrator.Status END")
+		} else {
+			log.Debug().Msg("Migrator.Status END")
+		}
+	}()
+
+	err = m.withLock(ctx, func(conn *sql.Conn, alreadyApplied map[int]appliedMigration) error {
+
+		for _, migr := range m.migrations {
+			status := MigrationStatus{Version: migr.version, Name: migr.name}
+			if applied, ok := alreadyApplied[migr.version]; ok {
+				status.AppliedAt = &applied.appliedAt
+				delete(alreadyApplied, migr.version)
+			}
+			statuses = append(statuses, status)
+		}
+
+		for version, applied := range alreadyApplied {
+			appliedAt := applied.appliedAt
+			statuses = append(statuses, MigrationStatus{Version: version, Name: applied.name, AppliedAt: &appliedAt, IsUnknown: true})
+		}
+
+		return nil
+	})
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	return statuses, err
+}
+
+func (m *Migrator) Close() (err error) {
+	if err = m.db.Close(); err != nil {
+		return fmt.Errorf("close connection with db: %w", err)
+	}
+	return nil
+}
+
+// withLock runs f holding the migrations advisory lock on a dedicated connection.
+func (m *Migrator) withLock(ctx context.Context, f func(conn *sql.Conn, applied map[int]appliedMigration) error) (err error) {
+
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("getting connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, queryLockMigrations, migrationsLockID); err != nil {
+		return fmt.Errorf("locking migrations: %w", err)
+	}
+	defer func() {
+		if _, errUnlock := conn.ExecContext(context.Background(), queryUnlockMigrations, migrationsLockID); errUnlock != nil {
+			log.Warn().Err(errUnlock).Msg("unlocking migrations")
+		}
+	}()
+
+	if _, err = conn.ExecContext(ctx, queryCreateTableSchemaMigrations); err != nil {
+		return fmt.Errorf("creating table `schema_migrations`: %w", err)
+	}
+
+	applied, err := getAppliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	return f(conn, applied)
+}
+
+func getAppliedMigrations(ctx context.Context, conn *sql.Conn) (applied map[int]appliedMigration, err error) {
+
+	rows, err := conn.QueryContext(ctx, queryGetAppliedMigrations)
+	if err != nil {
+		return nil, fmt.Errorf("getting applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied = map[int]appliedMigration{}
+	for rows.Next() {
+		var version int
+		var currApplied appliedMigration
+		if err = rows.Scan(&version, &currApplied.name, &currApplied.checksum, &currApplied.appliedAt); err != nil {
+			return nil, fmt.Errorf("reading applied migrations: %w", err)
+		}
+		applied[version] = currApplied
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading applied migrations: %w", err)
+	}
+
+	return applied, nil
+}
+
+func (m *Migrator) checkApplied(applied map[int]appliedMigration) error {
+
+	known := map[int]migration{}
+	for _, migr := range m.migrations {
+		known[migr.version] = migr
+	}
+
+	for version, currApplied := range applied {
+		migr, ok := known[version]
+		if !ok {
+			return fmt.Errorf("version %d (%s): %w", version, currApplied.name, ErrUnknownSchemaVersion)
+		}
+		if migr.checksum != currApplied.checksum {
+			return fmt.Errorf("version %d (%s): %w", version, migr.name, ErrMigrationChecksumMismatch)
+		}
+	}
+
+	return nil
+}
+
+// run executes the migration script and updates schema_migrations in one transaction.
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, migr migration, script, recordQuery string, recordArgs ...any) (err error) {
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("running migration %d (%s): %w", migr.version, migr.name, err)
+	}
+
+	if _, err = tx.ExecContext(ctx, recordQuery, recordArgs...); err != nil {
+		return fmt.Errorf("recording migration %d (%s): %w", migr.version, migr.name, err)
+	}
+
+	return tx.Commit()
+}
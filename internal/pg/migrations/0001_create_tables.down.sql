@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS tx_queues;
+DROP TABLE IF EXISTS balance;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS users
+(
+	id bigserial PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS balance
+(
+	id             bigserial PRIMARY KEY,
+	user_id        bigint REFERENCES users(id) ON DELETE CASCADE,
+	sum            double precision NOT NULL CHECK (NOT(sum < 0))
+);
+
+CREATE TABLE IF NOT EXISTS tx_queues
+(
+	id             bigserial PRIMARY KEY,
+	user_id        bigint REFERENCES users(id) ON DELETE CASCADE,
+	sum            double precision NOT NULL
+);
@@ -0,0 +1,2 @@
+ALTER TABLE tx_queues ALTER COLUMN sum TYPE double precision USING sum / 100.0;
+ALTER TABLE balance ALTER COLUMN sum TYPE double precision USING sum / 100.0;
@@ -0,0 +1,14 @@
+-- Sums are stored as bigint minor units (2 digits after the point) instead of double precision.
+-- The float is cast through numeric first, so values like 0.30000000000000004 round to 30.
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM information_schema.columns
+		WHERE table_name = 'balance' AND column_name = 'sum' AND data_type = 'double precision') THEN
+		ALTER TABLE balance ALTER COLUMN sum TYPE bigint USING round(sum::numeric * 100)::bigint;
+	END IF;
+	IF EXISTS (SELECT 1 FROM information_schema.columns
+		WHERE table_name = 'tx_queues' AND column_name = 'sum' AND data_type = 'double precision') THEN
+		ALTER TABLE tx_queues ALTER COLUMN sum TYPE bigint USING round(sum::numeric * 100)::bigint;
+	END IF;
+END
+$$;
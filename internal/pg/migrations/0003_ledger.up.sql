@@ -0,0 +1,52 @@
+-- The ledger is append-only double-entry bookkeeping: every movement of money is a journal entry
+-- with a debit and a credit posting of the same amount. A posting with NULL user_id belongs to the
+-- external world account. The balance of a user is sum of credits minus sum of debits of the user's postings.
+CREATE TABLE IF NOT EXISTS journal_entries
+(
+	id             bigserial PRIMARY KEY,
+	tx_id          bigint UNIQUE REFERENCES tx_queues(id),
+	description    text NOT NULL,
+	created_at     timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS postings
+(
+	id             bigserial PRIMARY KEY,
+	entry_id       bigint NOT NULL REFERENCES journal_entries(id),
+	user_id        bigint REFERENCES users(id),
+	direction      text NOT NULL CHECK (direction IN ('debit', 'credit')),
+	amount         bigint NOT NULL CHECK (NOT(amount < 0))
+);
+
+CREATE INDEX IF NOT EXISTS postings_user_id_idx ON postings (user_id);
+
+CREATE OR REPLACE FUNCTION forbid_ledger_change() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'table % is append-only', TG_TABLE_NAME;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS journal_entries_append_only ON journal_entries;
+CREATE TRIGGER journal_entries_append_only BEFORE UPDATE OR DELETE ON journal_entries
+	FOR EACH ROW EXECUTE FUNCTION forbid_ledger_change();
+
+DROP TRIGGER IF EXISTS postings_append_only ON postings;
+CREATE TRIGGER postings_append_only BEFORE UPDATE OR DELETE ON postings
+	FOR EACH ROW EXECUTE FUNCTION forbid_ledger_change();
+
+-- Balances that existed before the ledger are moved into it as opening entries,
+-- so that every balance can be checked against the postings.
+DO $$
+DECLARE
+	b         record;
+	new_entry bigint;
+BEGIN
+	FOR b IN SELECT user_id, sum FROM balance
+		WHERE sum <> 0 AND NOT EXISTS (SELECT 1 FROM postings WHERE postings.user_id = balance.user_id)
+	LOOP
+		INSERT INTO journal_entries (description) VALUES ('opening balance') RETURNING id INTO new_entry;
+		INSERT INTO postings (entry_id, user_id, direction, amount)
+			VALUES (new_entry, NULL, 'debit', b.sum), (new_entry, b.user_id, 'credit', b.sum);
+	END LOOP;
+END
+$$;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS tx_queues_pending_idx;
+ALTER TABLE tx_queues DROP COLUMN IF EXISTS reject_reason;
+ALTER TABLE tx_queues DROP COLUMN IF EXISTS status;
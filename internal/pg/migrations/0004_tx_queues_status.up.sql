@@ -0,0 +1,11 @@
+-- A queued transaction stays in tx_queues forever. It is pending until it is processed,
+-- then it is either applied (and has a journal entry in the ledger) or rejected with a reason.
+-- Transactions queued before statuses existed are marked applied if the ledger has them.
+ALTER TABLE tx_queues ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'pending'
+	CHECK (status IN ('pending', 'applied', 'rejected'));
+ALTER TABLE tx_queues ADD COLUMN IF NOT EXISTS reject_reason text;
+
+UPDATE tx_queues SET status = 'applied'
+	WHERE status = 'pending' AND EXISTS (SELECT 1 FROM journal_entries e WHERE e.tx_id = tx_queues.id);
+
+CREATE INDEX IF NOT EXISTS tx_queues_pending_idx ON tx_queues (user_id, id) WHERE status = 'pending';
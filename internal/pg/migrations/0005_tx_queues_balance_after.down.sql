@@ -0,0 +1 @@
+ALTER TABLE tx_queues DROP COLUMN IF EXISTS balance_after;
@@ -0,0 +1,2 @@
+-- balance_after is the user balance right after the transaction was processed.
+ALTER TABLE tx_queues ADD COLUMN IF NOT EXISTS balance_after bigint;
@@ -0,0 +1,2 @@
+ALTER TABLE tx_queues DROP COLUMN IF EXISTS processed_at;
+ALTER TABLE tx_queues DROP COLUMN IF EXISTS created_at;
@@ -0,0 +1,2 @@
+ALTER TABLE tx_queues ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now();
+ALTER TABLE tx_queues ADD COLUMN IF NOT EXISTS processed_at timestamptz;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS tx_queues_user_id_idx;
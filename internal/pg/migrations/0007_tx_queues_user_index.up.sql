@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS tx_queues_user_id_idx ON tx_queues (user_id, id);
@@ -0,0 +1,12 @@
+-- An idempotency key remembers the transaction queued by the first request with the key
+-- and the request itself (user and sum), so that a retry gets the same transaction.
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+	key            text PRIMARY KEY,
+	user_id        bigint NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	sum            bigint NOT NULL,
+	tx_id          bigint NOT NULL REFERENCES tx_queues(id) ON DELETE CASCADE,
+	created_at     timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at);
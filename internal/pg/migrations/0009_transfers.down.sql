@@ -0,0 +1,4 @@
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS transfer_id;
+ALTER TABLE journal_entries DROP COLUMN IF EXISTS transfer_id;
+ALTER TABLE tx_queues DROP COLUMN IF EXISTS transfer_id;
+DROP TABLE IF EXISTS transfers;
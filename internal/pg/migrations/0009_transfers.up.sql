@@ -0,0 +1,16 @@
+-- A transfer moves money between two users at once. Each side of it is also recorded in tx_queues
+-- as an already applied transaction (with transfer_id set), so transfers show up in the users' histories.
+-- A key of a transfer also has transfer_id; its user, sum and transaction are the sender's side.
+CREATE TABLE IF NOT EXISTS transfers
+(
+	id             bigserial PRIMARY KEY,
+	from_user_id   bigint NOT NULL REFERENCES users(id),
+	to_user_id     bigint NOT NULL REFERENCES users(id),
+	sum            bigint NOT NULL CHECK (sum > 0),
+	created_at     timestamptz NOT NULL DEFAULT now(),
+	CHECK (from_user_id <> to_user_id)
+);
+
+ALTER TABLE tx_queues ADD COLUMN IF NOT EXISTS transfer_id bigint REFERENCES transfers(id);
+ALTER TABLE journal_entries ADD COLUMN IF NOT EXISTS transfer_id bigint UNIQUE REFERENCES transfers(id);
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS transfer_id bigint REFERENCES transfers(id) ON DELETE CASCADE;
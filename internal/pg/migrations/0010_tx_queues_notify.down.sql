@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS tx_queues_notify ON tx_queues;
+DROP FUNCTION IF EXISTS notify_tx_queued();
@@ -0,0 +1,14 @@
+-- Every queued pending transaction notifies the tx_queues channel with its user id as the payload,
+-- so the app instances can process the queue right away instead of waiting for the next sweep.
+-- Being a trigger, it also covers rows inserted directly into tx_queues, e.g. by batch jobs.
+-- Notifications are delivered on commit, and the same user queued several times in one db transaction notifies once.
+CREATE OR REPLACE FUNCTION notify_tx_queued() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('tx_queues', NEW.user_id::text);
+	RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS tx_queues_notify ON tx_queues;
+CREATE TRIGGER tx_queues_notify AFTER INSERT ON tx_queues
+	FOR EACH ROW WHEN (NEW.status = 'pending') EXECUTE FUNCTION notify_tx_queued();
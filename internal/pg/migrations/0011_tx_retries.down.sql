@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS tx_dead_letters;
+
+UPDATE tx_queues SET status = 'pending', processed_at = NULL WHERE status = 'dead_lettered';
+ALTER TABLE tx_queues DROP CONSTRAINT IF EXISTS tx_queues_status_check;
+ALTER TABLE tx_queues ADD CONSTRAINT tx_queues_status_check CHECK (status IN ('pending', 'applied', 'rejected'));
+
+ALTER TABLE tx_queues DROP COLUMN IF EXISTS last_error;
+ALTER TABLE tx_queues DROP COLUMN IF EXISTS next_attempt_at;
+ALTER TABLE tx_queues DROP COLUMN IF EXISTS attempts;
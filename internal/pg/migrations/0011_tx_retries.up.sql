@@ -0,0 +1,27 @@
+-- Processing failures (other than the rejections) are tracked per transaction: the failure of a queue run
+-- is counted against the oldest pending transaction of the queue, which is not retried before next_attempt_at.
+-- After too many attempts the transaction is dead-lettered: it gets a row in tx_dead_letters and leaves the queue
+-- until an admin requeues or discards it. Dead letters are resolved rather than deleted.
+ALTER TABLE tx_queues ADD COLUMN IF NOT EXISTS attempts int NOT NULL DEFAULT 0;
+ALTER TABLE tx_queues ADD COLUMN IF NOT EXISTS next_attempt_at timestamptz;
+ALTER TABLE tx_queues ADD COLUMN IF NOT EXISTS last_error text;
+
+ALTER TABLE tx_queues DROP CONSTRAINT IF EXISTS tx_queues_status_check;
+ALTER TABLE tx_queues ADD CONSTRAINT tx_queues_status_check
+	CHECK (status IN ('pending', 'applied', 'rejected', 'dead_lettered'));
+
+CREATE TABLE IF NOT EXISTS tx_dead_letters
+(
+	id           bigserial PRIMARY KEY,
+	tx_id        bigint NOT NULL REFERENCES tx_queues(id),
+	user_id      bigint NOT NULL REFERENCES users(id),
+	sum          bigint NOT NULL,
+	attempts     int NOT NULL,
+	last_error   text NOT NULL,
+	created_at   timestamptz NOT NULL DEFAULT now(),
+	resolved_at  timestamptz,
+	resolution   text CHECK (resolution IN ('requeued', 'discarded')),
+	CHECK ((resolved_at IS NULL) = (resolution IS NULL))
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS tx_dead_letters_unresolved_idx ON tx_dead_letters (tx_id) WHERE resolved_at IS NULL;
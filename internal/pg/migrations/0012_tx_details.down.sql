@@ -0,0 +1,3 @@
+ALTER TABLE tx_queues DROP COLUMN IF EXISTS external_reference;
+ALTER TABLE tx_queues DROP COLUMN IF EXISTS description;
+ALTER TABLE tx_queues DROP COLUMN IF EXISTS currency;
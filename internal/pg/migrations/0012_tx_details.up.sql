@@ -0,0 +1,5 @@
+-- The details sent by the client with a transaction. They are stored as they are and don't affect processing,
+-- the transactions queued before have none.
+ALTER TABLE tx_queues ADD COLUMN IF NOT EXISTS currency text;
+ALTER TABLE tx_queues ADD COLUMN IF NOT EXISTS description text;
+ALTER TABLE tx_queues ADD COLUMN IF NOT EXISTS external_reference text;
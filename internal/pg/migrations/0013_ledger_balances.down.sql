@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS postings_ledger_balance ON postings;
+DROP FUNCTION IF EXISTS add_posting_to_ledger_balance();
+DROP TABLE IF EXISTS ledger_balances;
@@ -0,0 +1,30 @@
+-- The running balance of the postings of every user, kept by a trigger on postings. Checking a balance against it
+-- costs the same whatever the history of the user; the full reconciliation with the postings is the ledger audit.
+-- postings is locked for the migration, so no posting is missed between the trigger and the backfill.
+LOCK TABLE postings IN SHARE MODE;
+
+CREATE TABLE IF NOT EXISTS ledger_balances
+(
+	user_id        bigint PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+	sum            bigint NOT NULL
+);
+
+CREATE OR REPLACE FUNCTION add_posting_to_ledger_balance() RETURNS trigger AS $$
+BEGIN
+	IF NEW.user_id IS NOT NULL THEN
+		INSERT INTO ledger_balances (user_id, sum)
+			VALUES (NEW.user_id, CASE NEW.direction WHEN 'credit' THEN NEW.amount ELSE -NEW.amount END)
+			ON CONFLICT (user_id) DO UPDATE SET sum = ledger_balances.sum + EXCLUDED.sum;
+	END IF;
+	RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS postings_ledger_balance ON postings;
+CREATE TRIGGER postings_ledger_balance AFTER INSERT ON postings
+	FOR EACH ROW EXECUTE FUNCTION add_posting_to_ledger_balance();
+
+INSERT INTO ledger_balances (user_id, sum)
+	SELECT user_id, sum(CASE direction WHEN 'credit' THEN amount ELSE -amount END) FROM postings
+	WHERE user_id IS NOT NULL GROUP BY user_id
+	ON CONFLICT (user_id) DO UPDATE SET sum = EXCLUDED.sum;
@@ -0,0 +1 @@
+ALTER TABLE tx_queues DROP COLUMN IF EXISTS reject_code;
@@ -0,0 +1,10 @@
+-- The machine-readable reason of a rejected transaction. reject_reason is the text of it, for display only.
+-- The transactions rejected before get the code of their reason, unknown reasons stay NULL.
+ALTER TABLE tx_queues ADD COLUMN IF NOT EXISTS reject_code text;
+
+UPDATE tx_queues SET reject_code = CASE reject_reason
+	WHEN 'insufficient funds' THEN 'insufficient_funds'
+	WHEN 'amount overflow' THEN 'balance_overflow'
+	WHEN 'discarded' THEN 'discarded'
+	END
+WHERE status = 'rejected' AND reject_code IS NULL;
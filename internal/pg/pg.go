@@ -10,17 +10,24 @@ import (
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
 	_ "github.com/jackc/pgx/v4/stdlib"
-	"github.com/lib/pq"
 	"github.com/rs/zerolog/log"
+
+	"transactions/internal/model"
+	"transactions/internal/money"
 )
 
 var ErrDBIsNilPointer = errors.New("database is nil pointer")
 
 type Pg struct {
-	db            *sql.DB
-	usersStmts    *usersStmts
-	balanceStmts  *balanceStmts
-	txQueuesStmts *txQueuesStmts
+	connString           string
+	db                   *sql.DB
+	usersStmts           *usersStmts
+	balanceStmts         *balanceStmts
+	txQueuesStmts        *txQueuesStmts
+	ledgerStmts          *ledgerStmts
+	idempotencyKeysStmts *idempotencyKeysStmts
+	transfersStmts       *transfersStmts
+	deadLettersStmts     *deadLettersStmts
 }
 
 func New(pgConn string) (newPg *Pg, err error) {
@@ -35,6 +42,8 @@ func New(pgConn string) (newPg *Pg, err error) {
 
 	newPg = &Pg{}
 
+	newPg.connString = pgConn
+
 	db, err := sql.Open("pgx", pgConn)
 	if err != nil {
 		return nil, fmt.Errorf("opening connection with postgres db: %w", err)
@@ -48,8 +57,13 @@ func New(pgConn string) (newPg *Pg, err error) {
 
 	ctx := context.Background()
 
-	if err = initTables(ctx, newPg); err != nil {
-		return nil, fmt.Errorf("initializing tables: %w", err)
+	migrator, err := newMigratorWithDB(newPg.db)
+	if err != nil {
+		return nil, fmt.Errorf("reading migrations: %w", err)
+	}
+
+	if _, err = migrator.Up(ctx); err != nil {
+		return nil, fmt.Errorf("migrating db: %w", err)
 	}
 
 	if err = prepareUserStmts(ctx, newPg); err != nil {
@@ -64,21 +78,42 @@ func New(pgConn string) (newPg *Pg, err error) {
 		return nil, fmt.Errorf("preparing tx queues stmts: %w", err)
 	}
 
+	if err = prepareLedgerStmts(ctx, newPg); err != nil {
+		return nil, fmt.Errorf("preparing ledger stmts: %w", err)
+	}
+
+	if err = prepareIdempotencyKeysStmts(ctx, newPg); err != nil {
+		return nil, fmt.Errorf("preparing idempotency keys stmts: %w", err)
+	}
+
+	if err = prepareTransfersStmts(ctx, newPg); err != nil {
+		return nil, fmt.Errorf("preparing transfers stmts: %w", err)
+	}
+
+	if err = prepareDeadLettersStmts(ctx, newPg); err != nil {
+		return nil, fmt.Errorf("preparing dead letters stmts: %w", err)
+	}
+
 	return newPg, nil
 }
 
-func initTables(ctx context.Context, p *Pg) (err error) {
-	log.Debug().Msg("pg.initTables START")
+func (p *Pg) InitFirstFiveUsersIfNotExistsForTestingApp() (err error) {
+	log.Debug().Msg("Pg.InitFirstFiveUsersIfNotExistsForTestingApp START")
 	defer func() {
 		if err != nil {
-			log.Error().Err(err).Msg("pg.initTables END")
+			log.Error().Err(err).Msg("Pg.InitFirstFiveUsersIfNotExistsForTestingApp END")
 		} else {
-			log.Debug().Msg("pg.initTables END")
+			log.Debug().Msg("Pg.InitFirstFiveUsersIfNotExistsForTestingApp END")
 		}
 	}()
 
-	if p.db == nil {
-		return ErrDBIsNilPointer
+	usersExist, err := p.userIsExist(1)
+	if err != nil {
+		return fmt.Errorf("users existence check: %w", err)
+	}
+
+	if usersExist {
+		return nil
 	}
 
 	tx, err := p.db.Begin()
@@ -87,109 +122,384 @@ func initTables(ctx context.Context, p *Pg) (err error) {
 	}
 	defer tx.Rollback()
 
-	_, err = tx.ExecContext(ctx, queryCreateTableUsers)
-	if err != nil {
-		return fmt.Errorf("creating table `users`: %w", err)
+	for id := 1; id <= 5; id++ {
+
+		_, err = tx.Stmt(p.usersStmts.stmtAddUser).Exec()
+		if err != nil {
+			return fmt.Errorf("creating user: %w", err)
+		}
+
+		_, err = tx.Stmt(p.balanceStmts.stmtCreateStartingBalance).Exec(id)
+		if err != nil {
+			return fmt.Errorf("creating user start balance: %w", err)
+		}
+
 	}
 
-	_, err = tx.ExecContext(ctx, queryCreateTableBalance)
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddTx queues a transaction for the user with its details. If a transaction was already queued with the same non-empty
+// idempotency key, AddTx doesn't queue a new one but returns the ID of that one with isReplay = true,
+// or ErrIdempotencyKeyReused if the key was used for another user or sum. The details of a replay are not compared.
+func (p *Pg) AddTx(ctx context.Context, userID int64, sum money.Amount, details model.TxDetails, idempotencyKey string) (txID int64, isReplay bool, err error) {
+	log.Debug().Msg("Pg.AddTx START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("Pg.AddTx END")
+		} else {
+			log.Debug().Msg("Pg.AddTx END")
+		}
+	}()
+
+	if idempotencyKey != "" {
+		if txID, isReplay, err = p.getTxByIdempotencyKey(ctx, idempotencyKey, userID, sum); err != nil || isReplay {
+			return txID, isReplay, err
+		}
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("creating table `balance`: %w", err)
+		return 0, false, err
 	}
+	defer tx.Rollback()
 
-	_, err = tx.ExecContext(ctx, queryCreateTableTxQueues)
+	err = tx.StmtContext(ctx, p.txQueuesStmts.stmtAddTx).QueryRowContext(ctx, userID, sum,
+		details.Currency, details.Description, details.ExternalReference).Scan(&txID)
 	if err != nil {
-		return fmt.Errorf("creating table `tx_queues`: %w", err)
+		if pgError, ok := err.(*pgconn.PgError); ok && pgError.Code == pgerrcode.ForeignKeyViolation {
+			return 0, false, fmt.Errorf("adding a transaction to the user's queue: userID: %d: %w", userID, ErrUserNotFound)
+		}
+		return 0, false, fmt.Errorf("adding a transaction to the user's queue: userID: %d: %w", userID, err)
 	}
 
-	err = tx.Commit()
+	if idempotencyKey != "" {
+		res, err := tx.StmtContext(ctx, p.idempotencyKeysStmts.stmtAddIdempotencyKey).
+			ExecContext(ctx, idempotencyKey, userID, sum, txID, nil)
+		if err != nil {
+			return 0, false, fmt.Errorf("adding idempotency key: userID: %d: %w", userID, err)
+		}
+		added, err := res.RowsAffected()
+		if err != nil {
+			return 0, false, fmt.Errorf("adding idempotency key: userID: %d: %w", userID, err)
+		}
+		if added == 0 {
+			// A concurrent request with the same key has queued its transaction first.
+			tx.Rollback()
+			return p.getTxByIdempotencyKey(ctx, idempotencyKey, userID, sum)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, false, err
+	}
+
+	return txID, false, nil
+}
+
+func (p *Pg) getTxByIdempotencyKey(ctx context.Context, idempotencyKey string, userID int64, sum money.Amount) (txID int64, isFound bool, err error) {
+
+	var keyUserID int64
+	var keySum money.Amount
+	var keyTransferID sql.NullInt64
+	err = p.idempotencyKeysStmts.stmtGetIdempotencyKey.QueryRowContext(ctx, idempotencyKey).
+		Scan(&keyUserID, &keySum, &txID, &keyTransferID)
 	if err != nil {
-		return err
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("getting idempotency key: userID: %d: %w", userID, err)
 	}
 
-	return nil
+	if keyUserID != userID || keySum != sum || keyTransferID.Valid {
+		return 0, false, fmt.Errorf("userID: %d: %w", userID, ErrIdempotencyKeyReused)
+	}
+
+	return txID, true, nil
 }
 
-func (p *Pg) InitFirstFiveUsersIfNotExistsForTestingApp() (err error) {
-	log.Debug().Msg("Pg.InitFirstFiveUsersIfNotExistsForTestingApp START")
+// Transfer moves the amount from one user to another in one database transaction.
+// Unlike AddTx it doesn't queue anything: the transfer is applied right away or fails with ErrInsufficientFunds.
+// Idempotency keys work the same way as in AddTx.
+func (p *Pg) Transfer(ctx context.Context, fromUserID, toUserID int64, amount money.Amount, idempotencyKey string) (transfer model.Transfer, isReplay bool, err error) {
+	log.Debug().Msg("Pg.Transfer START")
 	defer func() {
 		if err != nil {
-			log.Error().Err(err).Msg("Pg.InitFirstFiveUsersIfNotExistsForTestingApp END")
+			if errors.Is(err, ErrInsufficientFunds) {
+				log.Info().Err(err).Msg("Pg.Transfer END")
+			} else {
+				log.Error().Err(err).Msg("Pg.Transfer END")
+			}
 		} else {
-			log.Debug().Msg("Pg.InitFirstFiveUsersIfNotExistsForTestingApp END")
+			log.Debug().Msg("Pg.Transfer END")
 		}
 	}()
 
-	usersExist, err := p.userIsExist(1)
+	if idempotencyKey != "" {
+		if transfer, isReplay, err = p.getTransferByIdempotencyKey(ctx, idempotencyKey, fromUserID, toUserID, amount); err != nil || isReplay {
+			return transfer, isReplay, err
+		}
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("users existence check: %w", err)
+		return model.Transfer{}, false, err
 	}
+	defer tx.Rollback()
 
-	if usersExist {
-		return nil
+	balances, err := p.getBalancesForUpdate(ctx, tx, fromUserID, toUserID)
+	if err != nil {
+		return model.Transfer{}, false, err
 	}
 
-	tx, err := p.db.Begin()
+	fromBalance, err := balances[fromUserID].Add(amount.Neg())
 	if err != nil {
-		return err
+		return model.Transfer{}, false, fmt.Errorf("debiting user: userID: %d: %w", fromUserID, err)
+	}
+	if fromBalance < 0 {
+		return model.Transfer{}, false, fmt.Errorf("debiting user: userID: %d: %w", fromUserID, ErrInsufficientFunds)
+	}
+	toBalance, err := balances[toUserID].Add(amount)
+	if err != nil {
+		return model.Transfer{}, false, fmt.Errorf("crediting user: userID: %d: %w", toUserID, err)
 	}
-	defer tx.Rollback()
 
-	for id := 1; id <= 5; id++ {
+	transfer = model.Transfer{FromUserID: fromUserID, ToUserID: toUserID, Amount: amount, FromBalanceAfter: fromBalance}
+	err = tx.StmtContext(ctx, p.transfersStmts.stmtAddTransfer).QueryRowContext(ctx, fromUserID, toUserID, amount).
+		Scan(&transfer.ID, &transfer.CreatedAt)
+	if err != nil {
+		return model.Transfer{}, false, fmt.Errorf("adding transfer: from: %d: to: %d: %w", fromUserID, toUserID, err)
+	}
 
-		_, err = tx.Stmt(p.usersStmts.stmtAddUser).Exec()
+	var fromTxID int64
+	for _, side := range []struct {
+		userID       int64
+		sum          money.Amount
+		balanceAfter money.Amount
+		txID         *int64
+	}{
+		{userID: fromUserID, sum: amount.Neg(), balanceAfter: fromBalance, txID: &fromTxID},
+		{userID: toUserID, sum: amount, balanceAfter: toBalance, txID: new(int64)},
+	} {
+		_, err = tx.StmtContext(ctx, p.balanceStmts.stmtChangeBalance).ExecContext(ctx, side.userID, side.sum)
 		if err != nil {
-			return fmt.Errorf("creating user: %w", err)
+			return model.Transfer{}, false, fmt.Errorf("changing user balance: userID: %d: %w", side.userID, err)
 		}
-
-		_, err = tx.Stmt(p.balanceStmts.stmtCreateStartingBalance).Exec(id)
+		err = tx.StmtContext(ctx, p.transfersStmts.stmtAddTransferTx).
+			QueryRowContext(ctx, side.userID, side.sum, side.balanceAfter, transfer.ID).Scan(side.txID)
 		if err != nil {
-			return fmt.Errorf("creating user start balance: %w", err)
+			return model.Transfer{}, false, fmt.Errorf("adding transfer transaction: userID: %d: %w", side.userID, err)
+		}
+	}
+
+	if err = p.postTransfer(ctx, tx, transfer.ID, fromUserID, toUserID, amount); err != nil {
+		return model.Transfer{}, false, err
+	}
+
+	for _, userID := range []int64{fromUserID, toUserID} {
+		if err = p.checkBalanceAgainstLedger(ctx, tx, userID); err != nil {
+			return model.Transfer{}, false, err
 		}
+	}
 
+	if idempotencyKey != "" {
+		res, err := tx.StmtContext(ctx, p.idempotencyKeysStmts.stmtAddIdempotencyKey).
+			ExecContext(ctx, idempotencyKey, fromUserID, amount.Neg(), fromTxID, transfer.ID)
+		if err != nil {
+			return model.Transfer{}, false, fmt.Errorf("adding idempotency key: userID: %d: %w", fromUserID, err)
+		}
+		added, err := res.RowsAffected()
+		if err != nil {
+			return model.Transfer{}, false, fmt.Errorf("adding idempotency key: userID: %d: %w", fromUserID, err)
+		}
+		if added == 0 {
+			// A concurrent request with the same key has made its transfer first.
+			tx.Rollback()
+			return p.getTransferByIdempotencyKey(ctx, idempotencyKey, fromUserID, toUserID, amount)
+		}
 	}
 
 	if err = tx.Commit(); err != nil {
-		return err
+		return model.Transfer{}, false, err
 	}
 
-	return nil
+	return transfer, false, nil
 }
 
-func (p *Pg) ChangeBalance(ctx context.Context, userID int64, sum float64) (err error) {
-	log.Debug().Msg("Pg.ChangeBalance START")
+// getBalancesForUpdate locks the balances of both users, always in the same order.
+func (p *Pg) getBalancesForUpdate(ctx context.Context, tx *sql.Tx, firstUserID, secondUserID int64) (balances map[int64]money.Amount, err error) {
+
+	rows, err := tx.StmtContext(ctx, p.transfersStmts.stmtGetBalancesForUpdate).QueryContext(ctx, firstUserID, secondUserID)
+	if err != nil {
+		return nil, fmt.Errorf("getting users balances: %w", err)
+	}
+	defer rows.Close()
+
+	balances = map[int64]money.Amount{}
+	for rows.Next() {
+		var userID int64
+		var balance money.Amount
+		if err = rows.Scan(&userID, &balance); err != nil {
+			return nil, fmt.Errorf("reading users balances: %w", err)
+		}
+		balances[userID] = balance
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading users balances: %w", err)
+	}
+
+	for _, userID := range []int64{firstUserID, secondUserID} {
+		if _, ok := balances[userID]; !ok {
+			return nil, fmt.Errorf("getting user balance: userID: %d: %w", userID, ErrUserNotFound)
+		}
+	}
+
+	return balances, nil
+}
+
+func (p *Pg) getTransferByIdempotencyKey(ctx context.Context, idempotencyKey string, fromUserID, toUserID int64, amount money.Amount) (transfer model.Transfer, isFound bool, err error) {
+
+	var keyUserID, keyTxID int64
+	var keySum money.Amount
+	var keyTransferID sql.NullInt64
+	err = p.idempotencyKeysStmts.stmtGetIdempotencyKey.QueryRowContext(ctx, idempotencyKey).
+		Scan(&keyUserID, &keySum, &keyTxID, &keyTransferID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Transfer{}, false, nil
+		}
+		return model.Transfer{}, false, fmt.Errorf("getting idempotency key: userID: %d: %w", fromUserID, err)
+	}
+
+	if !keyTransferID.Valid {
+		return model.Transfer{}, false, fmt.Errorf("userID: %d: %w", fromUserID, ErrIdempotencyKeyReused)
+	}
+
+	err = p.transfersStmts.stmtGetTransfer.QueryRowContext(ctx, keyTransferID.Int64).Scan(&transfer.ID,
+		&transfer.FromUserID, &transfer.ToUserID, &transfer.Amount, &transfer.FromBalanceAfter, &transfer.CreatedAt)
+	if err != nil {
+		return model.Transfer{}, false, fmt.Errorf("getting transfer: transferID: %d: %w", keyTransferID.Int64, err)
+	}
+
+	if transfer.FromUserID != fromUserID || transfer.ToUserID != toUserID || transfer.Amount != amount {
+		return model.Transfer{}, false, fmt.Errorf("userID: %d: %w", fromUserID, ErrIdempotencyKeyReused)
+	}
+
+	return transfer, true, nil
+}
+
+// DeleteIdempotencyKeysCreatedBefore deletes the expired idempotency keys.
+func (p *Pg) DeleteIdempotencyKeysCreatedBefore(ctx context.Context, before time.Time) (deleted int64, err error) {
+	log.Debug().Msg("Pg.DeleteIdempotencyKeysCreatedBefore START")
 	defer func() {
 		if err != nil {
-			log.Error().Err(err).Msg("Pg.ChangeBalance END")
+			log.Error().Err(err).Msg("Pg.DeleteIdempotencyKeysCreatedBefore END")
 		} else {
-			log.Debug().Msg("Pg.ChangeBalance END")
+			log.Debug().Msg("Pg.DeleteIdempotencyKeysCreatedBefore END")
 		}
 	}()
 
-	_, err = p.balanceStmts.stmtChangeBalance.ExecContext(ctx, userID, sum)
+	res, err := p.idempotencyKeysStmts.stmtDeleteIdempotencyKeysCreatedBefore.ExecContext(ctx, before)
 	if err != nil {
-		return fmt.Errorf("user balance change: userID: %d: %w", userID, err)
+		return 0, fmt.Errorf("deleting idempotency keys created before %s: %w", before, err)
 	}
 
-	return nil
+	deleted, err = res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("deleting idempotency keys created before %s: %w", before, err)
+	}
+
+	return deleted, nil
 }
 
-func (p *Pg) AddTx(ctx context.Context, userID int64, sum float64) (err error) {
-	log.Debug().Msg("Pg.AddTx START")
+func (p *Pg) GetTx(ctx context.Context, txID int64) (tx model.Tx, err error) {
+	log.Debug().Msg("Pg.GetTx START")
 	defer func() {
 		if err != nil {
-			log.Error().Err(err).Msg("Pg.AddTx END")
+			log.Error().Err(err).Msg("Pg.GetTx END")
 		} else {
-			log.Debug().Msg("Pg.AddTx END")
+			log.Debug().Msg("Pg.GetTx END")
 		}
 	}()
 
-	_, err = p.txQueuesStmts.stmtAddTx.ExecContext(ctx, userID, sum)
+	err = p.txQueuesStmts.stmtGetTx.QueryRowContext(ctx, txID).
+		Scan(&tx.ID, &tx.UserID, &tx.Sum, &tx.Status, &tx.RejectReason, &tx.RejectCode, &tx.BalanceAfter, &tx.CreatedAt, &tx.ProcessedAt,
+			&tx.TransferID, &tx.Attempts, &tx.LastError, &tx.NextAttemptAt, &tx.Currency, &tx.Description, &tx.ExternalReference)
 	if err != nil {
-		return fmt.Errorf("adding a transaction to the user's queue: userID: %d: %w", userID, err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Tx{}, fmt.Errorf("getting transaction: txID: %d: %w", txID, ErrTxNotFound)
+		}
+		return model.Tx{}, fmt.Errorf("getting transaction: txID: %d: %w", txID, err)
 	}
 
-	return nil
+	return tx, nil
+}
+
+func (p *Pg) GetTxs(ctx context.Context, filter model.TxFilter) (txs []model.Tx, err error) {
+	log.Debug().Msg("Pg.GetTxs START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("Pg.GetTxs END")
+		} else {
+			log.Debug().Msg("Pg.GetTxs END")
+		}
+	}()
+
+	cursor := sql.NullInt64{Int64: filter.Cursor, Valid: filter.Cursor != 0}
+	txType := sql.NullString{String: string(filter.Type), Valid: filter.Type != ""}
+	status := sql.NullString{String: string(filter.Status), Valid: filter.Status != ""}
+
+	rows, err := p.txQueuesStmts.stmtGetTxsByFilter.QueryContext(ctx, filter.UserID, cursor, txType, status,
+		filter.MinAmount, filter.MaxAmount, filter.CreatedFrom, filter.CreatedTo, filter.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("getting transactions by filter: userID: %d: %w", filter.UserID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tx model.Tx
+		if err = rows.Scan(&tx.ID, &tx.UserID, &tx.Sum, &tx.Status, &tx.RejectReason, &tx.RejectCode, &tx.BalanceAfter,
+			&tx.CreatedAt, &tx.ProcessedAt, &tx.TransferID, &tx.Attempts, &tx.LastError, &tx.NextAttemptAt,
+			&tx.Currency, &tx.Description, &tx.ExternalReference); err != nil {
+			return nil, fmt.Errorf("reading transactions by filter: userID: %d: %w", filter.UserID, err)
+		}
+		txs = append(txs, tx)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading transactions by filter: userID: %d: %w", filter.UserID, err)
+	}
+
+	return txs, nil
+}
+
+func (p *Pg) GetBalance(ctx context.Context, userID int64) (balance model.Balance, err error) {
+	log.Debug().Msg("Pg.GetBalance START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("Pg.GetBalance END")
+		} else {
+			log.Debug().Msg("Pg.GetBalance END")
+		}
+	}()
+
+	balance.UserID = userID
+
+	err = p.balanceStmts.stmtGetBalance.QueryRowContext(ctx, userID).
+		Scan(&balance.Settled, &balance.PendingReceipts, &balance.PendingWithdrawals)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Balance{}, fmt.Errorf("getting user balance: userID: %d: %w", userID, ErrUserNotFound)
+		}
+		return model.Balance{}, fmt.Errorf("getting user balance: userID: %d: %w", userID, err)
+	}
+
+	return balance, nil
 }
 
 func (p *Pg) GetUsersWithNonEmptyTxQueues(ctx context.Context) (users []int64, err error) {
@@ -223,71 +533,300 @@ func (p *Pg) GetUsersWithNonEmptyTxQueues(ctx context.Context) (users []int64, e
 	return users, nil
 }
 
-func (p *Pg) ProcessTxQueue(ctx context.Context, userID int64) (err error) {
+// ProcessTxQueue processes the pending transactions of the user one by one in FIFO order.
+// A transaction that would make the balance negative is rejected with ErrInsufficientFunds as the reason,
+// the ones after it are still applied. It returns the processed transactions with their outcome.
+func (p *Pg) ProcessTxQueue(ctx context.Context, userID int64) (processed []model.Tx, err error) {
 	log.Debug().Msg("Pg.ProcessTxQueue START")
 	defer func() {
 		if err != nil {
-			if errors.Is(err, ErrInsufficientFunds) {
-				log.Info().Err(err).Msg("Pg.ProcessTxQueue END")
-			} else {
-				log.Error().Err(err).Msg("Pg.ProcessTxQueue END")
-			}
+			log.Error().Err(err).Msg("Pg.ProcessTxQueue END")
 		} else {
 			log.Debug().Msg("Pg.ProcessTxQueue END")
 		}
 	}()
 
-	tx, err := p.db.Begin()
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback()
 
-	txRows, err := tx.StmtContext(ctx, p.txQueuesStmts.stmtGetTxsByUser).QueryContext(ctx, userID)
-	if err != nil {
-		return fmt.Errorf("getting transactions by user: userID: %d: %w", userID, err)
+	// The advisory lock serializes processing of the user's queue across all the app instances,
+	// the balance row lock serializes it with transfers of the user.
+	if _, err = tx.StmtContext(ctx, p.txQueuesStmts.stmtLockTxQueue).ExecContext(ctx, userID); err != nil {
+		return nil, fmt.Errorf("locking tx queue: userID: %d: %w", userID, err)
 	}
-	defer txRows.Close()
 
-	txsFromDB := []int64{}
-	var sumInQueue float64
-	for txRows.Next() {
-		var currTxFromDB int64
-		var currSum float64
-		if err = txRows.Scan(&currTxFromDB, &currSum); err != nil {
-			return fmt.Errorf("getting transactions by user: userID: %d: %w", userID, err)
+	var balance money.Amount
+	err = tx.StmtContext(ctx, p.balanceStmts.stmtGetBalanceForUpdate).QueryRowContext(ctx, userID).Scan(&balance)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("getting user balance: userID: %d: %w", userID, ErrUserNotFound)
 		}
-		txsFromDB = append(txsFromDB, currTxFromDB)
-		sumInQueue += currSum
+		return nil, fmt.Errorf("getting user balance: userID: %d: %w", userID, err)
 	}
 
-	if err = txRows.Err(); err != nil {
-		tx.Rollback()
-		return fmt.Errorf("reading transactions by user: userID: %d: %w", userID, err)
+	pending, isBackingOff, err := p.getPendingTxs(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if isBackingOff {
+		return nil, fmt.Errorf("processing tx queue: userID: %d: txID: %d: %w", userID, pending[0].ID, ErrTxQueueIsBackingOff)
+	}
+
+	startBalance := balance
+	for _, currTx := range pending {
+
+		newBalance, errAdd := balance.Add(currTx.Sum)
+		switch {
+		case errAdd != nil:
+			currTx.Status, currTx.RejectCode, currTx.RejectReason = model.TxStatusRejected, model.RejectCodeBalanceOverflow, errAdd.Error()
+		case newBalance < 0:
+			currTx.Status, currTx.RejectCode, currTx.RejectReason = model.TxStatusRejected, model.RejectCodeInsufficientFunds, ErrInsufficientFunds.Error()
+		default:
+			if err = p.postTx(ctx, tx, currTx.ID, userID, currTx.Sum); err != nil {
+				return nil, err
+			}
+			currTx.Status = model.TxStatusApplied
+			balance = newBalance
+		}
+
+		balanceAfter := balance
+		currTx.BalanceAfter = &balanceAfter
+
+		rejectReason := sql.NullString{String: currTx.RejectReason, Valid: currTx.RejectReason != ""}
+		rejectCode := sql.NullString{String: string(currTx.RejectCode), Valid: currTx.RejectCode != ""}
+		err = tx.StmtContext(ctx, p.txQueuesStmts.stmtSetTxStatus).
+			QueryRowContext(ctx, currTx.ID, currTx.Status, rejectReason, balanceAfter, rejectCode).Scan(&currTx.ProcessedAt)
+		if err != nil {
+			return nil, fmt.Errorf("setting transaction status: txID: %d: %w", currTx.ID, err)
+		}
+
+		processed = append(processed, currTx)
 	}
 
-	_, err = tx.StmtContext(ctx, p.balanceStmts.stmtChangeBalance).ExecContext(ctx, userID, sumInQueue)
+	_, err = tx.StmtContext(ctx, p.balanceStmts.stmtChangeBalance).ExecContext(ctx, userID, balance-startBalance)
 	if err != nil {
-		tx.Rollback()
 		if pgError, ok := err.(*pgconn.PgError); ok &&
 			pgError.Code == pgerrcode.CheckViolation &&
 			pgError.ConstraintName == "balance_sum_check" {
-			return fmt.Errorf("changing user balance: userID: %d: %w", userID, ErrInsufficientFunds)
+			return nil, fmt.Errorf("changing user balance: userID: %d: %w", userID, ErrInsufficientFunds)
 		}
-		return fmt.Errorf("changing user balance: userID: %d: %w", userID, err)
+		return nil, fmt.Errorf("changing user balance: userID: %d: %w", userID, err)
+	}
+
+	if err = p.checkBalanceAgainstLedger(ctx, tx, userID); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
 	}
 
-	_, err = p.txQueuesStmts.stmtDeleteTxsByIds.ExecContext(ctx, pq.Array(txsFromDB))
+	return processed, nil
+
+}
+
+// getPendingTxs locks and returns the pending transactions of the user in FIFO order.
+// isBackingOff tells that the oldest of them waits for its next attempt after a failure, so the queue must not be processed yet.
+func (p *Pg) getPendingTxs(ctx context.Context, tx *sql.Tx, userID int64) (pending []model.Tx, isBackingOff bool, err error) {
+
+	txRows, err := tx.StmtContext(ctx, p.txQueuesStmts.stmtGetPendingTxsByUser).QueryContext(ctx, userID)
 	if err != nil {
-		return fmt.Errorf("clearing txs from queue: userID: %d: %w", userID, err)
+		return nil, false, fmt.Errorf("getting pending transactions by user: userID: %d: %w", userID, err)
+	}
+	defer txRows.Close()
+
+	for txRows.Next() {
+		currTx := model.Tx{UserID: userID, Status: model.TxStatusPending}
+		var currIsBackingOff bool
+		if err = txRows.Scan(&currTx.ID, &currTx.Sum, &currTx.CreatedAt, &currTx.Attempts, &currIsBackingOff); err != nil {
+			return nil, false, fmt.Errorf("reading pending transactions by user: userID: %d: %w", userID, err)
+		}
+		if len(pending) == 0 {
+			isBackingOff = currIsBackingOff
+		}
+		pending = append(pending, currTx)
+	}
+
+	if err = txRows.Err(); err != nil {
+		return nil, false, fmt.Errorf("reading pending transactions by user: userID: %d: %w", userID, err)
+	}
+
+	return pending, isBackingOff, nil
+}
+
+// RecordTxQueueFailure counts a failed run of processing of the user's tx queue against the oldest pending transaction of it,
+// which blocks the rest of the queue. The transaction is retried after policy.Delay, or dead-lettered
+// after policy.MaxAttempts failed attempts. It returns the transaction with its new state.
+func (p *Pg) RecordTxQueueFailure(ctx context.Context, userID int64, reason string, policy model.RetryPolicy) (failed model.Tx, err error) {
+	log.Debug().Msg("Pg.RecordTxQueueFailure START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("Pg.RecordTxQueueFailure END")
+		} else {
+			log.Debug().Msg("Pg.RecordTxQueueFailure END")
+		}
+	}()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Tx{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.StmtContext(ctx, p.txQueuesStmts.stmtLockTxQueue).ExecContext(ctx, userID); err != nil {
+		return model.Tx{}, fmt.Errorf("locking tx queue: userID: %d: %w", userID, err)
+	}
+
+	pending, _, err := p.getPendingTxs(ctx, tx, userID)
+	if err != nil {
+		return model.Tx{}, err
+	}
+	if len(pending) == 0 {
+		return model.Tx{}, fmt.Errorf("getting the oldest pending transaction: userID: %d: %w", userID, ErrTxNotFound)
+	}
+
+	failed = pending[0]
+	failed.Attempts++
+	failed.LastError = reason
+
+	if failed.Attempts >= policy.MaxAttempts {
+		_, err = tx.StmtContext(ctx, p.txQueuesStmts.stmtSetTxDeadLettered).ExecContext(ctx, failed.ID, failed.Attempts, reason)
+		if err != nil {
+			return model.Tx{}, fmt.Errorf("dead-lettering transaction: txID: %d: %w", failed.ID, err)
+		}
+		_, err = tx.StmtContext(ctx, p.deadLettersStmts.stmtAddDeadLetter).
+			ExecContext(ctx, failed.ID, userID, failed.Sum, failed.Attempts, reason)
+		if err != nil {
+			return model.Tx{}, fmt.Errorf("adding dead letter: txID: %d: %w", failed.ID, err)
+		}
+		failed.Status = model.TxStatusDeadLettered
+	} else {
+		err = tx.StmtContext(ctx, p.txQueuesStmts.stmtSetTxRetry).
+			QueryRowContext(ctx, failed.ID, failed.Attempts, reason, policy.Delay(failed.Attempts).Seconds()).Scan(&failed.NextAttemptAt)
+		if err != nil {
+			return model.Tx{}, fmt.Errorf("setting transaction retry: txID: %d: %w", failed.ID, err)
+		}
 	}
 
 	if err = tx.Commit(); err != nil {
+		return model.Tx{}, err
+	}
+
+	return failed, nil
+}
+
+// GetDeadLetters returns a page of the unresolved dead letters, oldest first.
+// cursor is the ID of the last dead letter of the previous page.
+func (p *Pg) GetDeadLetters(ctx context.Context, cursor int64, limit int) (deadLetters []model.DeadLetter, err error) {
+	log.Debug().Msg("Pg.GetDeadLetters START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("Pg.GetDeadLetters END")
+		} else {
+			log.Debug().Msg("Pg.GetDeadLetters END")
+		}
+	}()
+
+	rows, err := p.deadLettersStmts.stmtGetDeadLetters.QueryContext(ctx, cursor, limit)
+	if err != nil {
+		return nil, fmt.Errorf("getting dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var deadLetter model.DeadLetter
+		if err = rows.Scan(&deadLetter.ID, &deadLetter.TxID, &deadLetter.UserID, &deadLetter.Sum, &deadLetter.Attempts,
+			&deadLetter.LastError, &deadLetter.CreatedAt, &deadLetter.ResolvedAt, &deadLetter.Resolution); err != nil {
+			return nil, fmt.Errorf("reading dead letters: %w", err)
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading dead letters: %w", err)
+	}
+
+	return deadLetters, nil
+}
+
+// RequeueDeadLetter puts the transaction of the dead letter back to its user's queue as pending, with no failed attempts.
+// It keeps its place in the queue, so it is processed before the transactions queued after it that are still pending.
+func (p *Pg) RequeueDeadLetter(ctx context.Context, deadLetterID int64) (deadLetter model.DeadLetter, err error) {
+	log.Debug().Msg("Pg.RequeueDeadLetter START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("Pg.RequeueDeadLetter END")
+		} else {
+			log.Debug().Msg("Pg.RequeueDeadLetter END")
+		}
+	}()
+
+	return p.resolveDeadLetter(ctx, deadLetterID, model.DeadLetterResolutionRequeued, func(tx *sql.Tx, txID int64) error {
+		_, err := tx.StmtContext(ctx, p.txQueuesStmts.stmtRequeueTx).ExecContext(ctx, txID)
+		return err
+	})
+}
+
+// DiscardDeadLetter rejects the transaction of the dead letter, so it never moves money.
+func (p *Pg) DiscardDeadLetter(ctx context.Context, deadLetterID int64) (deadLetter model.DeadLetter, err error) {
+	log.Debug().Msg("Pg.DiscardDeadLetter START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("Pg.DiscardDeadLetter END")
+		} else {
+			log.Debug().Msg("Pg.DiscardDeadLetter END")
+		}
+	}()
+
+	return p.resolveDeadLetter(ctx, deadLetterID, model.DeadLetterResolutionDiscarded, func(tx *sql.Tx, txID int64) error {
+		_, err := tx.StmtContext(ctx, p.txQueuesStmts.stmtDiscardTx).
+			ExecContext(ctx, txID, string(model.DeadLetterResolutionDiscarded), model.RejectCodeDiscarded)
 		return err
+	})
+}
+
+func (p *Pg) resolveDeadLetter(ctx context.Context, deadLetterID int64, resolution model.DeadLetterResolution,
+	resolveTx func(tx *sql.Tx, txID int64) error) (deadLetter model.DeadLetter, err error) {
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.DeadLetter{}, err
+	}
+	defer tx.Rollback()
+
+	err = tx.StmtContext(ctx, p.deadLettersStmts.stmtGetDeadLetterForUpdate).QueryRowContext(ctx, deadLetterID).
+		Scan(&deadLetter.ID, &deadLetter.TxID, &deadLetter.UserID, &deadLetter.Sum, &deadLetter.Attempts,
+			&deadLetter.LastError, &deadLetter.CreatedAt, &deadLetter.ResolvedAt, &deadLetter.Resolution)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.DeadLetter{}, fmt.Errorf("getting dead letter: id: %d: %w", deadLetterID, ErrDeadLetterNotFound)
+		}
+		return model.DeadLetter{}, fmt.Errorf("getting dead letter: id: %d: %w", deadLetterID, err)
 	}
 
-	return nil
+	if deadLetter.ResolvedAt != nil {
+		return model.DeadLetter{}, fmt.Errorf("resolving dead letter: id: %d: %w: %s", deadLetterID, ErrDeadLetterIsResolved, deadLetter.Resolution)
+	}
+
+	if err = resolveTx(tx, deadLetter.TxID); err != nil {
+		return model.DeadLetter{}, fmt.Errorf("resolving dead letter transaction: txID: %d: %w", deadLetter.TxID, err)
+	}
+
+	err = tx.StmtContext(ctx, p.deadLettersStmts.stmtResolveDeadLetter).
+		QueryRowContext(ctx, deadLetterID, resolution).Scan(&deadLetter.ResolvedAt)
+	if err != nil {
+		return model.DeadLetter{}, fmt.Errorf("resolving dead letter: id: %d: %w", deadLetterID, err)
+	}
+	deadLetter.Resolution = resolution
+
+	if err = tx.Commit(); err != nil {
+		return model.DeadLetter{}, err
+	}
 
+	return deadLetter, nil
 }
 
 func (p *Pg) Close() (err error) {
@@ -0,0 +1,63 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	queryAddTransfer = `INSERT INTO transfers (from_user_id, to_user_id, sum) VALUES ($1, $2, $3) RETURNING id, created_at`
+	queryGetTransfer = `
+SELECT t.id, t.from_user_id, t.to_user_id, t.sum, q.balance_after, t.created_at
+FROM transfers t
+JOIN tx_queues q ON q.transfer_id = t.id AND q.user_id = t.from_user_id
+WHERE t.id = $1
+`
+	queryAddTransferTx = `INSERT INTO tx_queues (user_id, sum, status, balance_after, processed_at, transfer_id)
+		VALUES ($1, $2, 'applied', $3, now(), $4) RETURNING id`
+	// Locking both balance rows in the order of user IDs keeps concurrent transfers from deadlocking.
+	queryGetBalancesForUpdate = `SELECT user_id, sum FROM balance WHERE user_id IN ($1, $2) ORDER BY user_id FOR UPDATE`
+)
+
+type transfersStmts struct {
+	stmtAddTransfer          *sql.Stmt
+	stmtGetTransfer          *sql.Stmt
+	stmtAddTransferTx        *sql.Stmt
+	stmtGetBalancesForUpdate *sql.Stmt
+}
+
+func prepareTransfersStmts(ctx context.Context, p *Pg) (err error) {
+	log.Debug().Msg("pg.prepareTransfersStmts START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("pg.prepareTransfersStmts END")
+		} else {
+			log.Debug().Msg("pg.prepareTransfersStmts END")
+		}
+	}()
+
+	newTransfersStmts := transfersStmts{}
+
+	if newTransfersStmts.stmtAddTransfer, err = p.db.PrepareContext(ctx, queryAddTransfer); err != nil {
+		return fmt.Errorf("preparing `add transfer` stmt: %w", err)
+	}
+
+	if newTransfersStmts.stmtGetTransfer, err = p.db.PrepareContext(ctx, queryGetTransfer); err != nil {
+		return fmt.Errorf("preparing `get transfer` stmt: %w", err)
+	}
+
+	if newTransfersStmts.stmtAddTransferTx, err = p.db.PrepareContext(ctx, queryAddTransferTx); err != nil {
+		return fmt.Errorf("preparing `add transfer tx` stmt: %w", err)
+	}
+
+	if newTransfersStmts.stmtGetBalancesForUpdate, err = p.db.PrepareContext(ctx, queryGetBalancesForUpdate); err != nil {
+		return fmt.Errorf("preparing `get balances for update` stmt: %w", err)
+	}
+
+	p.transfersStmts = &newTransfersStmts
+
+	return nil
+}
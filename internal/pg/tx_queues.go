@@ -8,27 +8,62 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-const queryCreateTableTxQueues = `
-CREATE TABLE IF NOT EXISTS tx_queues
-(
-	id             bigserial PRIMARY KEY,
-	user_id        bigint REFERENCES users(id) ON DELETE CASCADE,
-	sum            double precision NOT NULL
-);
-`
-
 const (
-	queryAddTx                        = `INSERT INTO tx_queues (user_id, sum) VALUES ($1, $2)`
-	queryGetTxsByUser                 = `SELECT id, sum FROM tx_queues WHERE user_id = $1`
-	queryDeleteTxsByIds               = `DELETE FROM tx_queues WHERE id = any($1)`
-	queryGetUsersWithNonEmptyTxQueues = `SELECT DISTINCT user_id FROM tx_queues`
+	queryAddTx = `INSERT INTO tx_queues (user_id, sum, currency, description, external_reference)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, '')) RETURNING id`
+	queryGetTx = `SELECT id, user_id, sum, status, COALESCE(reject_reason, ''), COALESCE(reject_code, ''), balance_after, created_at, processed_at, transfer_id,
+		attempts, COALESCE(last_error, ''), next_attempt_at,
+		COALESCE(currency, ''), COALESCE(description, ''), COALESCE(external_reference, '')
+		FROM tx_queues WHERE id = $1`
+	// queryLockTxQueue takes a transaction level advisory lock on the user's queue,
+	// so the queue is processed by one db session at a time whatever the number of app instances.
+	queryLockTxQueue         = `SELECT pg_advisory_xact_lock(hashtextextended('tx_queues:' || $1::text, 0))`
+	queryGetPendingTxsByUser = `SELECT id, sum, created_at, attempts, COALESCE(next_attempt_at > now(), false)
+		FROM tx_queues WHERE user_id = $1 AND status = 'pending' ORDER BY id FOR UPDATE`
+	querySetTxStatus = `UPDATE tx_queues SET status = $2, reject_code = $5, reject_reason = $3, balance_after = $4, processed_at = now()
+		WHERE id = $1 RETURNING processed_at`
+	// The queues whose oldest pending transaction waits for its next attempt are skipped.
+	queryGetUsersWithNonEmptyTxQueues = `SELECT user_id FROM (
+		SELECT DISTINCT ON (user_id) user_id, next_attempt_at FROM tx_queues WHERE status = 'pending' ORDER BY user_id, id
+	) oldest WHERE COALESCE(next_attempt_at, '-infinity') <= now()`
+	querySetTxRetry = `UPDATE tx_queues SET attempts = $2, last_error = $3, next_attempt_at = now() + make_interval(secs => $4)
+		WHERE id = $1 RETURNING next_attempt_at`
+	querySetTxDeadLettered = `UPDATE tx_queues SET status = 'dead_lettered', attempts = $2, last_error = $3, next_attempt_at = NULL,
+		processed_at = now() WHERE id = $1`
+	queryRequeueTx = `UPDATE tx_queues SET status = 'pending', attempts = 0, last_error = NULL, next_attempt_at = NULL, processed_at = NULL
+		WHERE id = $1 AND status = 'dead_lettered'`
+	queryDiscardTx = `UPDATE tx_queues SET status = 'rejected', reject_code = $3, reject_reason = $2, processed_at = now()
+		WHERE id = $1 AND status = 'dead_lettered'`
+	queryGetTxsByFilter = `
+SELECT id, user_id, sum, status, COALESCE(reject_reason, ''), COALESCE(reject_code, ''), balance_after, created_at, processed_at, transfer_id,
+	attempts, COALESCE(last_error, ''), next_attempt_at,
+	COALESCE(currency, ''), COALESCE(description, ''), COALESCE(external_reference, '')
+FROM tx_queues
+WHERE user_id = $1
+	AND ($2::bigint IS NULL OR id < $2)
+	AND ($3::text IS NULL OR ($3 = 'receipt' AND sum >= 0) OR ($3 = 'withdraw' AND sum < 0))
+	AND ($4::text IS NULL OR status = $4)
+	AND ($5::bigint IS NULL OR abs(sum) >= $5)
+	AND ($6::bigint IS NULL OR abs(sum) <= $6)
+	AND ($7::timestamptz IS NULL OR created_at >= $7)
+	AND ($8::timestamptz IS NULL OR created_at < $8)
+ORDER BY id DESC
+LIMIT $9
+`
 )
 
 type txQueuesStmts struct {
 	stmtAddTx                        *sql.Stmt
-	stmtGetTxsByUser                 *sql.Stmt
-	stmtDeleteTxsByIds               *sql.Stmt
+	stmtGetTx                        *sql.Stmt
+	stmtLockTxQueue                  *sql.Stmt
+	stmtGetPendingTxsByUser          *sql.Stmt
+	stmtSetTxStatus                  *sql.Stmt
 	stmtGetUsersWithNonEmptyTxQueues *sql.Stmt
+	stmtGetTxsByFilter               *sql.Stmt
+	stmtSetTxRetry                   *sql.Stmt
+	stmtSetTxDeadLettered            *sql.Stmt
+	stmtRequeueTx                    *sql.Stmt
+	stmtDiscardTx                    *sql.Stmt
 }
 
 func prepareTxStmts(ctx context.Context, p *Pg) (err error) {
@@ -47,18 +82,46 @@ func prepareTxStmts(ctx context.Context, p *Pg) (err error) {
 		return fmt.Errorf("preparing `add tx` stmt: %w", err)
 	}
 
-	if newTxQueuesStmts.stmtGetTxsByUser, err = p.db.PrepareContext(ctx, queryGetTxsByUser); err != nil {
-		return fmt.Errorf("preparing `get txs by user` stmt: %w", err)
+	if newTxQueuesStmts.stmtGetTx, err = p.db.PrepareContext(ctx, queryGetTx); err != nil {
+		return fmt.Errorf("preparing `get tx` stmt: %w", err)
+	}
+
+	if newTxQueuesStmts.stmtLockTxQueue, err = p.db.PrepareContext(ctx, queryLockTxQueue); err != nil {
+		return fmt.Errorf("preparing `lock tx queue` stmt: %w", err)
 	}
 
-	if newTxQueuesStmts.stmtDeleteTxsByIds, err = p.db.PrepareContext(ctx, queryDeleteTxsByIds); err != nil {
-		return fmt.Errorf("preparing `delete txs by ids` stmt: %w", err)
+	if newTxQueuesStmts.stmtGetPendingTxsByUser, err = p.db.PrepareContext(ctx, queryGetPendingTxsByUser); err != nil {
+		return fmt.Errorf("preparing `get pending txs by user` stmt: %w", err)
+	}
+
+	if newTxQueuesStmts.stmtSetTxStatus, err = p.db.PrepareContext(ctx, querySetTxStatus); err != nil {
+		return fmt.Errorf("preparing `set tx status` stmt: %w", err)
 	}
 
 	if newTxQueuesStmts.stmtGetUsersWithNonEmptyTxQueues, err = p.db.PrepareContext(ctx, queryGetUsersWithNonEmptyTxQueues); err != nil {
 		return fmt.Errorf("preparing `get users with non empty txs queues` stmt: %w", err)
 	}
 
+	if newTxQueuesStmts.stmtGetTxsByFilter, err = p.db.PrepareContext(ctx, queryGetTxsByFilter); err != nil {
+		return fmt.Errorf("preparing `get txs by filter` stmt: %w", err)
+	}
+
+	if newTxQueuesStmts.stmtSetTxRetry, err = p.db.PrepareContext(ctx, querySetTxRetry); err != nil {
+		return fmt.Errorf("preparing `set tx retry` stmt: %w", err)
+	}
+
+	if newTxQueuesStmts.stmtSetTxDeadLettered, err = p.db.PrepareContext(ctx, querySetTxDeadLettered); err != nil {
+		return fmt.Errorf("preparing `set tx dead lettered` stmt: %w", err)
+	}
+
+	if newTxQueuesStmts.stmtRequeueTx, err = p.db.PrepareContext(ctx, queryRequeueTx); err != nil {
+		return fmt.Errorf("preparing `requeue tx` stmt: %w", err)
+	}
+
+	if newTxQueuesStmts.stmtDiscardTx, err = p.db.PrepareContext(ctx, queryDiscardTx); err != nil {
+		return fmt.Errorf("preparing `discard tx` stmt: %w", err)
+	}
+
 	p.txQueuesStmts = &newTxQueuesStmts
 
 	return nil
@@ -0,0 +1,75 @@
+package pg
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// txQueuesChannel is notified with the user id every time a pending transaction is queued (see migration 0010).
+const txQueuesChannel = "tx_queues"
+
+// listenReconnectDelay is how long ListenTxQueues waits before reconnecting after losing the connection.
+const listenReconnectDelay = time.Second * 5
+
+// ListenTxQueues listens for transactions queued by any app instance or written to tx_queues directly
+// and calls onQueued with the user id of each of them. onQueued must not block.
+// It holds a dedicated connection, reconnects when it is lost, and returns only when ctx is done.
+// Notifications sent while reconnecting are lost, so the queues should still be swept from time to time.
+func (p *Pg) ListenTxQueues(ctx context.Context, onQueued func(userID int64)) (err error) {
+	log.Debug().Msg("Pg.ListenTxQueues START")
+	defer log.Debug().Msg("Pg.ListenTxQueues END")
+
+	for {
+
+		err = p.listenTxQueues(ctx, onQueued)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Warn().Err(err).Msg("listening tx queues notifications, reconnecting")
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(listenReconnectDelay):
+		}
+
+	}
+
+}
+
+func (p *Pg) listenTxQueues(ctx context.Context, onQueued func(userID int64)) (err error) {
+
+	conn, err := pgx.Connect(ctx, p.connString)
+	if err != nil {
+		return fmt.Errorf("connecting: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	if _, err = conn.Exec(ctx, "LISTEN "+txQueuesChannel); err != nil {
+		return fmt.Errorf("listening channel %s: %w", txQueuesChannel, err)
+	}
+	log.Info().Str("channel", txQueuesChannel).Msg("listening tx queues notifications")
+
+	for {
+
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("waiting for notification: %w", err)
+		}
+
+		userID, err := strconv.ParseInt(notification.Payload, 10, 64)
+		if err != nil {
+			log.Warn().Err(err).Str("payload", notification.Payload).Msg("unexpected tx queues notification")
+			continue
+		}
+
+		onQueued(userID)
+
+	}
+
+}
@@ -9,15 +9,8 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-const queryCreateTableUsers = `
-CREATE TABLE IF NOT EXISTS users
-(
-	id bigserial PRIMARY KEY
-);
-`
-
 const (
-	queryAddUser = `INSERT INTO users DEFAULT VALUES`
+	queryAddUser = `INSERT INTO users DEFAULT VALUES RETURNING id`
 	queryGetUser = `SELECT id FROM users WHERE id = $1`
 )
 
@@ -51,6 +44,38 @@ func prepareUserStmts(ctx context.Context, p *Pg) (err error) {
 	return nil
 }
 
+// AddUser adds a user with a zero balance and returns the ID of the user.
+func (p *Pg) AddUser() (userID int64, err error) {
+	log.Debug().Msg("Pg.AddUser START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("Pg.AddUser END")
+		} else {
+			log.Debug().Msg("Pg.AddUser END")
+		}
+	}()
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err = tx.Stmt(p.usersStmts.stmtAddUser).QueryRow().Scan(&userID); err != nil {
+		return 0, fmt.Errorf("creating user: %w", err)
+	}
+
+	if _, err = tx.Stmt(p.balanceStmts.stmtCreateStartingBalance).Exec(userID); err != nil {
+		return 0, fmt.Errorf("creating user start balance: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
 func (p *Pg) userIsExist(userID int64) (isExists bool, err error) {
 	log.Debug().Str("userID", fmt.Sprint(userID)).Msg("pg.prepareUserStmts START")
 	defer func() {
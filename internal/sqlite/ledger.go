@@ -0,0 +1,107 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+
+	"transactions/internal/money"
+	"transactions/internal/pg"
+)
+
+const (
+	entryDescriptionReceipt  = "receipt"
+	entryDescriptionWithdraw = "withdraw"
+	entryDescriptionTransfer = "transfer"
+)
+
+// postTx writes the journal entry of a queued transaction: a receipt moves money
+// from the external world to the user, a withdrawal moves it back.
+func (s *SQLite) postTx(ctx context.Context, tx *sql.Tx, txID, userID int64, sum money.Amount) (err error) {
+
+	user := sql.NullInt64{Int64: userID, Valid: true}
+	world := sql.NullInt64{}
+
+	description, debit, credit, amount := entryDescriptionReceipt, world, user, sum
+	if sum < 0 {
+		description, debit, credit, amount = entryDescriptionWithdraw, user, world, sum.Neg()
+	}
+
+	if err = s.postJournalEntry(ctx, tx, sql.NullInt64{Int64: txID, Valid: true}, sql.NullInt64{},
+		description, debit, credit, amount); err != nil {
+		return fmt.Errorf("posting journal entry: txID: %d: %w", txID, err)
+	}
+
+	return nil
+}
+
+// postJournalEntry writes a journal entry of a transaction or a transfer with its debit and credit postings.
+// A NULL account is the external world.
+func (s *SQLite) postJournalEntry(ctx context.Context, tx *sql.Tx, txID, transferID sql.NullInt64, description string,
+	debit, credit sql.NullInt64, amount money.Amount) (err error) {
+
+	var entryID int64
+	err = tx.StmtContext(ctx, s.stmts.stmtAddJournalEntry).
+		QueryRowContext(ctx, txID, transferID, description, formatTime(now())).Scan(&entryID)
+	if err != nil {
+		return fmt.Errorf("adding journal entry: %w", err)
+	}
+
+	if _, err = tx.StmtContext(ctx, s.stmts.stmtAddPostings).ExecContext(ctx, entryID, debit, credit, amount); err != nil {
+		return fmt.Errorf("adding postings: entryID: %d: %w", entryID, err)
+	}
+
+	return nil
+}
+
+// checkBalanceAgainstLedger makes sure the stored balance of the user equals the running balance of the user's postings.
+// It doesn't read the postings themselves, so it costs the same whatever the history of the user, see AuditLedger.
+func (s *SQLite) checkBalanceAgainstLedger(ctx context.Context, tx *sql.Tx, userID int64) (err error) {
+
+	var isConsistent bool
+	err = tx.StmtContext(ctx, s.stmts.stmtCheckBalanceAgainstLedger).QueryRowContext(ctx, userID).Scan(&isConsistent)
+	if err != nil {
+		return fmt.Errorf("checking balance against ledger: userID: %d: %w", userID, err)
+	}
+
+	if !isConsistent {
+		return fmt.Errorf("userID: %d: %w", userID, pg.ErrLedgerMismatch)
+	}
+
+	return nil
+}
+
+// AuditLedger reconciles every balance with the full history of the postings of the user and returns the users
+// whose balance or running ledger balance differs from it. It reads all the postings, so it is meant for a periodic job.
+func (s *SQLite) AuditLedger(ctx context.Context) (mismatchedUsers []int64, err error) {
+	log.Debug().Msg("SQLite.AuditLedger START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("SQLite.AuditLedger END")
+		} else {
+			log.Debug().Msg("SQLite.AuditLedger END")
+		}
+	}()
+
+	rows, err := s.stmts.stmtAuditLedger.QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("auditing ledger: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int64
+		if err = rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("reading ledger audit: %w", err)
+		}
+		mismatchedUsers = append(mismatchedUsers, userID)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading ledger audit: %w", err)
+	}
+
+	return mismatchedUsers, nil
+}
@@ -0,0 +1,135 @@
+-- The same tables as the pg storage has after all its migrations (see internal/pg/migrations), in the SQLite dialect.
+-- Sums are integer minor units, timestamps are UTC text in the fixed width timeLayout, so they sort as text.
+-- Bump schemaVersion in sqlite.go with every change here and add the upgrade of the older files to schemaUpgrades,
+-- and keep every statement idempotent.
+CREATE TABLE IF NOT EXISTS users
+(
+	id             INTEGER PRIMARY KEY AUTOINCREMENT
+);
+
+CREATE TABLE IF NOT EXISTS balance
+(
+	id             INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id        INTEGER UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+	sum            INTEGER NOT NULL CONSTRAINT balance_sum_check CHECK (NOT(sum < 0))
+);
+
+CREATE TABLE IF NOT EXISTS transfers
+(
+	id             INTEGER PRIMARY KEY AUTOINCREMENT,
+	from_user_id   INTEGER NOT NULL REFERENCES users(id),
+	to_user_id     INTEGER NOT NULL REFERENCES users(id),
+	sum            INTEGER NOT NULL CHECK (sum > 0),
+	created_at     TEXT NOT NULL,
+	CHECK (from_user_id <> to_user_id)
+);
+
+CREATE TABLE IF NOT EXISTS tx_queues
+(
+	id              INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id         INTEGER REFERENCES users(id) ON DELETE CASCADE,
+	sum             INTEGER NOT NULL,
+	status          TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'applied', 'rejected', 'dead_lettered')),
+	reject_reason   TEXT,
+	-- The machine-readable reason of a rejection, see the pg migration 0014.
+	reject_code     TEXT,
+	balance_after   INTEGER,
+	created_at      TEXT NOT NULL,
+	processed_at    TEXT,
+	transfer_id     INTEGER REFERENCES transfers(id),
+	attempts        INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TEXT,
+	last_error      TEXT,
+	-- The details sent by the client with the transaction, see the pg migration 0012.
+	currency           TEXT,
+	description        TEXT,
+	external_reference TEXT
+);
+
+CREATE INDEX IF NOT EXISTS tx_queues_pending_idx ON tx_queues (user_id, id) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS tx_queues_user_id_idx ON tx_queues (user_id, id);
+
+-- The ledger: every movement of money is a journal entry with a debit and a credit posting of the same amount.
+-- A posting with NULL user_id belongs to the external world account.
+CREATE TABLE IF NOT EXISTS journal_entries
+(
+	id             INTEGER PRIMARY KEY AUTOINCREMENT,
+	tx_id          INTEGER UNIQUE REFERENCES tx_queues(id),
+	transfer_id    INTEGER UNIQUE REFERENCES transfers(id),
+	description    TEXT NOT NULL,
+	created_at     TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS postings
+(
+	id             INTEGER PRIMARY KEY AUTOINCREMENT,
+	entry_id       INTEGER NOT NULL REFERENCES journal_entries(id),
+	user_id        INTEGER REFERENCES users(id),
+	direction      TEXT NOT NULL CHECK (direction IN ('debit', 'credit')),
+	amount         INTEGER NOT NULL CHECK (NOT(amount < 0))
+);
+
+CREATE INDEX IF NOT EXISTS postings_user_id_idx ON postings (user_id);
+
+CREATE TRIGGER IF NOT EXISTS journal_entries_no_update BEFORE UPDATE ON journal_entries
+BEGIN
+	SELECT RAISE(ABORT, 'table journal_entries is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS journal_entries_no_delete BEFORE DELETE ON journal_entries
+BEGIN
+	SELECT RAISE(ABORT, 'table journal_entries is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS postings_no_update BEFORE UPDATE ON postings
+BEGIN
+	SELECT RAISE(ABORT, 'table postings is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS postings_no_delete BEFORE DELETE ON postings
+BEGIN
+	SELECT RAISE(ABORT, 'table postings is append-only');
+END;
+
+-- The running balance of the postings of every user, checked against the balance instead of summing all the postings.
+CREATE TABLE IF NOT EXISTS ledger_balances
+(
+	user_id        INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+	sum            INTEGER NOT NULL
+);
+
+CREATE TRIGGER IF NOT EXISTS postings_ledger_balance AFTER INSERT ON postings
+WHEN NEW.user_id IS NOT NULL
+BEGIN
+	INSERT INTO ledger_balances (user_id, sum)
+		VALUES (NEW.user_id, CASE NEW.direction WHEN 'credit' THEN NEW.amount ELSE -NEW.amount END)
+		ON CONFLICT (user_id) DO UPDATE SET sum = sum + excluded.sum;
+END;
+
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+	key            TEXT PRIMARY KEY,
+	user_id        INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	sum            INTEGER NOT NULL,
+	tx_id          INTEGER NOT NULL REFERENCES tx_queues(id) ON DELETE CASCADE,
+	transfer_id    INTEGER REFERENCES transfers(id) ON DELETE CASCADE,
+	created_at     TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at);
+
+CREATE TABLE IF NOT EXISTS tx_dead_letters
+(
+	id             INTEGER PRIMARY KEY AUTOINCREMENT,
+	tx_id          INTEGER NOT NULL REFERENCES tx_queues(id),
+	user_id        INTEGER NOT NULL REFERENCES users(id),
+	sum            INTEGER NOT NULL,
+	attempts       INTEGER NOT NULL,
+	last_error     TEXT NOT NULL,
+	created_at     TEXT NOT NULL,
+	resolved_at    TEXT,
+	resolution     TEXT CHECK (resolution IN ('requeued', 'discarded')),
+	CHECK ((resolved_at IS NULL) = (resolution IS NULL))
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS tx_dead_letters_unresolved_idx ON tx_dead_letters (tx_id) WHERE resolved_at IS NULL;
@@ -0,0 +1,958 @@
+// Package sqlite is an embedded storage in one SQLite file, with the same schema and semantics as the pg one,
+// for edge deployments and local demos. It uses a pure Go driver, so it needs no cgo and no db server.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"transactions/internal/model"
+	"transactions/internal/money"
+	"transactions/internal/pg"
+)
+
+// DSNScheme is the prefix of the connection strings of the SQLite storage: sqlite:///path/to/file.db
+const DSNScheme = "sqlite://"
+
+// schemaVersion is the version of schema.sql, it is stored as the user_version of the db file.
+const schemaVersion = 4
+
+// schemaUpgrades bring a db file of the previous version to the version of the key.
+// A new file gets schema.sql at once, so the upgrades run only on the files created by older builds.
+var schemaUpgrades = map[int]string{
+	2: `
+ALTER TABLE tx_queues ADD COLUMN currency TEXT;
+ALTER TABLE tx_queues ADD COLUMN description TEXT;
+ALTER TABLE tx_queues ADD COLUMN external_reference TEXT;
+`,
+	3: `
+CREATE TABLE IF NOT EXISTS ledger_balances
+(
+	user_id        INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+	sum            INTEGER NOT NULL
+);
+
+CREATE TRIGGER IF NOT EXISTS postings_ledger_balance AFTER INSERT ON postings
+WHEN NEW.user_id IS NOT NULL
+BEGIN
+	INSERT INTO ledger_balances (user_id, sum)
+		VALUES (NEW.user_id, CASE NEW.direction WHEN 'credit' THEN NEW.amount ELSE -NEW.amount END)
+		ON CONFLICT (user_id) DO UPDATE SET sum = sum + excluded.sum;
+END;
+
+INSERT INTO ledger_balances (user_id, sum)
+	SELECT user_id, sum(CASE direction WHEN 'credit' THEN amount ELSE -amount END) FROM postings
+	WHERE user_id IS NOT NULL GROUP BY user_id;
+`,
+	4: `
+ALTER TABLE tx_queues ADD COLUMN reject_code TEXT;
+UPDATE tx_queues SET reject_code = CASE reject_reason
+	WHEN 'insufficient funds' THEN 'insufficient_funds'
+	WHEN 'amount overflow' THEN 'balance_overflow'
+	WHEN 'discarded' THEN 'discarded'
+	END
+WHERE status = 'rejected' AND reject_code IS NULL;
+`,
+}
+
+//go:embed schema.sql
+var schema string
+
+// SQLite keeps the data in one db file. Every db transaction takes the write lock of the file when it begins
+// (BEGIN IMMEDIATE), so the queue of a user is processed by one caller at a time, like the pg storage does with its locks.
+// Several processes may share the file, but it must not be on a network file system.
+type SQLite struct {
+	db    *sql.DB
+	stmts *stmts
+}
+
+func New(dsn string) (newSQLite *SQLite, err error) {
+	log.Debug().Msg("sqlite.New START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("sqlite.New END")
+		} else {
+			log.Debug().Msg("sqlite.New END")
+		}
+	}()
+
+	path := strings.TrimPrefix(dsn, DSNScheme)
+	if path == dsn || path == "" {
+		return nil, fmt.Errorf("parsing dsn %q: expected %s/path/to/file.db", dsn, DSNScheme)
+	}
+
+	newSQLite = &SQLite{}
+
+	db, err := sql.Open("sqlite", "file:"+path+
+		"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+	if err != nil {
+		return nil, fmt.Errorf("opening sqlite db: %w", err)
+	}
+	newSQLite.db = db
+
+	// SQLite has one writer at a time anyway. With one connection the writers of this process queue up in the pool
+	// instead of spinning on the busy timeout.
+	newSQLite.db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+
+	if err = newSQLite.migrate(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating db: %w", err)
+	}
+
+	if err = prepareStmts(ctx, newSQLite); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("preparing stmts: %w", err)
+	}
+
+	return newSQLite, nil
+}
+
+// migrate creates the schema if the db file is new, upgrades it if it is older than this build,
+// and fails with pg.ErrUnknownSchemaVersion if it was created by a newer build.
+func (s *SQLite) migrate(ctx context.Context) (err error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err = tx.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("getting schema version: %w", err)
+	}
+
+	if version > schemaVersion {
+		return fmt.Errorf("schema version: %d: %w", version, pg.ErrUnknownSchemaVersion)
+	}
+	if version == schemaVersion {
+		return nil
+	}
+
+	if version == 0 {
+		if _, err = tx.ExecContext(ctx, schema); err != nil {
+			return fmt.Errorf("creating schema: %w", err)
+		}
+	} else {
+		for version++; version <= schemaVersion; version++ {
+			if _, err = tx.ExecContext(ctx, schemaUpgrades[version]); err != nil {
+				return fmt.Errorf("upgrading schema to version %d: %w", version, err)
+			}
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d`, schemaVersion)); err != nil {
+		return fmt.Errorf("setting schema version: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// now is the current time as it is stored, so the times returned by the methods equal the ones read back later.
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+// isConstraintViolation tells that err is a violation of the constraint of the SQLite result code,
+// with the constraint name in the message if the name is not empty.
+func isConstraintViolation(err error, code int, name string) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == code && strings.Contains(sqliteErr.Error(), name)
+}
+
+func (s *SQLite) InitFirstFiveUsersIfNotExistsForTestingApp() (err error) {
+	log.Debug().Msg("SQLite.InitFirstFiveUsersIfNotExistsForTestingApp START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("SQLite.InitFirstFiveUsersIfNotExistsForTestingApp END")
+		} else {
+			log.Debug().Msg("SQLite.InitFirstFiveUsersIfNotExistsForTestingApp END")
+		}
+	}()
+
+	var existsID int64
+	err = s.stmts.stmtGetUser.QueryRow(1).Scan(&existsID)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("users existence check: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for id := 1; id <= 5; id++ {
+		if err = s.addUser(context.Background(), tx, new(int64)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// AddUser adds a user with a zero balance and returns the ID of the user.
+func (s *SQLite) AddUser() (userID int64, err error) {
+	log.Debug().Msg("SQLite.AddUser START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("SQLite.AddUser END")
+		} else {
+			log.Debug().Msg("SQLite.AddUser END")
+		}
+	}()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err = s.addUser(context.Background(), tx, &userID); err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+func (s *SQLite) addUser(ctx context.Context, tx *sql.Tx, userID *int64) (err error) {
+
+	res, err := tx.StmtContext(ctx, s.stmts.stmtAddUser).ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("creating user: %w", err)
+	}
+
+	if *userID, err = res.LastInsertId(); err != nil {
+		return fmt.Errorf("creating user: %w", err)
+	}
+
+	if _, err = tx.StmtContext(ctx, s.stmts.stmtCreateStartingBalance).ExecContext(ctx, *userID); err != nil {
+		return fmt.Errorf("creating user start balance: %w", err)
+	}
+
+	return nil
+}
+
+// AddTx queues a transaction for the user with its details, see pg.Pg.AddTx.
+func (s *SQLite) AddTx(ctx context.Context, userID int64, sum money.Amount, details model.TxDetails, idempotencyKey string) (txID int64, isReplay bool, err error) {
+	log.Debug().Msg("SQLite.AddTx START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("SQLite.AddTx END")
+		} else {
+			log.Debug().Msg("SQLite.AddTx END")
+		}
+	}()
+
+	if idempotencyKey != "" {
+		if txID, isReplay, err = s.getTxByIdempotencyKey(ctx, idempotencyKey, userID, sum); err != nil || isReplay {
+			return txID, isReplay, err
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	createdAt := formatTime(now())
+
+	err = tx.StmtContext(ctx, s.stmts.stmtAddTx).QueryRowContext(ctx, userID, sum, createdAt,
+		details.Currency, details.Description, details.ExternalReference).Scan(&txID)
+	if err != nil {
+		if isConstraintViolation(err, sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY, "") {
+			return 0, false, fmt.Errorf("adding a transaction to the user's queue: userID: %d: %w", userID, pg.ErrUserNotFound)
+		}
+		return 0, false, fmt.Errorf("adding a transaction to the user's queue: userID: %d: %w", userID, err)
+	}
+
+	if idempotencyKey != "" {
+		res, err := tx.StmtContext(ctx, s.stmts.stmtAddIdempotencyKey).
+			ExecContext(ctx, idempotencyKey, userID, sum, txID, nil, createdAt)
+		if err != nil {
+			return 0, false, fmt.Errorf("adding idempotency key: userID: %d: %w", userID, err)
+		}
+		added, err := res.RowsAffected()
+		if err != nil {
+			return 0, false, fmt.Errorf("adding idempotency key: userID: %d: %w", userID, err)
+		}
+		if added == 0 {
+			// Another process sharing the file has queued its transaction with the same key first.
+			tx.Rollback()
+			return s.getTxByIdempotencyKey(ctx, idempotencyKey, userID, sum)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, false, err
+	}
+
+	return txID, false, nil
+}
+
+func (s *SQLite) getTxByIdempotencyKey(ctx context.Context, idempotencyKey string, userID int64, sum money.Amount) (txID int64, isFound bool, err error) {
+
+	var keyUserID int64
+	var keySum money.Amount
+	var keyTransferID sql.NullInt64
+	err = s.stmts.stmtGetIdempotencyKey.QueryRowContext(ctx, idempotencyKey).
+		Scan(&keyUserID, &keySum, &txID, &keyTransferID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("getting idempotency key: userID: %d: %w", userID, err)
+	}
+
+	if keyUserID != userID || keySum != sum || keyTransferID.Valid {
+		return 0, false, fmt.Errorf("userID: %d: %w", userID, pg.ErrIdempotencyKeyReused)
+	}
+
+	return txID, true, nil
+}
+
+// Transfer moves the amount from one user to another in one database transaction, see pg.Pg.Transfer.
+func (s *SQLite) Transfer(ctx context.Context, fromUserID, toUserID int64, amount money.Amount, idempotencyKey string) (transfer model.Transfer, isReplay bool, err error) {
+	log.Debug().Msg("SQLite.Transfer START")
+	defer func() {
+		if err != nil {
+			if errors.Is(err, pg.ErrInsufficientFunds) {
+				log.Info().Err(err).Msg("SQLite.Transfer END")
+			} else {
+				log.Error().Err(err).Msg("SQLite.Transfer END")
+			}
+		} else {
+			log.Debug().Msg("SQLite.Transfer END")
+		}
+	}()
+
+	if idempotencyKey != "" {
+		if transfer, isReplay, err = s.getTransferByIdempotencyKey(ctx, idempotencyKey, fromUserID, toUserID, amount); err != nil || isReplay {
+			return transfer, isReplay, err
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Transfer{}, false, err
+	}
+	defer tx.Rollback()
+
+	balances, err := s.getBalances(ctx, tx, fromUserID, toUserID)
+	if err != nil {
+		return model.Transfer{}, false, err
+	}
+
+	fromBalance, err := balances[fromUserID].Add(amount.Neg())
+	if err != nil {
+		return model.Transfer{}, false, fmt.Errorf("debiting user: userID: %d: %w", fromUserID, err)
+	}
+	if fromBalance < 0 {
+		return model.Transfer{}, false, fmt.Errorf("debiting user: userID: %d: %w", fromUserID, pg.ErrInsufficientFunds)
+	}
+	toBalance, err := balances[toUserID].Add(amount)
+	if err != nil {
+		return model.Transfer{}, false, fmt.Errorf("crediting user: userID: %d: %w", toUserID, err)
+	}
+
+	transfer = model.Transfer{FromUserID: fromUserID, ToUserID: toUserID, Amount: amount, FromBalanceAfter: fromBalance, CreatedAt: now()}
+	createdAt := formatTime(transfer.CreatedAt)
+	err = tx.StmtContext(ctx, s.stmts.stmtAddTransfer).QueryRowContext(ctx, fromUserID, toUserID, amount, createdAt).
+		Scan(&transfer.ID)
+	if err != nil {
+		return model.Transfer{}, false, fmt.Errorf("adding transfer: from: %d: to: %d: %w", fromUserID, toUserID, err)
+	}
+
+	var fromTxID int64
+	for _, side := range []struct {
+		userID       int64
+		sum          money.Amount
+		balanceAfter money.Amount
+		txID         *int64
+	}{
+		{userID: fromUserID, sum: amount.Neg(), balanceAfter: fromBalance, txID: &fromTxID},
+		{userID: toUserID, sum: amount, balanceAfter: toBalance, txID: new(int64)},
+	} {
+		_, err = tx.StmtContext(ctx, s.stmts.stmtChangeBalance).ExecContext(ctx, side.userID, side.sum)
+		if err != nil {
+			return model.Transfer{}, false, fmt.Errorf("changing user balance: userID: %d: %w", side.userID, err)
+		}
+		err = tx.StmtContext(ctx, s.stmts.stmtAddTransferTx).
+			QueryRowContext(ctx, side.userID, side.sum, side.balanceAfter, createdAt, transfer.ID).Scan(side.txID)
+		if err != nil {
+			return model.Transfer{}, false, fmt.Errorf("adding transfer transaction: userID: %d: %w", side.userID, err)
+		}
+	}
+
+	from := sql.NullInt64{Int64: fromUserID, Valid: true}
+	to := sql.NullInt64{Int64: toUserID, Valid: true}
+	if err = s.postJournalEntry(ctx, tx, sql.NullInt64{}, sql.NullInt64{Int64: transfer.ID, Valid: true},
+		entryDescriptionTransfer, from, to, amount); err != nil {
+		return model.Transfer{}, false, fmt.Errorf("posting journal entry: transferID: %d: %w", transfer.ID, err)
+	}
+
+	for _, userID := range []int64{fromUserID, toUserID} {
+		if err = s.checkBalanceAgainstLedger(ctx, tx, userID); err != nil {
+			return model.Transfer{}, false, err
+		}
+	}
+
+	if idempotencyKey != "" {
+		res, err := tx.StmtContext(ctx, s.stmts.stmtAddIdempotencyKey).
+			ExecContext(ctx, idempotencyKey, fromUserID, amount.Neg(), fromTxID, transfer.ID, createdAt)
+		if err != nil {
+			return model.Transfer{}, false, fmt.Errorf("adding idempotency key: userID: %d: %w", fromUserID, err)
+		}
+		added, err := res.RowsAffected()
+		if err != nil {
+			return model.Transfer{}, false, fmt.Errorf("adding idempotency key: userID: %d: %w", fromUserID, err)
+		}
+		if added == 0 {
+			// Another process sharing the file has made its transfer with the same key first.
+			tx.Rollback()
+			return s.getTransferByIdempotencyKey(ctx, idempotencyKey, fromUserID, toUserID, amount)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return model.Transfer{}, false, err
+	}
+
+	return transfer, false, nil
+}
+
+func (s *SQLite) getBalances(ctx context.Context, tx *sql.Tx, firstUserID, secondUserID int64) (balances map[int64]money.Amount, err error) {
+
+	rows, err := tx.StmtContext(ctx, s.stmts.stmtGetBalancesOfUsers).QueryContext(ctx, firstUserID, secondUserID)
+	if err != nil {
+		return nil, fmt.Errorf("getting users balances: %w", err)
+	}
+	defer rows.Close()
+
+	balances = map[int64]money.Amount{}
+	for rows.Next() {
+		var userID int64
+		var balance money.Amount
+		if err = rows.Scan(&userID, &balance); err != nil {
+			return nil, fmt.Errorf("reading users balances: %w", err)
+		}
+		balances[userID] = balance
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading users balances: %w", err)
+	}
+
+	for _, userID := range []int64{firstUserID, secondUserID} {
+		if _, ok := balances[userID]; !ok {
+			return nil, fmt.Errorf("getting user balance: userID: %d: %w", userID, pg.ErrUserNotFound)
+		}
+	}
+
+	return balances, nil
+}
+
+func (s *SQLite) getTransferByIdempotencyKey(ctx context.Context, idempotencyKey string, fromUserID, toUserID int64, amount money.Amount) (transfer model.Transfer, isFound bool, err error) {
+
+	var keyUserID, keyTxID int64
+	var keySum money.Amount
+	var keyTransferID sql.NullInt64
+	err = s.stmts.stmtGetIdempotencyKey.QueryRowContext(ctx, idempotencyKey).
+		Scan(&keyUserID, &keySum, &keyTxID, &keyTransferID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Transfer{}, false, nil
+		}
+		return model.Transfer{}, false, fmt.Errorf("getting idempotency key: userID: %d: %w", fromUserID, err)
+	}
+
+	if !keyTransferID.Valid {
+		return model.Transfer{}, false, fmt.Errorf("userID: %d: %w", fromUserID, pg.ErrIdempotencyKeyReused)
+	}
+
+	err = s.stmts.stmtGetTransfer.QueryRowContext(ctx, keyTransferID.Int64).Scan(&transfer.ID,
+		&transfer.FromUserID, &transfer.ToUserID, &transfer.Amount, &transfer.FromBalanceAfter, timeScanner{&transfer.CreatedAt})
+	if err != nil {
+		return model.Transfer{}, false, fmt.Errorf("getting transfer: transferID: %d: %w", keyTransferID.Int64, err)
+	}
+
+	if transfer.FromUserID != fromUserID || transfer.ToUserID != toUserID || transfer.Amount != amount {
+		return model.Transfer{}, false, fmt.Errorf("userID: %d: %w", fromUserID, pg.ErrIdempotencyKeyReused)
+	}
+
+	return transfer, true, nil
+}
+
+// DeleteIdempotencyKeysCreatedBefore deletes the expired idempotency keys.
+func (s *SQLite) DeleteIdempotencyKeysCreatedBefore(ctx context.Context, before time.Time) (deleted int64, err error) {
+	log.Debug().Msg("SQLite.DeleteIdempotencyKeysCreatedBefore START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("SQLite.DeleteIdempotencyKeysCreatedBefore END")
+		} else {
+			log.Debug().Msg("SQLite.DeleteIdempotencyKeysCreatedBefore END")
+		}
+	}()
+
+	res, err := s.stmts.stmtDeleteIdempotencyKeysCreatedBefore.ExecContext(ctx, formatTime(before))
+	if err != nil {
+		return 0, fmt.Errorf("deleting idempotency keys created before %s: %w", before, err)
+	}
+
+	deleted, err = res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("deleting idempotency keys created before %s: %w", before, err)
+	}
+
+	return deleted, nil
+}
+
+// txScanDest is the scan destination of the columns of a transaction selected by queryGetTx and queryGetTxsByFilter.
+func txScanDest(tx *model.Tx) []any {
+	return []any{&tx.ID, &tx.UserID, &tx.Sum, &tx.Status, &tx.RejectReason, &tx.RejectCode, &tx.BalanceAfter,
+		timeScanner{&tx.CreatedAt}, nullTimeScanner{&tx.ProcessedAt}, &tx.TransferID,
+		&tx.Attempts, &tx.LastError, nullTimeScanner{&tx.NextAttemptAt},
+		&tx.Currency, &tx.Description, &tx.ExternalReference}
+}
+
+func (s *SQLite) GetTx(ctx context.Context, txID int64) (tx model.Tx, err error) {
+	log.Debug().Msg("SQLite.GetTx START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("SQLite.GetTx END")
+		} else {
+			log.Debug().Msg("SQLite.GetTx END")
+		}
+	}()
+
+	err = s.stmts.stmtGetTx.QueryRowContext(ctx, txID).Scan(txScanDest(&tx)...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Tx{}, fmt.Errorf("getting transaction: txID: %d: %w", txID, pg.ErrTxNotFound)
+		}
+		return model.Tx{}, fmt.Errorf("getting transaction: txID: %d: %w", txID, err)
+	}
+
+	return tx, nil
+}
+
+func (s *SQLite) GetTxs(ctx context.Context, filter model.TxFilter) (txs []model.Tx, err error) {
+	log.Debug().Msg("SQLite.GetTxs START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("SQLite.GetTxs END")
+		} else {
+			log.Debug().Msg("SQLite.GetTxs END")
+		}
+	}()
+
+	cursor := sql.NullInt64{Int64: filter.Cursor, Valid: filter.Cursor != 0}
+	txType := sql.NullString{String: string(filter.Type), Valid: filter.Type != ""}
+	status := sql.NullString{String: string(filter.Status), Valid: filter.Status != ""}
+
+	rows, err := s.stmts.stmtGetTxsByFilter.QueryContext(ctx, filter.UserID, cursor, txType, status,
+		filter.MinAmount, filter.MaxAmount, nullTime(filter.CreatedFrom), nullTime(filter.CreatedTo), filter.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("getting transactions by filter: userID: %d: %w", filter.UserID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tx model.Tx
+		if err = rows.Scan(txScanDest(&tx)...); err != nil {
+			return nil, fmt.Errorf("reading transactions by filter: userID: %d: %w", filter.UserID, err)
+		}
+		txs = append(txs, tx)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading transactions by filter: userID: %d: %w", filter.UserID, err)
+	}
+
+	return txs, nil
+}
+
+func (s *SQLite) GetBalance(ctx context.Context, userID int64) (balance model.Balance, err error) {
+	log.Debug().Msg("SQLite.GetBalance START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("SQLite.GetBalance END")
+		} else {
+			log.Debug().Msg("SQLite.GetBalance END")
+		}
+	}()
+
+	balance.UserID = userID
+
+	err = s.stmts.stmtGetBalance.QueryRowContext(ctx, userID).
+		Scan(&balance.Settled, &balance.PendingReceipts, &balance.PendingWithdrawals)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Balance{}, fmt.Errorf("getting user balance: userID: %d: %w", userID, pg.ErrUserNotFound)
+		}
+		return model.Balance{}, fmt.Errorf("getting user balance: userID: %d: %w", userID, err)
+	}
+
+	return balance, nil
+}
+
+func (s *SQLite) GetUsersWithNonEmptyTxQueues(ctx context.Context) (users []int64, err error) {
+	log.Debug().Msg("SQLite.GetUsersWithNonEmptyTxQueues START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("SQLite.GetUsersWithNonEmptyTxQueues END")
+		} else {
+			log.Debug().Msg("SQLite.GetUsersWithNonEmptyTxQueues END")
+		}
+	}()
+
+	rows, err := s.stmts.stmtGetUsersWithNonEmptyTxQueues.QueryContext(ctx, formatTime(now()))
+	if err != nil {
+		return nil, fmt.Errorf("getting users with non empty tx queues: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var currUser int64
+		if err = rows.Scan(&currUser); err != nil {
+			return nil, fmt.Errorf("reading users with non empty tx queues: %w", err)
+		}
+		users = append(users, currUser)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading users with non empty tx queues: %w", err)
+	}
+
+	return users, nil
+}
+
+// ProcessTxQueue processes the pending transactions of the user one by one in FIFO order, see pg.Pg.ProcessTxQueue.
+func (s *SQLite) ProcessTxQueue(ctx context.Context, userID int64) (processed []model.Tx, err error) {
+	log.Debug().Msg("SQLite.ProcessTxQueue START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("SQLite.ProcessTxQueue END")
+		} else {
+			log.Debug().Msg("SQLite.ProcessTxQueue END")
+		}
+	}()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var balance money.Amount
+	err = tx.StmtContext(ctx, s.stmts.stmtGetBalanceOfUser).QueryRowContext(ctx, userID).Scan(&balance)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("getting user balance: userID: %d: %w", userID, pg.ErrUserNotFound)
+		}
+		return nil, fmt.Errorf("getting user balance: userID: %d: %w", userID, err)
+	}
+
+	processedAt := now()
+
+	pending, isBackingOff, err := s.getPendingTxs(ctx, tx, userID, processedAt)
+	if err != nil {
+		return nil, err
+	}
+	if isBackingOff {
+		return nil, fmt.Errorf("processing tx queue: userID: %d: txID: %d: %w", userID, pending[0].ID, pg.ErrTxQueueIsBackingOff)
+	}
+
+	startBalance := balance
+	for _, currTx := range pending {
+
+		newBalance, errAdd := balance.Add(currTx.Sum)
+		switch {
+		case errAdd != nil:
+			currTx.Status, currTx.RejectCode, currTx.RejectReason = model.TxStatusRejected, model.RejectCodeBalanceOverflow, errAdd.Error()
+		case newBalance < 0:
+			currTx.Status, currTx.RejectCode, currTx.RejectReason = model.TxStatusRejected, model.RejectCodeInsufficientFunds, pg.ErrInsufficientFunds.Error()
+		default:
+			if err = s.postTx(ctx, tx, currTx.ID, userID, currTx.Sum); err != nil {
+				return nil, err
+			}
+			currTx.Status = model.TxStatusApplied
+			balance = newBalance
+		}
+
+		balanceAfter := balance
+		currTx.BalanceAfter = &balanceAfter
+		currTx.ProcessedAt = &processedAt
+
+		rejectReason := sql.NullString{String: currTx.RejectReason, Valid: currTx.RejectReason != ""}
+		rejectCode := sql.NullString{String: string(currTx.RejectCode), Valid: currTx.RejectCode != ""}
+		_, err = tx.StmtContext(ctx, s.stmts.stmtSetTxStatus).
+			ExecContext(ctx, currTx.ID, currTx.Status, rejectReason, balanceAfter, formatTime(processedAt), rejectCode)
+		if err != nil {
+			return nil, fmt.Errorf("setting transaction status: txID: %d: %w", currTx.ID, err)
+		}
+
+		processed = append(processed, currTx)
+	}
+
+	_, err = tx.StmtContext(ctx, s.stmts.stmtChangeBalance).ExecContext(ctx, userID, balance-startBalance)
+	if err != nil {
+		if isConstraintViolation(err, sqlite3.SQLITE_CONSTRAINT_CHECK, "balance_sum_check") {
+			return nil, fmt.Errorf("changing user balance: userID: %d: %w", userID, pg.ErrInsufficientFunds)
+		}
+		return nil, fmt.Errorf("changing user balance: userID: %d: %w", userID, err)
+	}
+
+	if err = s.checkBalanceAgainstLedger(ctx, tx, userID); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return processed, nil
+
+}
+
+// getPendingTxs returns the pending transactions of the user in FIFO order.
+// isBackingOff tells that the oldest of them waits for its next attempt after a failure, so the queue must not be processed yet.
+func (s *SQLite) getPendingTxs(ctx context.Context, tx *sql.Tx, userID int64, at time.Time) (pending []model.Tx, isBackingOff bool, err error) {
+
+	txRows, err := tx.StmtContext(ctx, s.stmts.stmtGetPendingTxsByUser).QueryContext(ctx, userID, formatTime(at))
+	if err != nil {
+		return nil, false, fmt.Errorf("getting pending transactions by user: userID: %d: %w", userID, err)
+	}
+	defer txRows.Close()
+
+	for txRows.Next() {
+		currTx := model.Tx{UserID: userID, Status: model.TxStatusPending}
+		var currIsBackingOff bool
+		if err = txRows.Scan(&currTx.ID, &currTx.Sum, timeScanner{&currTx.CreatedAt}, &currTx.Attempts, &currIsBackingOff); err != nil {
+			return nil, false, fmt.Errorf("reading pending transactions by user: userID: %d: %w", userID, err)
+		}
+		if len(pending) == 0 {
+			isBackingOff = currIsBackingOff
+		}
+		pending = append(pending, currTx)
+	}
+
+	if err = txRows.Err(); err != nil {
+		return nil, false, fmt.Errorf("reading pending transactions by user: userID: %d: %w", userID, err)
+	}
+
+	return pending, isBackingOff, nil
+}
+
+// RecordTxQueueFailure counts a failed run of processing of the user's tx queue against the oldest pending transaction of it,
+// see pg.Pg.RecordTxQueueFailure.
+func (s *SQLite) RecordTxQueueFailure(ctx context.Context, userID int64, reason string, policy model.RetryPolicy) (failed model.Tx, err error) {
+	log.Debug().Msg("SQLite.RecordTxQueueFailure START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("SQLite.RecordTxQueueFailure END")
+		} else {
+			log.Debug().Msg("SQLite.RecordTxQueueFailure END")
+		}
+	}()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Tx{}, err
+	}
+	defer tx.Rollback()
+
+	failedAt := now()
+
+	pending, _, err := s.getPendingTxs(ctx, tx, userID, failedAt)
+	if err != nil {
+		return model.Tx{}, err
+	}
+	if len(pending) == 0 {
+		return model.Tx{}, fmt.Errorf("getting the oldest pending transaction: userID: %d: %w", userID, pg.ErrTxNotFound)
+	}
+
+	failed = pending[0]
+	failed.Attempts++
+	failed.LastError = reason
+
+	if failed.Attempts >= policy.MaxAttempts {
+		_, err = tx.StmtContext(ctx, s.stmts.stmtSetTxDeadLettered).
+			ExecContext(ctx, failed.ID, failed.Attempts, reason, formatTime(failedAt))
+		if err != nil {
+			return model.Tx{}, fmt.Errorf("dead-lettering transaction: txID: %d: %w", failed.ID, err)
+		}
+		_, err = tx.StmtContext(ctx, s.stmts.stmtAddDeadLetter).
+			ExecContext(ctx, failed.ID, userID, failed.Sum, failed.Attempts, reason, formatTime(failedAt))
+		if err != nil {
+			return model.Tx{}, fmt.Errorf("adding dead letter: txID: %d: %w", failed.ID, err)
+		}
+		failed.Status = model.TxStatusDeadLettered
+	} else {
+		nextAttemptAt := failedAt.Add(policy.Delay(failed.Attempts))
+		failed.NextAttemptAt = &nextAttemptAt
+		_, err = tx.StmtContext(ctx, s.stmts.stmtSetTxRetry).
+			ExecContext(ctx, failed.ID, failed.Attempts, reason, formatTime(nextAttemptAt))
+		if err != nil {
+			return model.Tx{}, fmt.Errorf("setting transaction retry: txID: %d: %w", failed.ID, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return model.Tx{}, err
+	}
+
+	return failed, nil
+}
+
+// deadLetterScanDest is the scan destination of the columns of a dead letter selected by queryGetDeadLetters and queryGetDeadLetter.
+func deadLetterScanDest(deadLetter *model.DeadLetter) []any {
+	return []any{&deadLetter.ID, &deadLetter.TxID, &deadLetter.UserID, &deadLetter.Sum, &deadLetter.Attempts,
+		&deadLetter.LastError, timeScanner{&deadLetter.CreatedAt}, nullTimeScanner{&deadLetter.ResolvedAt}, &deadLetter.Resolution}
+}
+
+// GetDeadLetters returns a page of the unresolved dead letters, oldest first.
+// cursor is the ID of the last dead letter of the previous page.
+func (s *SQLite) GetDeadLetters(ctx context.Context, cursor int64, limit int) (deadLetters []model.DeadLetter, err error) {
+	log.Debug().Msg("SQLite.GetDeadLetters START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("SQLite.GetDeadLetters END")
+		} else {
+			log.Debug().Msg("SQLite.GetDeadLetters END")
+		}
+	}()
+
+	rows, err := s.stmts.stmtGetDeadLetters.QueryContext(ctx, cursor, limit)
+	if err != nil {
+		return nil, fmt.Errorf("getting dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var deadLetter model.DeadLetter
+		if err = rows.Scan(deadLetterScanDest(&deadLetter)...); err != nil {
+			return nil, fmt.Errorf("reading dead letters: %w", err)
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading dead letters: %w", err)
+	}
+
+	return deadLetters, nil
+}
+
+// RequeueDeadLetter puts the transaction of the dead letter back to its user's queue as pending, with no failed attempts.
+// It keeps its place in the queue, so it is processed before the transactions queued after it that are still pending.
+func (s *SQLite) RequeueDeadLetter(ctx context.Context, deadLetterID int64) (deadLetter model.DeadLetter, err error) {
+	log.Debug().Msg("SQLite.RequeueDeadLetter START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("SQLite.RequeueDeadLetter END")
+		} else {
+			log.Debug().Msg("SQLite.RequeueDeadLetter END")
+		}
+	}()
+
+	return s.resolveDeadLetter(ctx, deadLetterID, model.DeadLetterResolutionRequeued, func(tx *sql.Tx, txID int64, _ string) error {
+		_, err := tx.StmtContext(ctx, s.stmts.stmtRequeueTx).ExecContext(ctx, txID)
+		return err
+	})
+}
+
+// DiscardDeadLetter rejects the transaction of the dead letter, so it never moves money.
+func (s *SQLite) DiscardDeadLetter(ctx context.Context, deadLetterID int64) (deadLetter model.DeadLetter, err error) {
+	log.Debug().Msg("SQLite.DiscardDeadLetter START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("SQLite.DiscardDeadLetter END")
+		} else {
+			log.Debug().Msg("SQLite.DiscardDeadLetter END")
+		}
+	}()
+
+	return s.resolveDeadLetter(ctx, deadLetterID, model.DeadLetterResolutionDiscarded, func(tx *sql.Tx, txID int64, resolvedAt string) error {
+		_, err := tx.StmtContext(ctx, s.stmts.stmtDiscardTx).
+			ExecContext(ctx, txID, string(model.DeadLetterResolutionDiscarded), resolvedAt, model.RejectCodeDiscarded)
+		return err
+	})
+}
+
+func (s *SQLite) resolveDeadLetter(ctx context.Context, deadLetterID int64, resolution model.DeadLetterResolution,
+	resolveTx func(tx *sql.Tx, txID int64, resolvedAt string) error) (deadLetter model.DeadLetter, err error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.DeadLetter{}, err
+	}
+	defer tx.Rollback()
+
+	err = tx.StmtContext(ctx, s.stmts.stmtGetDeadLetter).QueryRowContext(ctx, deadLetterID).Scan(deadLetterScanDest(&deadLetter)...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.DeadLetter{}, fmt.Errorf("getting dead letter: id: %d: %w", deadLetterID, pg.ErrDeadLetterNotFound)
+		}
+		return model.DeadLetter{}, fmt.Errorf("getting dead letter: id: %d: %w", deadLetterID, err)
+	}
+
+	if deadLetter.ResolvedAt != nil {
+		return model.DeadLetter{}, fmt.Errorf("resolving dead letter: id: %d: %w: %s", deadLetterID, pg.ErrDeadLetterIsResolved, deadLetter.Resolution)
+	}
+
+	resolvedAt := now()
+
+	if err = resolveTx(tx, deadLetter.TxID, formatTime(resolvedAt)); err != nil {
+		return model.DeadLetter{}, fmt.Errorf("resolving dead letter transaction: txID: %d: %w", deadLetter.TxID, err)
+	}
+
+	_, err = tx.StmtContext(ctx, s.stmts.stmtResolveDeadLetter).ExecContext(ctx, deadLetterID, formatTime(resolvedAt), resolution)
+	if err != nil {
+		return model.DeadLetter{}, fmt.Errorf("resolving dead letter: id: %d: %w", deadLetterID, err)
+	}
+	deadLetter.ResolvedAt, deadLetter.Resolution = &resolvedAt, resolution
+
+	if err = tx.Commit(); err != nil {
+		return model.DeadLetter{}, err
+	}
+
+	return deadLetter, nil
+}
+
+func (s *SQLite) Close() (err error) {
+	log.Debug().Msg("SQLite.Close START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("SQLite.Close END")
+		} else {
+			log.Debug().Msg("SQLite.Close END")
+		}
+	}()
+
+	err = s.db.Close()
+	if err != nil {
+		return fmt.Errorf("close connection with db: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,18 @@
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"transactions/internal/sqlite"
+	"transactions/internal/storagetest"
+)
+
+func TestSQLite(t *testing.T) {
+
+	dsn := sqlite.DSNScheme + filepath.Join(t.TempDir(), "transactions.db")
+
+	storagetest.Run(t, func() (storagetest.Storage, error) {
+		return sqlite.New(dsn)
+	})
+}
@@ -0,0 +1,209 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The queries mirror the ones of the pg storage. Timestamps are always passed from Go, see timestamps.go,
+// and there are no row locks: every db transaction takes the write lock of the whole db when it begins.
+const (
+	queryAddUser = `INSERT INTO users DEFAULT VALUES`
+	queryGetUser = `SELECT id FROM users WHERE id = ?1`
+
+	queryCreateStartingBalance = `INSERT INTO balance (user_id, sum) VALUES (?1, 0)`
+	queryChangeBalance         = `UPDATE balance SET sum = sum + ?2 WHERE user_id = ?1`
+	queryGetBalanceOfUser      = `SELECT sum FROM balance WHERE user_id = ?1`
+	queryGetBalance            = `
+SELECT b.sum,
+	COALESCE(sum(q.sum) FILTER (WHERE q.sum > 0), 0),
+	COALESCE(-sum(q.sum) FILTER (WHERE q.sum < 0), 0)
+FROM balance b
+LEFT JOIN tx_queues q ON q.user_id = b.user_id AND q.status = 'pending'
+WHERE b.user_id = ?1
+GROUP BY b.sum
+`
+
+	queryAddTx = `INSERT INTO tx_queues (user_id, sum, created_at, currency, description, external_reference)
+		VALUES (?1, ?2, ?3, NULLIF(?4, ''), NULLIF(?5, ''), NULLIF(?6, '')) RETURNING id`
+	queryGetTx = `SELECT id, user_id, sum, status, COALESCE(reject_reason, ''), COALESCE(reject_code, ''), balance_after, created_at, processed_at, transfer_id,
+		attempts, COALESCE(last_error, ''), next_attempt_at,
+		COALESCE(currency, ''), COALESCE(description, ''), COALESCE(external_reference, '')
+		FROM tx_queues WHERE id = ?1`
+	queryGetPendingTxsByUser = `SELECT id, sum, created_at, attempts, COALESCE(next_attempt_at > ?2, 0)
+		FROM tx_queues WHERE user_id = ?1 AND status = 'pending' ORDER BY id`
+	querySetTxStatus = `UPDATE tx_queues SET status = ?2, reject_code = ?6, reject_reason = ?3, balance_after = ?4, processed_at = ?5
+		WHERE id = ?1`
+	// The queues whose oldest pending transaction waits for its next attempt are skipped.
+	queryGetUsersWithNonEmptyTxQueues = `SELECT user_id FROM tx_queues WHERE id IN (
+		SELECT min(id) FROM tx_queues WHERE status = 'pending' GROUP BY user_id
+	) AND COALESCE(next_attempt_at, '') <= ?1`
+	querySetTxRetry        = `UPDATE tx_queues SET attempts = ?2, last_error = ?3, next_attempt_at = ?4 WHERE id = ?1`
+	querySetTxDeadLettered = `UPDATE tx_queues SET status = 'dead_lettered', attempts = ?2, last_error = ?3, next_attempt_at = NULL,
+		processed_at = ?4 WHERE id = ?1`
+	queryRequeueTx = `UPDATE tx_queues SET status = 'pending', attempts = 0, last_error = NULL, next_attempt_at = NULL, processed_at = NULL
+		WHERE id = ?1 AND status = 'dead_lettered'`
+	queryDiscardTx = `UPDATE tx_queues SET status = 'rejected', reject_code = ?4, reject_reason = ?2, processed_at = ?3
+		WHERE id = ?1 AND status = 'dead_lettered'`
+	queryGetTxsByFilter = `
+SELECT id, user_id, sum, status, COALESCE(reject_reason, ''), COALESCE(reject_code, ''), balance_after, created_at, processed_at, transfer_id,
+	attempts, COALESCE(last_error, ''), next_attempt_at,
+	COALESCE(currency, ''), COALESCE(description, ''), COALESCE(external_reference, '')
+FROM tx_queues
+WHERE user_id = ?1
+	AND (?2 IS NULL OR id < ?2)
+	AND (?3 IS NULL OR (?3 = 'receipt' AND sum >= 0) OR (?3 = 'withdraw' AND sum < 0))
+	AND (?4 IS NULL OR status = ?4)
+	AND (?5 IS NULL OR abs(sum) >= ?5)
+	AND (?6 IS NULL OR abs(sum) <= ?6)
+	AND (?7 IS NULL OR created_at >= ?7)
+	AND (?8 IS NULL OR created_at < ?8)
+ORDER BY id DESC
+LIMIT ?9
+`
+
+	queryAddJournalEntry           = `INSERT INTO journal_entries (tx_id, transfer_id, description, created_at) VALUES (?1, ?2, ?3, ?4) RETURNING id`
+	queryAddPostings               = `INSERT INTO postings (entry_id, user_id, direction, amount) VALUES (?1, ?2, 'debit', ?4), (?1, ?3, 'credit', ?4)`
+	queryCheckBalanceAgainstLedger = `
+SELECT b.sum = COALESCE(l.sum, 0)
+FROM balance b LEFT JOIN ledger_balances l ON l.user_id = b.user_id
+WHERE b.user_id = ?1
+`
+	queryAuditLedger = `
+SELECT b.user_id
+FROM balance b
+LEFT JOIN (
+	SELECT user_id, sum(CASE direction WHEN 'credit' THEN amount ELSE -amount END) AS sum
+	FROM postings WHERE user_id IS NOT NULL GROUP BY user_id
+) p ON p.user_id = b.user_id
+LEFT JOIN ledger_balances l ON l.user_id = b.user_id
+WHERE b.sum <> COALESCE(p.sum, 0) OR COALESCE(l.sum, 0) <> COALESCE(p.sum, 0)
+ORDER BY b.user_id
+`
+
+	queryAddIdempotencyKey = `INSERT INTO idempotency_keys (key, user_id, sum, tx_id, transfer_id, created_at) VALUES (?1, ?2, ?3, ?4, ?5, ?6)
+		ON CONFLICT (key) DO NOTHING`
+	queryGetIdempotencyKey                  = `SELECT user_id, sum, tx_id, transfer_id FROM idempotency_keys WHERE key = ?1`
+	queryDeleteIdempotencyKeysCreatedBefore = `DELETE FROM idempotency_keys WHERE created_at < ?1`
+
+	queryAddTransfer = `INSERT INTO transfers (from_user_id, to_user_id, sum, created_at) VALUES (?1, ?2, ?3, ?4) RETURNING id`
+	queryGetTransfer = `
+SELECT t.id, t.from_user_id, t.to_user_id, t.sum, q.balance_after, t.created_at
+FROM transfers t
+JOIN tx_queues q ON q.transfer_id = t.id AND q.user_id = t.from_user_id
+WHERE t.id = ?1
+`
+	queryAddTransferTx = `INSERT INTO tx_queues (user_id, sum, status, balance_after, created_at, processed_at, transfer_id)
+		VALUES (?1, ?2, 'applied', ?3, ?4, ?4, ?5) RETURNING id`
+	queryGetBalancesOfUsers = `SELECT user_id, sum FROM balance WHERE user_id IN (?1, ?2)`
+
+	queryAddDeadLetter = `INSERT INTO tx_dead_letters (tx_id, user_id, sum, attempts, last_error, created_at)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6)`
+	queryGetDeadLetters = `SELECT id, tx_id, user_id, sum, attempts, last_error, created_at, resolved_at, COALESCE(resolution, '')
+		FROM tx_dead_letters WHERE resolved_at IS NULL AND id > ?1 ORDER BY id LIMIT ?2`
+	queryGetDeadLetter = `SELECT id, tx_id, user_id, sum, attempts, last_error, created_at, resolved_at, COALESCE(resolution, '')
+		FROM tx_dead_letters WHERE id = ?1`
+	queryResolveDeadLetter = `UPDATE tx_dead_letters SET resolved_at = ?2, resolution = ?3 WHERE id = ?1`
+)
+
+type stmts struct {
+	stmtAddUser *sql.Stmt
+	stmtGetUser *sql.Stmt
+
+	stmtCreateStartingBalance *sql.Stmt
+	stmtChangeBalance         *sql.Stmt
+	stmtGetBalanceOfUser      *sql.Stmt
+	stmtGetBalance            *sql.Stmt
+
+	stmtAddTx                        *sql.Stmt
+	stmtGetTx                        *sql.Stmt
+	stmtGetPendingTxsByUser          *sql.Stmt
+	stmtSetTxStatus                  *sql.Stmt
+	stmtGetUsersWithNonEmptyTxQueues *sql.Stmt
+	stmtSetTxRetry                   *sql.Stmt
+	stmtSetTxDeadLettered            *sql.Stmt
+	stmtRequeueTx                    *sql.Stmt
+	stmtDiscardTx                    *sql.Stmt
+	stmtGetTxsByFilter               *sql.Stmt
+
+	stmtAddJournalEntry           *sql.Stmt
+	stmtAddPostings               *sql.Stmt
+	stmtCheckBalanceAgainstLedger *sql.Stmt
+	stmtAuditLedger               *sql.Stmt
+
+	stmtAddIdempotencyKey                  *sql.Stmt
+	stmtGetIdempotencyKey                  *sql.Stmt
+	stmtDeleteIdempotencyKeysCreatedBefore *sql.Stmt
+
+	stmtAddTransfer        *sql.Stmt
+	stmtGetTransfer        *sql.Stmt
+	stmtAddTransferTx      *sql.Stmt
+	stmtGetBalancesOfUsers *sql.Stmt
+
+	stmtAddDeadLetter     *sql.Stmt
+	stmtGetDeadLetters    *sql.Stmt
+	stmtGetDeadLetter     *sql.Stmt
+	stmtResolveDeadLetter *sql.Stmt
+}
+
+func prepareStmts(ctx context.Context, s *SQLite) (err error) {
+	log.Debug().Msg("sqlite.prepareStmts START")
+	defer func() {
+		if err != nil {
+			log.Error().Err(err).Msg("sqlite.prepareStmts END")
+		} else {
+			log.Debug().Msg("sqlite.prepareStmts END")
+		}
+	}()
+
+	newStmts := stmts{}
+
+	for _, stmt := range []struct {
+		name  string
+		query string
+		stmt  **sql.Stmt
+	}{
+		{name: "add user", query: queryAddUser, stmt: &newStmts.stmtAddUser},
+		{name: "get user", query: queryGetUser, stmt: &newStmts.stmtGetUser},
+		{name: "create starting user balance", query: queryCreateStartingBalance, stmt: &newStmts.stmtCreateStartingBalance},
+		{name: "change balance", query: queryChangeBalance, stmt: &newStmts.stmtChangeBalance},
+		{name: "get balance of user", query: queryGetBalanceOfUser, stmt: &newStmts.stmtGetBalanceOfUser},
+		{name: "get balance", query: queryGetBalance, stmt: &newStmts.stmtGetBalance},
+		{name: "add tx", query: queryAddTx, stmt: &newStmts.stmtAddTx},
+		{name: "get tx", query: queryGetTx, stmt: &newStmts.stmtGetTx},
+		{name: "get pending txs by user", query: queryGetPendingTxsByUser, stmt: &newStmts.stmtGetPendingTxsByUser},
+		{name: "set tx status", query: querySetTxStatus, stmt: &newStmts.stmtSetTxStatus},
+		{name: "get users with non empty txs queues", query: queryGetUsersWithNonEmptyTxQueues, stmt: &newStmts.stmtGetUsersWithNonEmptyTxQueues},
+		{name: "set tx retry", query: querySetTxRetry, stmt: &newStmts.stmtSetTxRetry},
+		{name: "set tx dead lettered", query: querySetTxDeadLettered, stmt: &newStmts.stmtSetTxDeadLettered},
+		{name: "requeue tx", query: queryRequeueTx, stmt: &newStmts.stmtRequeueTx},
+		{name: "discard tx", query: queryDiscardTx, stmt: &newStmts.stmtDiscardTx},
+		{name: "get txs by filter", query: queryGetTxsByFilter, stmt: &newStmts.stmtGetTxsByFilter},
+		{name: "add journal entry", query: queryAddJournalEntry, stmt: &newStmts.stmtAddJournalEntry},
+		{name: "add postings", query: queryAddPostings, stmt: &newStmts.stmtAddPostings},
+		{name: "check balance against ledger", query: queryCheckBalanceAgainstLedger, stmt: &newStmts.stmtCheckBalanceAgainstLedger},
+		{name: "audit ledger", query: queryAuditLedger, stmt: &newStmts.stmtAuditLedger},
+		{name: "add idempotency key", query: queryAddIdempotencyKey, stmt: &newStmts.stmtAddIdempotencyKey},
+		{name: "get idempotency key", query: queryGetIdempotencyKey, stmt: &newStmts.stmtGetIdempotencyKey},
+		{name: "delete idempotency keys created before", query: queryDeleteIdempotencyKeysCreatedBefore, stmt: &newStmts.stmtDeleteIdempotencyKeysCreatedBefore},
+		{name: "add transfer", query: queryAddTransfer, stmt: &newStmts.stmtAddTransfer},
+		{name: "get transfer", query: queryGetTransfer, stmt: &newStmts.stmtGetTransfer},
+		{name: "add transfer tx", query: queryAddTransferTx, stmt: &newStmts.stmtAddTransferTx},
+		{name: "get balances of users", query: queryGetBalancesOfUsers, stmt: &newStmts.stmtGetBalancesOfUsers},
+		{name: "add dead letter", query: queryAddDeadLetter, stmt: &newStmts.stmtAddDeadLetter},
+		{name: "get dead letters", query: queryGetDeadLetters, stmt: &newStmts.stmtGetDeadLetters},
+		{name: "get dead letter", query: queryGetDeadLetter, stmt: &newStmts.stmtGetDeadLetter},
+		{name: "resolve dead letter", query: queryResolveDeadLetter, stmt: &newStmts.stmtResolveDeadLetter},
+	} {
+		if *stmt.stmt, err = s.db.PrepareContext(ctx, stmt.query); err != nil {
+			return fmt.Errorf("preparing `%s` stmt: %w", stmt.name, err)
+		}
+	}
+
+	s.stmts = &newStmts
+
+	return nil
+}
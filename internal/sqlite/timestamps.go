@@ -0,0 +1,70 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// timeLayout is how the timestamps are stored: UTC and fixed width, so comparing them as text compares the times.
+const timeLayout = "2006-01-02T15:04:05.000000000Z"
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
+
+// nullTime is the value of an optional time parameter.
+func nullTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: formatTime(*t), Valid: true}
+}
+
+func parseTime(src any) (t time.Time, err error) {
+	var s string
+	switch src := src.(type) {
+	case string:
+		s = src
+	case []byte:
+		s = string(src)
+	default:
+		return time.Time{}, fmt.Errorf("scanning time: unsupported type %T", src)
+	}
+
+	if t, err = time.Parse(timeLayout, s); err != nil {
+		return time.Time{}, fmt.Errorf("scanning time: %w", err)
+	}
+
+	return t, nil
+}
+
+// timeScanner scans a stored timestamp into t.
+type timeScanner struct {
+	t *time.Time
+}
+
+func (s timeScanner) Scan(src any) (err error) {
+	*s.t, err = parseTime(src)
+	return err
+}
+
+// nullTimeScanner scans an optional stored timestamp into t, NULL is scanned as nil.
+type nullTimeScanner struct {
+	t **time.Time
+}
+
+func (s nullTimeScanner) Scan(src any) error {
+	if src == nil {
+		*s.t = nil
+		return nil
+	}
+
+	t, err := parseTime(src)
+	if err != nil {
+		return err
+	}
+	*s.t = &t
+
+	return nil
+}
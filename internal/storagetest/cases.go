@@ -0,0 +1,540 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"transactions/internal/model"
+	"transactions/internal/money"
+	"transactions/internal/pg"
+)
+
+// unknownID is an ID no user, transaction or dead letter gets in a test db.
+const unknownID = int64(1) << 62
+
+func testProcessTxQueueInFIFOOrder(ctx context.Context, t T, s Storage) {
+
+	userID := addUser(t, s)
+
+	// The fourth transaction would overdraw the balance, it is rejected, and the fifth one is still applied.
+	sums := []money.Amount{1000, -300, 500, -2000, -1200}
+	wantStatuses := []model.TxStatus{model.TxStatusApplied, model.TxStatusApplied, model.TxStatusApplied, model.TxStatusRejected, model.TxStatusApplied}
+	wantBalancesAfter := []money.Amount{1000, 700, 1200, 1200, 0}
+
+	var txIDs []int64
+	for _, sum := range sums {
+		txIDs = append(txIDs, addTx(ctx, t, s, userID, sum))
+	}
+
+	balance := getBalance(ctx, t, s, userID)
+	if balance.Settled != 0 || balance.PendingReceipts != 1500 || balance.PendingWithdrawals != 3500 {
+		t.Errorf("balance before processing: got %+v, want settled 0.00, pending receipts 15.00, pending withdrawals 35.00", balance)
+	}
+
+	processed := processTxQueue(ctx, t, s, userID)
+	if len(processed) != len(sums) {
+		t.Fatalf("processed: got %d transactions, want %d", len(processed), len(sums))
+	}
+
+	for i, tx := range processed {
+		if tx.ID != txIDs[i] || tx.UserID != userID || tx.Sum != sums[i] {
+			t.Errorf("processed[%d]: got tx %d of user %d with sum %s, want tx %d of user %d with sum %s",
+				i, tx.ID, tx.UserID, tx.Sum, txIDs[i], userID, sums[i])
+		}
+		checkProcessedTx(t, tx, wantStatuses[i], wantBalancesAfter[i])
+
+		stored := getTx(ctx, t, s, txIDs[i])
+		checkProcessedTx(t, stored, wantStatuses[i], wantBalancesAfter[i])
+		if !stored.ProcessedAt.Equal(*tx.ProcessedAt) {
+			t.Errorf("tx %d: stored processed at %s, returned %s", tx.ID, stored.ProcessedAt, tx.ProcessedAt)
+		}
+	}
+
+	if processed = processTxQueue(ctx, t, s, userID); len(processed) != 0 {
+		t.Errorf("processing an empty queue: got %d processed transactions", len(processed))
+	}
+
+	checkBalance(ctx, t, s, userID, 0)
+
+	txs, err := s.GetTxs(ctx, model.TxFilter{UserID: userID, Limit: 10})
+	if err != nil {
+		t.Fatalf("getting txs: %v", err)
+	}
+	if len(txs) != len(txIDs) {
+		t.Fatalf("txs: got %d, want %d", len(txs), len(txIDs))
+	}
+	for i, tx := range txs {
+		if want := txIDs[len(txIDs)-1-i]; tx.ID != want {
+			t.Errorf("txs[%d]: got tx %d, want %d: newest first", i, tx.ID, want)
+		}
+	}
+}
+
+func checkProcessedTx(t T, tx model.Tx, wantStatus model.TxStatus, wantBalanceAfter money.Amount) {
+	t.Helper()
+
+	if tx.Status != wantStatus {
+		t.Errorf("tx %d: got status %s, want %s", tx.ID, tx.Status, wantStatus)
+	}
+	if wantStatus == model.TxStatusRejected && tx.RejectCode != model.RejectCodeInsufficientFunds {
+		t.Errorf("tx %d: got reject code %q, want %q", tx.ID, tx.RejectCode, model.RejectCodeInsufficientFunds)
+	}
+	if tx.BalanceAfter == nil || *tx.BalanceAfter != wantBalanceAfter {
+		t.Errorf("tx %d: got balance after %v, want %s", tx.ID, tx.BalanceAfter, wantBalanceAfter)
+	}
+	if tx.ProcessedAt == nil {
+		t.Errorf("tx %d: processed at is not set", tx.ID)
+	}
+}
+
+func testInsufficientFundsLeaveBalanceUntouched(ctx context.Context, t T, s Storage) {
+
+	userID := addUserWithBalance(ctx, t, s, 500)
+	otherUserID := addUserWithBalance(ctx, t, s, 100)
+
+	txID := addTx(ctx, t, s, userID, -1000)
+	processed := processTxQueue(ctx, t, s, userID)
+	if len(processed) != 1 || processed[0].ID != txID {
+		t.Fatalf("processed: got %+v, want tx %d", processed, txID)
+	}
+	checkProcessedTx(t, processed[0], model.TxStatusRejected, 500)
+	checkBalance(ctx, t, s, userID, 500)
+
+	if hasUserWithNonEmptyTxQueue(ctx, t, s, userID) {
+		t.Errorf("user %d with only a rejected tx has a non empty tx queue", userID)
+	}
+
+	_, _, err := s.Transfer(ctx, userID, otherUserID, 501, "")
+	if !errors.Is(err, pg.ErrInsufficientFunds) {
+		t.Errorf("transfer: got error %v, want %v", err, pg.ErrInsufficientFunds)
+	}
+	checkBalance(ctx, t, s, userID, 500)
+	checkBalance(ctx, t, s, otherUserID, 100)
+
+	txs, err := s.GetTxs(ctx, model.TxFilter{UserID: otherUserID, Limit: 10})
+	if err != nil {
+		t.Fatalf("getting txs: %v", err)
+	}
+	if len(txs) != 1 {
+		t.Errorf("txs of the transfer recipient: got %d, want only the receipt", len(txs))
+	}
+
+	// A rejected withdrawal doesn't block the transactions queued after it.
+	addTx(ctx, t, s, userID, -500)
+	processed = processTxQueue(ctx, t, s, userID)
+	if len(processed) != 1 {
+		t.Fatalf("processed: got %d transactions, want 1", len(processed))
+	}
+	checkProcessedTx(t, processed[0], model.TxStatusApplied, 0)
+	checkBalance(ctx, t, s, userID, 0)
+}
+
+func testUsersWithNonEmptyTxQueues(ctx context.Context, t T, s Storage) {
+
+	pendingUserID := addUser(t, s)
+	addTx(ctx, t, s, pendingUserID, 100)
+
+	processedUserID := addUserWithBalance(ctx, t, s, 100)
+
+	idleUserID := addUser(t, s)
+
+	backingOffUserID := addUser(t, s)
+	addTx(ctx, t, s, backingOffUserID, 100)
+	policy := model.RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	if _, err := s.RecordTxQueueFailure(ctx, backingOffUserID, "storagetest failure", policy); err != nil {
+		t.Fatalf("recording tx queue failure: %v", err)
+	}
+
+	for _, user := range []struct {
+		userID int64
+		want   bool
+	}{
+		{userID: pendingUserID, want: true},
+		{userID: processedUserID, want: false},
+		{userID: idleUserID, want: false},
+		{userID: backingOffUserID, want: false},
+	} {
+		if got := hasUserWithNonEmptyTxQueue(ctx, t, s, user.userID); got != user.want {
+			t.Errorf("user %d: got non empty tx queue %t, want %t", user.userID, got, user.want)
+		}
+	}
+
+	processTxQueue(ctx, t, s, pendingUserID)
+	if hasUserWithNonEmptyTxQueue(ctx, t, s, pendingUserID) {
+		t.Errorf("user %d: non empty tx queue after processing", pendingUserID)
+	}
+
+	if _, err := s.ProcessTxQueue(ctx, backingOffUserID); !errors.Is(err, pg.ErrTxQueueIsBackingOff) {
+		t.Errorf("processing a backing off tx queue: got error %v, want %v", err, pg.ErrTxQueueIsBackingOff)
+	}
+}
+
+// testUsersWithRunnableOldestTx checks that only the oldest pending transaction decides whether a queue is backing off:
+// a requeued dead letter runs before a later transaction that waits for its next attempt.
+func testUsersWithRunnableOldestTx(ctx context.Context, t T, s Storage) {
+
+	userID := addUser(t, s)
+	txID := addTx(ctx, t, s, userID, 100)
+	nextTxID := addTx(ctx, t, s, userID, 50)
+
+	deadLetterPolicy := model.RetryPolicy{MaxAttempts: 1, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	if _, err := s.RecordTxQueueFailure(ctx, userID, "storagetest failure", deadLetterPolicy); err != nil {
+		t.Fatalf("recording tx queue failure: %v", err)
+	}
+	retryPolicy := model.RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	failed, err := s.RecordTxQueueFailure(ctx, userID, "storagetest failure", retryPolicy)
+	if err != nil {
+		t.Fatalf("recording tx queue failure: %v", err)
+	}
+	if failed.ID != nextTxID || failed.Status != model.TxStatusPending || failed.NextAttemptAt == nil {
+		t.Fatalf("failure: got %+v, want tx %d pending with the next attempt time", failed, nextTxID)
+	}
+	if hasUserWithNonEmptyTxQueue(ctx, t, s, userID) {
+		t.Errorf("user %d: got non empty tx queue while its oldest tx backs off", userID)
+	}
+
+	if _, err = s.RequeueDeadLetter(ctx, findDeadLetter(ctx, t, s, txID).ID); err != nil {
+		t.Fatalf("requeueing dead letter: %v", err)
+	}
+	if !hasUserWithNonEmptyTxQueue(ctx, t, s, userID) {
+		t.Errorf("user %d: got no non empty tx queue with the requeued tx %d first", userID, txID)
+	}
+
+	processed := processTxQueue(ctx, t, s, userID)
+	if len(processed) != 2 || processed[0].ID != txID || processed[1].ID != nextTxID {
+		t.Fatalf("processed: got %+v, want txs %d and %d", processed, txID, nextTxID)
+	}
+	checkBalance(ctx, t, s, userID, 150)
+}
+
+func testUnknownUserAndTx(ctx context.Context, t T, s Storage) {
+
+	userID := addUserWithBalance(ctx, t, s, 100)
+
+	if _, _, err := s.AddTx(ctx, unknownID, 100, model.TxDetails{}, ""); !errors.Is(err, pg.ErrUserNotFound) {
+		t.Errorf("adding tx: got error %v, want %v", err, pg.ErrUserNotFound)
+	}
+	if _, err := s.GetBalance(ctx, unknownID); !errors.Is(err, pg.ErrUserNotFound) {
+		t.Errorf("getting balance: got error %v, want %v", err, pg.ErrUserNotFound)
+	}
+	if _, err := s.ProcessTxQueue(ctx, unknownID); !errors.Is(err, pg.ErrUserNotFound) {
+		t.Errorf("processing tx queue: got error %v, want %v", err, pg.ErrUserNotFound)
+	}
+	if _, _, err := s.Transfer(ctx, userID, unknownID, 100, ""); !errors.Is(err, pg.ErrUserNotFound) {
+		t.Errorf("transfer: got error %v, want %v", err, pg.ErrUserNotFound)
+	}
+	if _, err := s.GetTx(ctx, unknownID); !errors.Is(err, pg.ErrTxNotFound) {
+		t.Errorf("getting tx: got error %v, want %v", err, pg.ErrTxNotFound)
+	}
+	if _, err := s.RequeueDeadLetter(ctx, unknownID); !errors.Is(err, pg.ErrDeadLetterNotFound) {
+		t.Errorf("requeueing dead letter: got error %v, want %v", err, pg.ErrDeadLetterNotFound)
+	}
+
+	checkBalance(ctx, t, s, userID, 100)
+}
+
+func testTxDetails(ctx context.Context, t T, s Storage) {
+
+	userID := addUser(t, s)
+	details := model.TxDetails{Currency: "USD", Description: "salary, March", ExternalReference: "invoice-42"}
+
+	txID, _, err := s.AddTx(ctx, userID, 100, details, "")
+	if err != nil {
+		t.Fatalf("adding tx with details: %v", err)
+	}
+	noDetailsTxID := addTx(ctx, t, s, userID, 100)
+	processTxQueue(ctx, t, s, userID)
+
+	if tx := getTx(ctx, t, s, txID); tx.TxDetails != details {
+		t.Errorf("getting tx: got details %+v, want %+v", tx.TxDetails, details)
+	}
+	if tx := getTx(ctx, t, s, noDetailsTxID); tx.TxDetails != (model.TxDetails{}) {
+		t.Errorf("getting tx with no details: got details %+v, want none", tx.TxDetails)
+	}
+
+	txs, err := s.GetTxs(ctx, model.TxFilter{UserID: userID, Limit: 10})
+	if err != nil {
+		t.Fatalf("getting txs: %v", err)
+	}
+	if len(txs) != 2 || txs[1].ID != txID || txs[1].TxDetails != details {
+		t.Errorf("getting txs: got %+v, want tx %d with details %+v last", txs, txID, details)
+	}
+}
+
+func testIdempotencyKeys(ctx context.Context, t T, s Storage) {
+
+	userID := addUserWithBalance(ctx, t, s, 1000)
+	otherUserID := addUser(t, s)
+
+	// The keys are unique per run, so the case passes on a db with the keys of the previous runs.
+	key := fmt.Sprintf("storagetest:%d:%d", userID, time.Now().UnixNano())
+
+	txID, isReplay, err := s.AddTx(ctx, userID, -100, model.TxDetails{}, key)
+	if err != nil || isReplay {
+		t.Fatalf("adding tx: got replay %t, error %v", isReplay, err)
+	}
+	replayTxID, isReplay, err := s.AddTx(ctx, userID, -100, model.TxDetails{}, key)
+	if err != nil || !isReplay || replayTxID != txID {
+		t.Errorf("replaying tx: got tx %d, replay %t, error %v, want tx %d replayed", replayTxID, isReplay, err, txID)
+	}
+	if _, _, err = s.AddTx(ctx, userID, -200, model.TxDetails{}, key); !errors.Is(err, pg.ErrIdempotencyKeyReused) {
+		t.Errorf("reusing key for another sum: got error %v, want %v", err, pg.ErrIdempotencyKeyReused)
+	}
+	if _, _, err = s.AddTx(ctx, otherUserID, -100, model.TxDetails{}, key); !errors.Is(err, pg.ErrIdempotencyKeyReused) {
+		t.Errorf("reusing key for another user: got error %v, want %v", err, pg.ErrIdempotencyKeyReused)
+	}
+	if _, _, err = s.Transfer(ctx, userID, otherUserID, 100, key); !errors.Is(err, pg.ErrIdempotencyKeyReused) {
+		t.Errorf("reusing key for a transfer: got error %v, want %v", err, pg.ErrIdempotencyKeyReused)
+	}
+
+	transferKey := key + ":transfer"
+	transfer, isReplay, err := s.Transfer(ctx, userID, otherUserID, 100, transferKey)
+	if err != nil || isReplay {
+		t.Fatalf("transfer: got replay %t, error %v", isReplay, err)
+	}
+	replayTransfer, isReplay, err := s.Transfer(ctx, userID, otherUserID, 100, transferKey)
+	if err != nil || !isReplay || replayTransfer.ID != transfer.ID || replayTransfer.FromBalanceAfter != transfer.FromBalanceAfter {
+		t.Errorf("replaying transfer: got %+v, replay %t, error %v, want %+v replayed", replayTransfer, isReplay, err, transfer)
+	}
+
+	processTxQueue(ctx, t, s, userID)
+	checkBalance(ctx, t, s, userID, 800)
+	checkBalance(ctx, t, s, otherUserID, 100)
+}
+
+func testRetriesAndDeadLetters(ctx context.Context, t T, s Storage) {
+
+	userID := addUser(t, s)
+	txID := addTx(ctx, t, s, userID, 100)
+	nextTxID := addTx(ctx, t, s, userID, 50)
+
+	policy := model.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Hour, MaxDelay: time.Hour}
+
+	failed, err := s.RecordTxQueueFailure(ctx, userID, "storagetest failure", policy)
+	if err != nil {
+		t.Fatalf("recording tx queue failure: %v", err)
+	}
+	if failed.ID != txID || failed.Status != model.TxStatusPending || failed.Attempts != 1 || failed.NextAttemptAt == nil {
+		t.Errorf("first failure: got %+v, want tx %d pending with 1 attempt and the next attempt time", failed, txID)
+	}
+
+	failed, err = s.RecordTxQueueFailure(ctx, userID, "storagetest failure", policy)
+	if err != nil {
+		t.Fatalf("recording tx queue failure: %v", err)
+	}
+	if failed.ID != txID || failed.Status != model.TxStatusDeadLettered || failed.Attempts != 2 {
+		t.Errorf("last failure: got %+v, want tx %d dead-lettered with 2 attempts", failed, txID)
+	}
+
+	// The queue goes on without the dead-lettered transaction.
+	processed := processTxQueue(ctx, t, s, userID)
+	if len(processed) != 1 || processed[0].ID != nextTxID {
+		t.Fatalf("processed: got %+v, want tx %d", processed, nextTxID)
+	}
+	checkProcessedTx(t, processed[0], model.TxStatusApplied, 50)
+
+	deadLetter := findDeadLetter(ctx, t, s, txID)
+	if deadLetter.UserID != userID || deadLetter.Sum != 100 || deadLetter.Attempts != 2 || deadLetter.LastError != "storagetest failure" {
+		t.Errorf("dead letter: got %+v", deadLetter)
+	}
+
+	requeued, err := s.RequeueDeadLetter(ctx, deadLetter.ID)
+	if err != nil {
+		t.Fatalf("requeueing dead letter: %v", err)
+	}
+	if requeued.ResolvedAt == nil || requeued.Resolution != model.DeadLetterResolutionRequeued {
+		t.Errorf("requeued dead letter: got %+v", requeued)
+	}
+	if _, err = s.DiscardDeadLetter(ctx, deadLetter.ID); !errors.Is(err, pg.ErrDeadLetterIsResolved) {
+		t.Errorf("discarding a resolved dead letter: got error %v, want %v", err, pg.ErrDeadLetterIsResolved)
+	}
+
+	processed = processTxQueue(ctx, t, s, userID)
+	if len(processed) != 1 || processed[0].ID != txID {
+		t.Fatalf("processed after requeue: got %+v, want tx %d", processed, txID)
+	}
+	checkProcessedTx(t, processed[0], model.TxStatusApplied, 150)
+	checkBalance(ctx, t, s, userID, 150)
+}
+
+// findDeadLetter pages through the unresolved dead letters for the one of the transaction.
+func findDeadLetter(ctx context.Context, t T, s Storage, txID int64) (deadLetter model.DeadLetter) {
+	t.Helper()
+
+	var cursor int64
+	for {
+		deadLetters, err := s.GetDeadLetters(ctx, cursor, 100)
+		if err != nil {
+			t.Fatalf("getting dead letters: %v", err)
+		}
+		for _, deadLetter = range deadLetters {
+			if deadLetter.TxID == txID {
+				return deadLetter
+			}
+		}
+		if len(deadLetters) < 100 {
+			t.Fatalf("no dead letter of tx %d", txID)
+		}
+		cursor = deadLetters[len(deadLetters)-1].ID
+	}
+}
+
+func testConcurrentAddAndProcess(ctx context.Context, t T, s Storage) {
+
+	const (
+		clients       = 20
+		txsPerClient  = 10
+		processors    = 5
+		processorRuns = 20
+	)
+
+	userID := addUser(t, s)
+
+	var mu sync.Mutex
+	added := map[int64]money.Amount{}
+	timesProcessed := map[int64]int{}
+	record := func(processed []model.Tx) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, tx := range processed {
+			timesProcessed[tx.ID]++
+		}
+	}
+
+	// Clients queue receipts and withdrawals and process the queue right away, like the requests do,
+	// while the processors process it concurrently, like the sweeps and the other instances do.
+	var wg sync.WaitGroup
+	for client := 0; client < clients; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			for i := 0; i < txsPerClient; i++ {
+				sum := money.Amount(100)
+				if (client+i)%2 == 1 {
+					sum = -150
+				}
+				txID, _, err := s.AddTx(ctx, userID, sum, model.TxDetails{}, "")
+				if err != nil {
+					t.Errorf("adding tx: %v", err)
+					return
+				}
+				mu.Lock()
+				added[txID] = sum
+				mu.Unlock()
+
+				processed, err := s.ProcessTxQueue(ctx, userID)
+				if err != nil {
+					t.Errorf("processing tx queue: %v", err)
+					return
+				}
+				record(processed)
+			}
+		}(client)
+	}
+	for processor := 0; processor < processors; processor++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < processorRuns; i++ {
+				processed, err := s.ProcessTxQueue(ctx, userID)
+				if err != nil {
+					t.Errorf("processing tx queue: %v", err)
+					return
+				}
+				record(processed)
+			}
+		}()
+	}
+	wg.Wait()
+
+	record(processTxQueue(ctx, t, s, userID))
+
+	if len(added) != clients*txsPerClient {
+		t.Fatalf("added: got %d transactions, want %d", len(added), clients*txsPerClient)
+	}
+
+	var settled money.Amount
+	for txID, sum := range added {
+		if timesProcessed[txID] != 1 {
+			t.Errorf("tx %d: processed %d times, want once", txID, timesProcessed[txID])
+		}
+		tx := getTx(ctx, t, s, txID)
+		switch tx.Status {
+		case model.TxStatusApplied:
+			settled += sum
+		case model.TxStatusRejected:
+		default:
+			t.Errorf("tx %d: got status %s after processing", txID, tx.Status)
+		}
+	}
+	for txID := range timesProcessed {
+		if _, ok := added[txID]; !ok {
+			t.Errorf("tx %d: processed but not added", txID)
+		}
+	}
+
+	if settled < 0 {
+		t.Errorf("settled balance: got %s, overdrawn", settled)
+	}
+	checkBalance(ctx, t, s, userID, settled)
+}
+
+func testConcurrentTransfers(ctx context.Context, t T, s Storage) {
+
+	const (
+		transfersPerSide = 50
+		amount           = money.Amount(30)
+	)
+
+	firstUserID := addUserWithBalance(ctx, t, s, 500)
+	secondUserID := addUserWithBalance(ctx, t, s, 500)
+
+	// Transfers in both directions at once must neither deadlock nor overdraw.
+	var wg sync.WaitGroup
+	for i := 0; i < 2*transfersPerSide; i++ {
+		from, to := firstUserID, secondUserID
+		if i%2 == 1 {
+			from, to = to, from
+		}
+		wg.Add(1)
+		go func(from, to int64) {
+			defer wg.Done()
+			if _, _, err := s.Transfer(ctx, from, to, amount, ""); err != nil && !errors.Is(err, pg.ErrInsufficientFunds) {
+				t.Errorf("transfer: from %d: to %d: %v", from, to, err)
+			}
+		}(from, to)
+	}
+	wg.Wait()
+
+	first, second := getBalance(ctx, t, s, firstUserID), getBalance(ctx, t, s, secondUserID)
+	if first.Settled < 0 || second.Settled < 0 || first.Settled+second.Settled != 1000 {
+		t.Errorf("balances: got %s and %s, want non negative with the total 10.00", first.Settled, second.Settled)
+	}
+}
+
+func testClose(ctx context.Context, t T, s Storage) {
+
+	userID := addUser(t, s)
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("closing storage: %v", err)
+	}
+
+	if _, _, err := s.AddTx(ctx, userID, 100, model.TxDetails{}, ""); err == nil {
+		t.Errorf("adding tx after close: got no error")
+	}
+	if _, err := s.ProcessTxQueue(ctx, userID); err == nil {
+		t.Errorf("processing tx queue after close: got no error")
+	}
+	if _, err := s.GetBalance(ctx, userID); err == nil {
+		t.Errorf("getting balance after close: got no error")
+	}
+
+	// The storage is closed once more at the end of the case: closing is idempotent.
+	if err := s.Close(); err != nil {
+		t.Errorf("closing storage again: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+// Package storagetest is the conformance suite of the api.Storage implementations: the pg, sqlite and memstore
+// storages must all pass it. It is a plain package, not a _test one, so the suite runs both from go test
+// with Run and against a real db with cmd/storagetest.
+package storagetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"transactions/internal/api"
+	"transactions/internal/model"
+	"transactions/internal/money"
+)
+
+// caseTimeout bounds every case, so a deadlock in a storage fails the case instead of hanging the suite.
+const caseTimeout = time.Minute
+
+// Storage is a storage under test. The cases add their own users, so the suite may run against a db with other data.
+type Storage interface {
+	api.Storage
+	AddUser() (userID int64, err error)
+}
+
+// Factory opens a storage for one case. The storage is closed at the end of the case.
+type Factory func() (Storage, error)
+
+// T is the part of *testing.T the cases use. Errorf may be called from any goroutine, Fatalf only from the case's one.
+type T interface {
+	Helper()
+	Errorf(format string, args ...any)
+	Fatalf(format string, args ...any)
+}
+
+// Case is one check of the storage contract.
+type Case struct {
+	Name string
+	Test func(ctx context.Context, t T, s Storage)
+}
+
+// Cases are all the checks of the suite.
+var Cases = []Case{
+	{Name: "ProcessTxQueueInFIFOOrder", Test: testProcessTxQueueInFIFOOrder},
+	{Name: "InsufficientFundsLeaveBalanceUntouched", Test: testInsufficientFundsLeaveBalanceUntouched},
+	{Name: "UsersWithNonEmptyTxQueues", Test: testUsersWithNonEmptyTxQueues},
+	{Name: "UsersWithRunnableOldestTx", Test: testUsersWithRunnableOldestTx},
+	{Name: "UnknownUserAndTx", Test: testUnknownUserAndTx},
+	{Name: "TxDetails", Test: testTxDetails},
+	{Name: "IdempotencyKeys", Test: testIdempotencyKeys},
+	{Name: "RetriesAndDeadLetters", Test: testRetriesAndDeadLetters},
+	{Name: "ConcurrentAddAndProcess", Test: testConcurrentAddAndProcess},
+	{Name: "ConcurrentTransfers", Test: testConcurrentTransfers},
+	{Name: "Close", Test: testClose},
+}
+
+// Run runs every case as a subtest of t, each one with a new storage. For example:
+//
+//	func TestMemStore(t *testing.T) {
+//		storagetest.Run(t, func() (storagetest.Storage, error) { return memstore.New(), nil })
+//	}
+func Run(t *testing.T, newStorage Factory) {
+	for _, c := range Cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			RunCase(t, c, newStorage)
+		})
+	}
+}
+
+// RunCase runs the case with a new storage and closes the storage after it.
+func RunCase(t T, c Case, newStorage Factory) {
+	t.Helper()
+
+	s, err := newStorage()
+	if err != nil {
+		t.Fatalf("opening storage: %v", err)
+	}
+	defer func() {
+		if err := s.Close(); err != nil {
+			t.Errorf("closing storage: %v", err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), caseTimeout)
+	defer cancel()
+
+	c.Test(ctx, t, s)
+}
+
+func addUser(t T, s Storage) (userID int64) {
+	t.Helper()
+
+	userID, err := s.AddUser()
+	if err != nil {
+		t.Fatalf("adding user: %v", err)
+	}
+
+	return userID
+}
+
+// addUserWithBalance adds a user and gives the user the balance with a processed receipt.
+func addUserWithBalance(ctx context.Context, t T, s Storage, balance money.Amount) (userID int64) {
+	t.Helper()
+
+	userID = addUser(t, s)
+	addTx(ctx, t, s, userID, balance)
+	processTxQueue(ctx, t, s, userID)
+
+	return userID
+}
+
+func addTx(ctx context.Context, t T, s Storage, userID int64, sum money.Amount) (txID int64) {
+	t.Helper()
+
+	txID, isReplay, err := s.AddTx(ctx, userID, sum, model.TxDetails{}, "")
+	if err != nil {
+		t.Fatalf("adding tx: userID: %d: sum: %s: %v", userID, sum, err)
+	}
+	if isReplay {
+		t.Fatalf("adding tx: userID: %d: sum: %s: replayed with no idempotency key", userID, sum)
+	}
+
+	return txID
+}
+
+func processTxQueue(ctx context.Context, t T, s Storage, userID int64) (processed []model.Tx) {
+	t.Helper()
+
+	processed, err := s.ProcessTxQueue(ctx, userID)
+	if err != nil {
+		t.Fatalf("processing tx queue: userID: %d: %v", userID, err)
+	}
+
+	return processed
+}
+
+func getTx(ctx context.Context, t T, s Storage, txID int64) (tx model.Tx) {
+	t.Helper()
+
+	tx, err := s.GetTx(ctx, txID)
+	if err != nil {
+		t.Fatalf("getting tx: txID: %d: %v", txID, err)
+	}
+
+	return tx
+}
+
+func getBalance(ctx context.Context, t T, s Storage, userID int64) (balance model.Balance) {
+	t.Helper()
+
+	balance, err := s.GetBalance(ctx, userID)
+	if err != nil {
+		t.Fatalf("getting balance: userID: %d: %v", userID, err)
+	}
+
+	return balance
+}
+
+// checkBalance checks the settled balance of the user and that nothing of the user is pending.
+func checkBalance(ctx context.Context, t T, s Storage, userID int64, settled money.Amount) {
+	t.Helper()
+
+	balance := getBalance(ctx, t, s, userID)
+	if balance.Settled != settled || balance.PendingReceipts != 0 || balance.PendingWithdrawals != 0 {
+		t.Errorf("balance: userID: %d: got settled %s, pending receipts %s, pending withdrawals %s, want settled %s and nothing pending",
+			userID, balance.Settled, balance.PendingReceipts, balance.PendingWithdrawals, settled)
+	}
+}
+
+func hasUserWithNonEmptyTxQueue(ctx context.Context, t T, s Storage, userID int64) bool {
+	t.Helper()
+
+	users, err := s.GetUsersWithNonEmptyTxQueues(ctx)
+	if err != nil {
+		t.Fatalf("getting users with non empty tx queues: %v", err)
+	}
+
+	for _, user := range users {
+		if user == userID {
+			return true
+		}
+	}
+
+	return false
+}
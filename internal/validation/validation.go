@@ -0,0 +1,155 @@
+// Package validation checks the amounts of the requests before they reach the storage.
+// Every rejection is an *Error with a machine-readable Code, so clients can branch on the code instead of the message.
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"transactions/internal/money"
+)
+
+var errInvalidLimits = errors.New("invalid amount limits")
+var errInvalidMaxPrecision = errors.New("invalid amount max precision")
+
+// Code is the machine-readable reason of a rejected amount.
+type Code string
+
+const (
+	CodeAmountIsEmpty Code = "amount_is_empty"
+	// CodeAmountIsInvalid is anything but a plain decimal: NaN, Inf, 1e308, 1,5 and so on.
+	CodeAmountIsInvalid   Code = "amount_is_invalid"
+	CodeAmountIsTooLarge  Code = "amount_is_too_large"
+	CodeAmountTooPrecise  Code = "amount_too_precise"
+	CodeAmountNotPositive Code = "amount_not_positive"
+	CodeAmountBelowMin    Code = "amount_below_min"
+	CodeAmountAboveMax    Code = "amount_above_max"
+)
+
+// Error is a rejected amount.
+type Error struct {
+	Code    Code
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func newError(code Code, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Operation is what the amount is for, every operation has its own limits.
+type Operation string
+
+const (
+	OperationReceipt  Operation = "receipt"
+	OperationWithdraw Operation = "withdraw"
+	OperationTransfer Operation = "transfer"
+)
+
+// Limits bound the amount of an operation, both inclusive. A zero Min or Max doesn't bound it.
+type Limits struct {
+	Min money.Amount
+	Max money.Amount
+}
+
+// ParseLimits parses the limits written as "min:max", e.g. "0.10:1000". Either side may be empty, so may be the whole string.
+func ParseLimits(s string) (limits Limits, err error) {
+
+	if s == "" {
+		return Limits{}, nil
+	}
+
+	reqMin, reqMax, ok := strings.Cut(s, ":")
+	if !ok {
+		return Limits{}, fmt.Errorf("%w: %q: expected min:max", errInvalidLimits, s)
+	}
+
+	for _, side := range []struct {
+		s    string
+		dest *money.Amount
+	}{
+		{s: reqMin, dest: &limits.Min},
+		{s: reqMax, dest: &limits.Max},
+	} {
+		if side.s == "" {
+			continue
+		}
+		if *side.dest, err = money.Parse(side.s); err != nil || *side.dest <= 0 {
+			return Limits{}, fmt.Errorf("%w: %q: %q is not a positive amount", errInvalidLimits, s, side.s)
+		}
+	}
+
+	if limits.Min != 0 && limits.Max != 0 && limits.Min > limits.Max {
+		return Limits{}, fmt.Errorf("%w: %q: min is greater than max", errInvalidLimits, s)
+	}
+
+	return limits, nil
+}
+
+// AmountValidator parses the amounts of the operations: positive plain decimals
+// with at most maxPrecision significant digits after the point, within the limits of the operation.
+type AmountValidator struct {
+	maxPrecision int
+	// precisionUnit is the least amount with maxPrecision digits after the point, e.g. 0.10 for the precision of 1.
+	precisionUnit money.Amount
+	limits        map[Operation]Limits
+}
+
+// NewAmountValidator makes a validator. maxPrecision is from 0 (whole units only) to money.Scale,
+// the operations with no limits are bounded by nothing but maxPrecision.
+func NewAmountValidator(maxPrecision int, limits map[Operation]Limits) (*AmountValidator, error) {
+
+	if maxPrecision < 0 || maxPrecision > money.Scale {
+		return nil, fmt.Errorf("%w: %d, must be from 0 to %d", errInvalidMaxPrecision, maxPrecision, money.Scale)
+	}
+
+	newValidator := &AmountValidator{maxPrecision: maxPrecision, precisionUnit: 1, limits: map[Operation]Limits{}}
+	for i := maxPrecision; i < money.Scale; i++ {
+		newValidator.precisionUnit *= 10
+	}
+	for operation, operationLimits := range limits {
+		newValidator.limits[operation] = operationLimits
+	}
+
+	return newValidator, nil
+}
+
+// ParseAmount parses the amount of the operation, or returns an *Error telling why it is rejected.
+func (v *AmountValidator) ParseAmount(operation Operation, s string) (amount money.Amount, err error) {
+
+	if s == "" {
+		return 0, newError(CodeAmountIsEmpty, "amount is empty")
+	}
+
+	// Zeros after the last significant digit don't count: "1.50" has the precision of 1, and money.Parse takes "1.500" for 1.50.
+	amount, err = money.Parse(s)
+	switch {
+	case errors.Is(err, money.ErrAmountTooPrecise):
+		return 0, newError(CodeAmountTooPrecise, "amount %q has more than %d digits after the point", s, v.maxPrecision)
+	case errors.Is(err, money.ErrAmountOverflow):
+		return 0, newError(CodeAmountIsTooLarge, "amount %q is too large", s)
+	case err != nil:
+		return 0, newError(CodeAmountIsInvalid, "amount %q is not a decimal number like 12.34", s)
+	}
+	if amount%v.precisionUnit != 0 {
+		return 0, newError(CodeAmountTooPrecise, "amount %q has more than %d digits after the point", s, v.maxPrecision)
+	}
+
+	if amount <= 0 {
+		return 0, newError(CodeAmountNotPositive, "amount %q is not positive", s)
+	}
+
+	limits := v.limits[operation]
+	if limits.Min != 0 && amount < limits.Min {
+		return 0, newError(CodeAmountBelowMin, "%s amount %s is below the min %s", operation, amount, limits.Min)
+	}
+	if limits.Max != 0 && amount > limits.Max {
+		return 0, newError(CodeAmountAboveMax, "%s amount %s is above the max %s", operation, amount, limits.Max)
+	}
+
+	return amount, nil
+}
@@ -0,0 +1,119 @@
+package validation
+
+import (
+	"errors"
+	"testing"
+
+	"transactions/internal/money"
+)
+
+func TestParseAmount(t *testing.T) {
+
+	limits := map[Operation]Limits{OperationReceipt: {Min: 10, Max: 100000}}
+
+	for _, tc := range []struct {
+		amount       string
+		maxPrecision int
+		operation    Operation
+		wantCode     Code
+		wantAmount   money.Amount
+	}{
+		{amount: "12.34", maxPrecision: 2, operation: OperationWithdraw, wantAmount: 1234},
+		{amount: "7", maxPrecision: 0, operation: OperationWithdraw, wantAmount: 700},
+		{amount: "+5", maxPrecision: 2, operation: OperationWithdraw, wantAmount: 500},
+
+		{amount: "", maxPrecision: 2, operation: OperationWithdraw, wantCode: CodeAmountIsEmpty},
+
+		{amount: "NaN", maxPrecision: 2, operation: OperationWithdraw, wantCode: CodeAmountIsInvalid},
+		{amount: "Inf", maxPrecision: 2, operation: OperationWithdraw, wantCode: CodeAmountIsInvalid},
+		{amount: "1e308", maxPrecision: 2, operation: OperationWithdraw, wantCode: CodeAmountIsInvalid},
+		{amount: "1,5", maxPrecision: 2, operation: OperationWithdraw, wantCode: CodeAmountIsInvalid},
+		{amount: ".5", maxPrecision: 2, operation: OperationWithdraw, wantCode: CodeAmountIsInvalid},
+		{amount: "5.", maxPrecision: 2, operation: OperationWithdraw, wantCode: CodeAmountIsInvalid},
+		{amount: " 5", maxPrecision: 2, operation: OperationWithdraw, wantCode: CodeAmountIsInvalid},
+
+		{amount: "92233720368547758.08", maxPrecision: 2, operation: OperationWithdraw, wantCode: CodeAmountIsTooLarge},
+		{amount: "92233720368547758.07", maxPrecision: 2, operation: OperationWithdraw, wantAmount: 9223372036854775807},
+
+		{amount: "1.505", maxPrecision: 2, operation: OperationWithdraw, wantCode: CodeAmountTooPrecise},
+		{amount: "1.55", maxPrecision: 1, operation: OperationWithdraw, wantCode: CodeAmountTooPrecise},
+		{amount: "1.5", maxPrecision: 0, operation: OperationWithdraw, wantCode: CodeAmountTooPrecise},
+		// Zeros after the last significant digit don't count.
+		{amount: "1.50", maxPrecision: 1, operation: OperationWithdraw, wantAmount: 150},
+		{amount: "2.000", maxPrecision: 0, operation: OperationWithdraw, wantAmount: 200},
+
+		{amount: "0", maxPrecision: 2, operation: OperationWithdraw, wantCode: CodeAmountNotPositive},
+		{amount: "-50", maxPrecision: 2, operation: OperationWithdraw, wantCode: CodeAmountNotPositive},
+		{amount: "-0.00", maxPrecision: 2, operation: OperationWithdraw, wantCode: CodeAmountNotPositive},
+
+		{amount: "0.09", maxPrecision: 2, operation: OperationReceipt, wantCode: CodeAmountBelowMin},
+		{amount: "0.10", maxPrecision: 2, operation: OperationReceipt, wantAmount: 10},
+		{amount: "1000", maxPrecision: 2, operation: OperationReceipt, wantAmount: 100000},
+		{amount: "1000.01", maxPrecision: 2, operation: OperationReceipt, wantCode: CodeAmountAboveMax},
+		// The limits are per operation.
+		{amount: "1000.01", maxPrecision: 2, operation: OperationTransfer, wantAmount: 100001},
+	} {
+		validator, err := NewAmountValidator(tc.maxPrecision, limits)
+		if err != nil {
+			t.Fatalf("creating validator: %v", err)
+		}
+
+		amount, err := validator.ParseAmount(tc.operation, tc.amount)
+
+		var validationErr *Error
+		switch {
+		case tc.wantCode == "" && err != nil:
+			t.Errorf("%s %q at precision %d: got error %v, want %s", tc.operation, tc.amount, tc.maxPrecision, err, tc.wantAmount)
+		case tc.wantCode == "" && amount != tc.wantAmount:
+			t.Errorf("%s %q at precision %d: got %s, want %s", tc.operation, tc.amount, tc.maxPrecision, amount, tc.wantAmount)
+		case tc.wantCode != "" && !errors.As(err, &validationErr):
+			t.Errorf("%s %q at precision %d: got %s, %v, want code %s", tc.operation, tc.amount, tc.maxPrecision, amount, err, tc.wantCode)
+		case tc.wantCode != "" && validationErr.Code != tc.wantCode:
+			t.Errorf("%s %q at precision %d: got code %s, want %s", tc.operation, tc.amount, tc.maxPrecision, validationErr.Code, tc.wantCode)
+		}
+	}
+}
+
+func TestNewAmountValidatorPrecision(t *testing.T) {
+
+	for _, maxPrecision := range []int{-1, money.Scale + 1} {
+		if _, err := NewAmountValidator(maxPrecision, nil); !errors.Is(err, errInvalidMaxPrecision) {
+			t.Errorf("precision %d: got %v, want %v", maxPrecision, err, errInvalidMaxPrecision)
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+
+	for _, tc := range []struct {
+		s          string
+		wantLimits Limits
+		wantErr    bool
+	}{
+		{s: "", wantLimits: Limits{}},
+		{s: ":", wantLimits: Limits{}},
+		{s: "0.10:1000", wantLimits: Limits{Min: 10, Max: 100000}},
+		{s: "0.10:", wantLimits: Limits{Min: 10}},
+		{s: ":1000", wantLimits: Limits{Max: 100000}},
+		{s: "5:5", wantLimits: Limits{Min: 500, Max: 500}},
+
+		{s: "1000", wantErr: true},
+		{s: "abc:1000", wantErr: true},
+		{s: "0.10:abc", wantErr: true},
+		{s: "0:1000", wantErr: true},
+		{s: "-1:1000", wantErr: true},
+		{s: "0.10:-5", wantErr: true},
+		{s: "1000:0.10", wantErr: true},
+		{s: "0.10:1000:5000", wantErr: true},
+	} {
+		limits, err := ParseLimits(tc.s)
+		switch {
+		case tc.wantErr && !errors.Is(err, errInvalidLimits):
+			t.Errorf("%q: got %+v, %v, want %v", tc.s, limits, err, errInvalidLimits)
+		case !tc.wantErr && err != nil:
+			t.Errorf("%q: got error %v, want %+v", tc.s, err, tc.wantLimits)
+		case !tc.wantErr && limits != tc.wantLimits:
+			t.Errorf("%q: got %+v, want %+v", tc.s, limits, tc.wantLimits)
+		}
+	}
+}